@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/perses/perses/pkg/model/api/v1/common"
+)
+
+// Every dashboard is analyzed for the Grafana features the migration drops or replaces with a placeholder, so that
+// the manual work can be triaged. The Grafana dashboard shows what is dropped: transformations, field overrides,
+// data links, dashboard links, annotations and legacy alerts. The Perses dashboard shows the panels, queries and
+// variables the migration replaced with a placeholder, whichever backend migrated them.
+// With --analyze-only, dashboards are only upgraded and converted in memory and nothing but the report is written.
+
+const (
+	featurePanel          = "panel"
+	featureQuery          = "query"
+	featureVariable       = "variable"
+	featureVariableUsage  = "variable-usage"
+	featureTransformation = "transformation"
+	featureFieldOverride  = "field-override"
+	featureDataLink       = "data-link"
+	featureDashboardLink  = "dashboard-link"
+	featureAnnotation     = "annotation"
+	featureAlert          = "alert"
+)
+
+// unsupportedFeatures orders the features in the summary
+var unsupportedFeatures = []string{
+	featurePanel, featureQuery, featureVariable, featureVariableUsage, featureTransformation, featureFieldOverride,
+	featureDataLink, featureDashboardLink, featureAnnotation, featureAlert,
+}
+
+// unsupportedFeature is a Grafana feature of a dashboard that needs manual work after the migration
+type unsupportedFeature struct {
+	Feature string `json:"feature"`
+	Panel   string `json:"panel,omitempty"` // title of the Grafana panel
+	Detail  string `json:"detail,omitempty"`
+}
+
+// analyzeDashboard lists the unsupported features of a Grafana dashboard (latest schema) and of its migration
+func analyzeDashboard(grafanaData, persesData []byte) ([]unsupportedFeature, error) {
+	var grafana map[string]any
+	if err := json.Unmarshal(grafanaData, &grafana); err != nil {
+		return nil, fmt.Errorf("failed to parse Grafana dashboard: %v", err)
+	}
+	var typed grafanaDashboard
+	if err := json.Unmarshal(grafanaData, &typed); err != nil {
+		return nil, fmt.Errorf("failed to parse Grafana dashboard: %v", err)
+	}
+	var perses map[string]any
+	if err := json.Unmarshal(persesData, &perses); err != nil {
+		return nil, fmt.Errorf("failed to parse Perses dashboard: %v", err)
+	}
+
+	features := findPlaceholders(perses, typed)
+	features = append(features, findDroppedFeatures(grafana)...)
+	return features, nil
+}
+
+// findPlaceholders lists the panels, queries and variables of a migrated dashboard that are placeholders. The
+// panel keys are the positions of the Grafana panels, with the panels of expanded rows moved into their row.
+func findPlaceholders(perses map[string]any, grafana grafanaDashboard) []unsupportedFeature {
+	grafanaPanels := make(map[string]grafanaPanel)
+	for i, panel := range rearrangePanelsWithinExpandedRows(grafana.Panels) {
+		if panel.Type != grafanaPanelRowType {
+			grafanaPanels[fmt.Sprint(i)] = panel
+			continue
+		}
+		for j, innerPanel := range panel.Panels {
+			grafanaPanels[fmt.Sprintf("%d_%d", i, j)] = innerPanel
+		}
+	}
+
+	spec, _ := perses["spec"].(map[string]any)
+	panels, _ := spec["panels"].(map[string]any)
+	keys := make([]string, 0, len(panels))
+	for key := range panels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var features []unsupportedFeature
+	for _, key := range keys {
+		panel, _ := panels[key].(map[string]any)
+		panelSpec, _ := panel["spec"].(map[string]any)
+		source := grafanaPanels[key]
+
+		if isPlaceholder(panelSpec["plugin"], unsupportedPanelPlugin, "text") {
+			features = append(features, unsupportedFeature{Feature: featurePanel, Panel: source.Title, Detail: source.Type})
+			continue
+		}
+		queries, _ := panelSpec["queries"].([]any)
+		for i, query := range queries {
+			fields, _ := query.(map[string]any)
+			querySpec, _ := fields["spec"].(map[string]any)
+			if !isPlaceholder(querySpec["plugin"], unsupportedQueryPlugin, "query") {
+				continue
+			}
+			detail := ""
+			if i < len(source.Targets) {
+				detail = targetDatasourceType(source.Targets[i], source.Datasource, grafana.Templating.List)
+			}
+			features = append(features, unsupportedFeature{Feature: featureQuery, Panel: source.Title, Detail: detail})
+		}
+	}
+
+	grafanaVariables := make(map[string]string)
+	for _, v := range grafana.Templating.List {
+		grafanaVariables[v.Name] = v.Type
+	}
+	variables, _ := spec["variables"].([]any)
+	for _, v := range variables {
+		fields, _ := v.(map[string]any)
+		variableSpec, _ := fields["spec"].(map[string]any)
+		if !isPlaceholder(variableSpec["plugin"], unsupportedVariablePlugin, "values") {
+			continue
+		}
+		name, _ := variableSpec["name"].(string)
+		features = append(features, unsupportedFeature{Feature: featureVariable, Detail: fmt.Sprintf("%s (%s)", name, grafanaVariables[name])})
+	}
+	return features
+}
+
+// isPlaceholder compares the kind and a field of the spec of a plugin with a placeholder plugin
+func isPlaceholder(plugin any, placeholder common.Plugin, field string) bool {
+	fields, _ := plugin.(map[string]any)
+	pluginSpec, _ := fields["spec"].(map[string]any)
+	if fields["kind"] != placeholder.Kind || pluginSpec == nil {
+		return false
+	}
+	expected, _ := json.Marshal(placeholder.Spec.(map[string]any)[field])
+	actual, _ := json.Marshal(pluginSpec[field])
+	return string(expected) == string(actual)
+}
+
+// targetDatasourceType returns the datasource type of a query target, or the reference of an unknown datasource
+func targetDatasourceType(target map[string]any, panelDatasource any, variables []grafanaTemplateVar) string {
+	datasource := target["datasource"]
+	if datasource == nil {
+		datasource = panelDatasource
+	}
+	if dsType := datasourceType(datasource, variables); dsType != "" {
+		return dsType
+	}
+	return "unknown datasource " + datasourceUID(datasource)
+}
+
+// findDroppedFeatures lists the features of a Grafana dashboard that the migration drops
+func findDroppedFeatures(grafana map[string]any) []unsupportedFeature {
+	var features []unsupportedFeature
+	var walk func(panels []any)
+	walk = func(panels []any) {
+		for _, item := range panels {
+			panel, _ := item.(map[string]any)
+			title, _ := panel["title"].(string)
+			if panelType, _ := panel["type"].(string); panelType == grafanaPanelRowType {
+				nested, _ := panel["panels"].([]any)
+				walk(nested)
+				continue
+			}
+
+			transformations, _ := panel["transformations"].([]any)
+			for _, transformation := range transformations {
+				fields, _ := transformation.(map[string]any)
+				id, _ := fields["id"].(string)
+				features = append(features, unsupportedFeature{Feature: featureTransformation, Panel: title, Detail: id})
+			}
+
+			fieldConfig, _ := panel["fieldConfig"].(map[string]any)
+			overrides, _ := fieldConfig["overrides"].([]any)
+			for _, override := range overrides {
+				features = append(features, unsupportedFeature{Feature: featureFieldOverride, Panel: title, Detail: describeOverride(override)})
+			}
+			defaults, _ := fieldConfig["defaults"].(map[string]any)
+			dataLinks, _ := defaults["links"].([]any)
+			for _, link := range dataLinks {
+				features = append(features, unsupportedFeature{Feature: featureDataLink, Panel: title, Detail: describeLink(link)})
+			}
+
+			if alert, ok := panel["alert"].(map[string]any); ok {
+				name, _ := alert["name"].(string)
+				features = append(features, unsupportedFeature{Feature: featureAlert, Panel: title, Detail: name})
+			}
+		}
+	}
+	panels, _ := grafana["panels"].([]any)
+	walk(panels)
+
+	links, _ := grafana["links"].([]any)
+	for _, link := range links {
+		features = append(features, unsupportedFeature{Feature: featureDashboardLink, Detail: describeLink(link)})
+	}
+
+	annotations, _ := grafana["annotations"].(map[string]any)
+	annotationList, _ := annotations["list"].([]any)
+	for _, item := range annotationList {
+		annotation, _ := item.(map[string]any)
+		// The built-in "Annotations & Alerts" annotation of every dashboard is not worth reporting
+		if builtIn, _ := annotation["builtIn"].(float64); builtIn == 1 {
+			continue
+		}
+		name, _ := annotation["name"].(string)
+		features = append(features, unsupportedFeature{Feature: featureAnnotation, Detail: name})
+	}
+	return features
+}
+
+// describeOverride summarizes the matcher of a field override, like "byName=cpu"
+func describeOverride(override any) string {
+	fields, _ := override.(map[string]any)
+	matcher, _ := fields["matcher"].(map[string]any)
+	id, _ := matcher["id"].(string)
+	if options, ok := matcher["options"].(string); ok && options != "" {
+		return id + "=" + options
+	}
+	return id
+}
+
+// describeLink returns the title of a link, or its URL or type when it has no title
+func describeLink(link any) string {
+	fields, _ := link.(map[string]any)
+	for _, key := range []string{"title", "url", "type"} {
+		if value, _ := fields[key].(string); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// countFeatures counts the unsupported features by feature, like "2 panel, 1 transformation"
+func countFeatures(features []unsupportedFeature) string {
+	counts := make(map[string]int)
+	for _, feature := range features {
+		counts[feature.Feature]++
+	}
+	var parts []string
+	for _, feature := range unsupportedFeatures {
+		if counts[feature] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[feature], feature))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// analyzeOnlyConflicts are the flags that write, publish or verify Perses resources, which --analyze-only doesn't
+// produce
+var analyzeOnlyConflicts = map[string]bool{
+	"publish-url":             true,
+	"generate-datasources":    true,
+	"datasource-provisioning": true,
+	"emit-projects":           true,
+	"operator-manifests":      true,
+	"generate-code":           true,
+	"reject-invalid":          true,
+	"resume":                  true,
+	"verify-prometheus-url":   true,
+}
+
+// validateAnalyzeOnly checks that --analyze-only is not combined with flags it would ignore
+func validateAnalyzeOnly() error {
+	if !*analyzeOnly {
+		return nil
+	}
+	if *schemaUpgrade != schemaUpgradeOffline || *migrationBackend != backendNative {
+		return fmt.Errorf("--analyze-only upgrades and converts the dashboards in memory. Use --schema-upgrade=%s and --migration-backend=%s.", schemaUpgradeOffline, backendNative)
+	}
+	var conflicts []string
+	flag.Visit(func(f *flag.Flag) {
+		if analyzeOnlyConflicts[f.Name] {
+			conflicts = append(conflicts, "--"+f.Name)
+		}
+	})
+	if len(conflicts) > 0 {
+		return fmt.Errorf("--analyze-only doesn't write Perses resources and can't be combined with %s", strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// analyzeUpgradedDashboard analyzes and validates a dashboard upgraded to the latest schema without writing
+// anything, for --analyze-only. The dashboard is converted with the native backend and runs through the transformers.
+func analyzeUpgradedDashboard(dashboard *DashboardInfo, spec map[string]any) error {
+	spec["uid"] = dashboard.UID
+	grafanaData, err := json.Marshal(spec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dashboard: %v", err)
+	}
+	persesDashboard, err := convertGrafanaDashboard(grafanaData)
+	if err != nil {
+		return err
+	}
+	persesData, err := json.Marshal(persesDashboard)
+	if err != nil {
+		return err
+	}
+	persesData, err = applyTransforms(dashboard, grafanaData, persesData)
+	if err != nil {
+		return err
+	}
+	if err := inspectMigration(dashboard, grafanaData, persesData); err != nil {
+		return err
+	}
+	dashboard.ValidationErrors = validateDashboard(persesData)
+	return nil
+}
+
+// inspectMigration analyzes a transformed dashboard for unsupported features and checks the PromQL syntax. The
+// features reported by the transformers, like the variables that can't be converted, are kept.
+func inspectMigration(dashboard *DashboardInfo, grafanaData, persesData []byte) error {
+	features, err := analyzeDashboard(grafanaData, persesData)
+	if err != nil {
+		return err
+	}
+	dashboard.Unsupported = append(features, dashboard.Unsupported...)
+
+	if dashboard.PromQLErrors, err = checkPromQL(persesData); err != nil {
+		return err
+	}
+	return nil
+}
+
+// describeFeature describes an unsupported feature on one line, like "transformation organize in panel Pods"
+func describeFeature(feature unsupportedFeature) string {
+	description := feature.Feature
+	if feature.Detail != "" {
+		description += " " + feature.Detail
+	}
+	if feature.Panel != "" {
+		description += fmt.Sprintf(" in panel %q", feature.Panel)
+	}
+	return description
+}
+
+// printUnsupported prints the PromQL rewrites, the variable fixes, the unsupported features and the PromQL errors of
+// a dashboard
+func printUnsupported(dashboard *DashboardInfo, out *dashboardOutput) {
+	for _, rewrite := range dashboard.PromQLRewrites {
+		out.Printf("    → Rewrote PromQL in %s: %s\n", rewrite.Location, strings.Join(rewrite.Changes, ", "))
+	}
+	if len(dashboard.VariableFixes) > 0 {
+		out.Printf("    → Fixed variables: %s\n", strings.Join(dashboard.VariableFixes, "; "))
+	}
+	if len(dashboard.Unsupported) > 0 {
+		out.Printf("    → Unsupported: %s\n", countFeatures(dashboard.Unsupported))
+	}
+	for _, promqlErr := range dashboard.PromQLErrors {
+		out.Printf("    → PromQL error in %s: %s\n", promqlErr.Location, promqlErr.Error)
+	}
+}
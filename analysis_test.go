@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeDashboard(t *testing.T) {
+	setDatasourceOptions(t, nil, true)
+	const grafana = `{"title": "Nodes", "panels": [
+		{"type": "timeseries", "title": "CPU",
+			"targets": [{"refId": "A", "expr": "up"}, {"refId": "B", "datasource": {"type": "loki", "uid": "logs"}, "expr": "{job=\"a\"}"}],
+			"transformations": [{"id": "organize"}],
+			"fieldConfig": {"defaults": {"links": [{"title": "Runbook", "url": "https://runbook"}, {"url": "https://docs"}]},
+				"overrides": [{"matcher": {"id": "byName", "options": "cpu"}}, {"matcher": {"id": "byType"}}]},
+			"alert": {"name": "High CPU"}},
+		{"type": "grafana-clock-panel", "title": "Clock"},
+		{"type": "row", "title": "Details", "collapsed": true, "panels": [
+			{"type": "stat", "title": "Load", "transformations": [{"id": "merge"}]}]}],
+		"templating": {"list": [{"name": "ds", "type": "datasource", "query": "prometheus"}, {"name": "job", "type": "query"}]},
+		"links": [{"type": "dashboards", "title": "Related"}, {"type": "link", "url": "https://wiki"}],
+		"annotations": {"list": [{"builtIn": 1, "name": "Annotations & Alerts"}, {"name": "Deployments"}]}}`
+	const perses = `{"kind": "Dashboard", "spec": {"panels": {
+		"0": {"kind": "Panel", "spec": {"plugin": {"kind": "TimeSeriesChart", "spec": {}}, "queries": [
+			{"kind": "TimeSeriesQuery", "spec": {"plugin": {"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "up"}}}},
+			{"kind": "TimeSeriesQuery", "spec": {"plugin": {"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "migration_from_grafana_not_supported"}}}}]}},
+		"1": {"kind": "Panel", "spec": {"plugin": {"kind": "Markdown", "spec": {"text": "**Migration from Grafana not supported !**"}}}},
+		"2_0": {"kind": "Panel", "spec": {"plugin": {"kind": "StatChart", "spec": {}}}}},
+		"variables": [
+			{"kind": "ListVariable", "spec": {"name": "ds", "plugin": {"kind": "StaticListVariable", "spec": {"values": ["grafana", "migration", "not", "supported"]}}}},
+			{"kind": "ListVariable", "spec": {"name": "job", "plugin": {"kind": "StaticListVariable", "spec": {"values": ["a", "b"]}}}}]}}`
+
+	features, err := analyzeDashboard([]byte(grafana), []byte(perses))
+	if err != nil {
+		t.Fatalf("analysis failed: %v", err)
+	}
+	want := []unsupportedFeature{
+		{Feature: featureQuery, Panel: "CPU", Detail: "loki"},
+		{Feature: featurePanel, Panel: "Clock", Detail: "grafana-clock-panel"},
+		{Feature: featureVariable, Detail: "ds (datasource)"},
+		{Feature: featureTransformation, Panel: "CPU", Detail: "organize"},
+		{Feature: featureFieldOverride, Panel: "CPU", Detail: "byName=cpu"},
+		{Feature: featureFieldOverride, Panel: "CPU", Detail: "byType"},
+		{Feature: featureDataLink, Panel: "CPU", Detail: "Runbook"},
+		{Feature: featureDataLink, Panel: "CPU", Detail: "https://docs"},
+		{Feature: featureAlert, Panel: "CPU", Detail: "High CPU"},
+		{Feature: featureTransformation, Panel: "Load", Detail: "merge"},
+		{Feature: featureDashboardLink, Detail: "Related"},
+		{Feature: featureDashboardLink, Detail: "https://wiki"},
+		{Feature: featureAnnotation, Detail: "Deployments"},
+	}
+	if !reflect.DeepEqual(features, want) {
+		t.Errorf("features =\n%+v\nwant\n%+v", features, want)
+	}
+	if got, want := countFeatures(features), "1 panel, 1 query, 1 variable, 2 transformation, 2 field-override, 2 data-link, 2 dashboard-link, 1 annotation, 1 alert"; got != want {
+		t.Errorf("countFeatures = %q, want %q", got, want)
+	}
+	if got, want := describeFeature(features[0]), `query loki in panel "CPU"`; got != want {
+		t.Errorf("describeFeature = %q, want %q", got, want)
+	}
+
+	if _, err := analyzeDashboard([]byte(grafana), []byte("{")); err == nil {
+		t.Error("a Perses dashboard that doesn't parse was analyzed")
+	}
+}
+
+func TestAnalyzeOnly(t *testing.T) {
+	setDatasourceOptions(t, nil, true)
+	setNamingOptions(t, namingTitle, collisionSuffix)
+	previousOutputDir, previousTransformers := *outputDir, transformers
+	defer func() { *outputDir, transformers = previousOutputDir, previousTransformers }()
+	*outputDir = t.TempDir()
+	pipeline, err := loadTransforms("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transformers = pipeline
+	setFlag(t, "analyze-only", "true")
+
+	inputDir := t.TempDir()
+	dashboards := map[string]string{
+		"nodes.json": `{"title": "Nodes", "uid": "nodes", "schemaVersion": 39, "panels": [
+			{"type": "timeseries", "title": "CPU", "gridPos": {"x": 0, "y": 0, "w": 12, "h": 8}, "targets": [{"refId": "A", "expr": "up"}],
+				"transformations": [{"id": "organize"}, {"id": "merge"}]}],
+			"annotations": {"list": [{"name": "Deployments"}]}}`,
+		"clean.json": `{"title": "Clean", "uid": "clean", "schemaVersion": 39, "panels": [
+			{"type": "timeseries", "title": "Up", "gridPos": {"x": 0, "y": 0, "w": 12, "h": 8}, "targets": [{"refId": "A", "expr": "up"}]}]}`,
+	}
+	for name, content := range dashboards {
+		if err := os.WriteFile(filepath.Join(inputDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary, err := runMigrationPipeline(inputDir, filepath.Join(*outputDir, "grafana-schema-latest"), filepath.Join(*outputDir, "perses"))
+	if err != nil {
+		t.Fatalf("analysis failed: %v", err)
+	}
+	if summary.Analyzed != 2 || summary.UnsupportedDashboards != 1 {
+		t.Errorf("analyzed %d dashboards, %d with unsupported features, want 2 and 1", summary.Analyzed, summary.UnsupportedDashboards)
+	}
+	if want := map[string]int{featureTransformation: 2, featureAnnotation: 1}; !reflect.DeepEqual(summary.Unsupported, want) {
+		t.Errorf("unsupported = %v, want %v", summary.Unsupported, want)
+	}
+	for _, dashboard := range summary.Dashboards {
+		if dashboard.Status != statusSucceeded || dashboard.PersesFile != "" {
+			t.Errorf("%s: status %s, Perses file %q, want analyzed without output", dashboard.InputPath, dashboard.Status, dashboard.PersesFile)
+		}
+		if want := map[string]int{"nodes.json": 3, "clean.json": 0}[dashboard.InputPath]; len(dashboard.Unsupported) != want {
+			t.Errorf("%s: unsupported %+v, want %d features", dashboard.InputPath, dashboard.Unsupported, want)
+		}
+	}
+	for _, dir := range []string{"grafana-schema-latest", "perses"} {
+		if _, err := os.Stat(filepath.Join(*outputDir, dir)); !os.IsNotExist(err) {
+			t.Errorf("--analyze-only created %s: %v", dir, err)
+		}
+	}
+}
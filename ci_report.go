@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The JUnit and SARIF reports are built from the migration report entries so that CI systems can show the
+// migration results as test results and as annotations on the input files.
+
+const (
+	junitSuiteName = "grafana-to-perses-migration"
+
+	sarifVersion         = "2.1.0"
+	sarifSchema          = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifToolName        = "grafana-to-perses-bulk-migrator"
+	sarifWarningRule     = "migration-warning"
+	sarifUnsupportedRule = "unsupported-feature"
+	sarifPromQLRule      = "promql-syntax"
+	sarifQueryRule       = "query-verification"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// writeJUnitReport writes one test case per dashboard, grouped in a single test suite
+func writeJUnitReport(reportPath string, report *migrationReport) error {
+	suite := junitTestSuite{
+		Name:      junitSuiteName,
+		Time:      junitSeconds(report.elapsed.Milliseconds()),
+		Timestamp: report.GeneratedAt.Format("2006-01-02T15:04:05"),
+	}
+
+	for _, dashboard := range report.Dashboards {
+		testCase := junitTestCase{
+			Name:      dashboard.InputPath,
+			ClassName: junitClassName(dashboard.InputPath),
+			File:      ciInputFile(dashboard.InputPath),
+			Time:      junitSeconds(dashboard.DurationMs),
+		}
+
+		switch dashboard.Status {
+		case statusFailed:
+			testCase.Failure = &junitFailure{
+				Message: dashboard.Error,
+				Type:    dashboard.FailedStage,
+				Text:    fmt.Sprintf("%s failed for %s: %s", dashboard.FailedStage, dashboard.InputPath, dashboard.Error),
+			}
+			suite.Failures++
+		case statusSkipped:
+			testCase.Skipped = &junitSkipped{Message: "unchanged since the previous run"}
+			suite.Skipped++
+		}
+
+		var output []string
+		for _, warning := range dashboard.Warnings {
+			output = append(output, "Warning: "+warning)
+		}
+		if dashboard.FailedStage != failedValidation {
+			for _, validationErr := range dashboard.ValidationErrors {
+				output = append(output, "Invalid: "+validationErr)
+			}
+		}
+		for _, feature := range dashboard.Unsupported {
+			output = append(output, "Unsupported: "+describeFeature(feature))
+		}
+		for _, promqlErr := range dashboard.PromQLErrors {
+			output = append(output, fmt.Sprintf("PromQL: %s in %s: %s", promqlErr.Error, promqlErr.Location, promqlErr.Query))
+		}
+		for _, problem := range dashboard.QueryProblems {
+			output = append(output, "Query: "+describeQueryProblem(problem))
+		}
+		testCase.SystemOut = strings.Join(output, "\n")
+
+		suite.TestCases = append(suite.TestCases, testCase)
+		suite.Tests++
+	}
+
+	suites := junitTestSuites{
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitTestSuite{suite},
+	}
+
+	data, err := xml.MarshalIndent(suites, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JUnit report: %v", err)
+	}
+	return writeReportFile(reportPath, append([]byte(xml.Header), append(data, '\n')...))
+}
+
+// junitClassName groups the test cases by input directory
+func junitClassName(inputPath string) string {
+	dir := path.Dir(inputPath)
+	if dir == "." {
+		return junitSuiteName
+	}
+	return junitSuiteName + "." + strings.ReplaceAll(dir, "/", ".")
+}
+
+func junitSeconds(ms int64) string {
+	return fmt.Sprintf("%.3f", float64(ms)/1000)
+}
+
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+// writeSARIFReport writes an error result for every failed dashboard and a warning result for every warning,
+// located on the input file
+func writeSARIFReport(reportPath string, report *migrationReport) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           sarifToolName,
+			InformationURI: "https://perses.dev/perses/docs/migration",
+			Rules: []sarifRule{
+				{ID: failedDownload, ShortDescription: sarifMessage{Text: "The dashboard could not be downloaded from the Grafana instance"}},
+				{ID: failedSchemaUpdate, ShortDescription: sarifMessage{Text: "The dashboard schema could not be upgraded to the latest Grafana version"}},
+				{ID: failedExport, ShortDescription: sarifMessage{Text: "The upgraded dashboard could not be exported"}},
+				{ID: failedMigration, ShortDescription: sarifMessage{Text: "The dashboard could not be migrated to Perses"}},
+				{ID: failedValidation, ShortDescription: sarifMessage{Text: "The migrated dashboard is not valid for Perses"}},
+				{ID: failedPublish, ShortDescription: sarifMessage{Text: "The migrated dashboard could not be published to Perses"}},
+				{ID: sarifWarningRule, ShortDescription: sarifMessage{Text: "The dashboard was migrated with a warning"}},
+				{ID: sarifUnsupportedRule, ShortDescription: sarifMessage{Text: "The dashboard uses a Grafana feature that needs manual work in Perses"}},
+				{ID: sarifPromQLRule, ShortDescription: sarifMessage{Text: "A migrated PromQL query doesn't parse"}},
+				{ID: sarifQueryRule, ShortDescription: sarifMessage{Text: "A migrated query returned no data, failed or was slow on the verification API"}},
+			},
+		}},
+		Results: []sarifResult{},
+	}
+
+	for _, dashboard := range report.Dashboards {
+		location := []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{URI: ciInputFile(dashboard.InputPath)},
+		}}}
+
+		if dashboard.Status == statusFailed {
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    dashboard.FailedStage,
+				Level:     "error",
+				Message:   sarifMessage{Text: fmt.Sprintf("Dashboard %s: %s failed: %s", dashboard.InputPath, dashboard.FailedStage, dashboard.Error)},
+				Locations: location,
+			})
+		}
+		// Rejected dashboards are reported above with all their validation errors
+		if dashboard.FailedStage != failedValidation {
+			for _, validationErr := range dashboard.ValidationErrors {
+				run.Results = append(run.Results, sarifResult{
+					RuleID:    failedValidation,
+					Level:     "warning",
+					Message:   sarifMessage{Text: fmt.Sprintf("Dashboard %s is not valid: %s", dashboard.InputPath, validationErr)},
+					Locations: location,
+				})
+			}
+		}
+		for _, warning := range dashboard.Warnings {
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    sarifWarningRule,
+				Level:     "warning",
+				Message:   sarifMessage{Text: fmt.Sprintf("Dashboard %s: %s", dashboard.InputPath, warning)},
+				Locations: location,
+			})
+		}
+		for _, feature := range dashboard.Unsupported {
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    sarifUnsupportedRule,
+				Level:     "note",
+				Message:   sarifMessage{Text: fmt.Sprintf("Dashboard %s: unsupported %s", dashboard.InputPath, describeFeature(feature))},
+				Locations: location,
+			})
+		}
+		for _, promqlErr := range dashboard.PromQLErrors {
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    sarifPromQLRule,
+				Level:     "warning",
+				Message:   sarifMessage{Text: fmt.Sprintf("Dashboard %s: PromQL in %s doesn't parse: %s", dashboard.InputPath, promqlErr.Location, promqlErr.Error)},
+				Locations: location,
+			})
+		}
+		for _, problem := range dashboard.QueryProblems {
+			level := "note"
+			if problem.Problem == queryFailed {
+				level = "warning"
+			}
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    sarifQueryRule,
+				Level:     level,
+				Message:   sarifMessage{Text: fmt.Sprintf("Dashboard %s: query %s", dashboard.InputPath, describeQueryProblem(problem))},
+				Locations: location,
+			})
+		}
+	}
+
+	data, err := json.MarshalIndent(sarifLog{Version: sarifVersion, Schema: sarifSchema, Runs: []sarifRun{run}}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal SARIF report: %v", err)
+	}
+	return writeReportFile(reportPath, data)
+}
+
+// ciInputFile returns the path of an input file relative to the working directory, which is the repository root
+// in CI, so that annotations land on the file. Input files outside of the working directory use a file URI.
+func ciInputFile(inputPath string) string {
+	file, err := filepath.Abs(filepath.Join(*inputDir, filepath.FromSlash(inputPath)))
+	if err != nil {
+		return inputPath
+	}
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, file); err == nil && !strings.HasPrefix(rel, "..") {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return "file://" + filepath.ToSlash(file)
+}
+
+func writeReportFile(reportPath string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(reportPath), 0755); err != nil {
+		return fmt.Errorf("failed to create report directory: %v", err)
+	}
+	if err := os.WriteFile(reportPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write report %s: %v", reportPath, err)
+	}
+	return nil
+}
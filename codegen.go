@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+	"github.com/perses/perses/pkg/model/api/v1/common"
+	persesdashboard "github.com/perses/perses/pkg/model/api/v1/dashboard"
+	persesvariable "github.com/perses/perses/pkg/model/api/v1/variable"
+)
+
+// With --generate-code=go, every migrated dashboard is also written as a Go program built with the Perses Go SDK to
+// <output-dir>/perses-dac/<dashboard>/main.go, so teams can maintain their dashboards as code right after the
+// migration. Running a program prints the dashboard it was generated from, like percli dac build expects.
+
+const (
+	codeDirName  = "perses-dac"
+	codeLanguage = "go"
+
+	persesModule = "github.com/perses/perses"
+	sdkPackage   = persesModule + "/go-sdk"
+	modelPackage = persesModule + "/pkg/model/api/v1"
+)
+
+// The go.mod and go.sum of this tool. The programs require the Go and Perses versions of this tool, and get its
+// checksums, so that they build with the SDK the dashboards were migrated with without a checksum database lookup.
+var (
+	//go:embed go.mod
+	toolGoMod string
+	//go:embed go.sum
+	toolGoSum []byte
+)
+
+func validateCodeLanguage() error {
+	if *generateCode != "" && *generateCode != codeLanguage {
+		return fmt.Errorf("invalid code generation language %q. Use --generate-code=%s", *generateCode, codeLanguage)
+	}
+	return nil
+}
+
+// writeDashboardsAsCode generates a program for every migrated dashboard, plus the go.mod of the programs, and
+// returns how many were written
+func writeDashboardsAsCode(dashboards []dashboardReport, codeDir string) (int, error) {
+	if err := os.RemoveAll(codeDir); err != nil {
+		return 0, fmt.Errorf("failed to clean code output directory: %v", err)
+	}
+	if err := os.MkdirAll(codeDir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create code output directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(codeDir, "go.mod"), goModFile(), 0644); err != nil {
+		return 0, fmt.Errorf("failed to write go.mod: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(codeDir, "go.sum"), toolGoSum, 0644); err != nil {
+		return 0, fmt.Errorf("failed to write go.sum: %v", err)
+	}
+
+	written := 0
+	for _, dashboard := range dashboards {
+		if dashboard.PersesFile == "" {
+			continue
+		}
+
+		data, err := readOutputFile(filepath.Join(*outputDir, filepath.FromSlash(dashboard.PersesFile)))
+		if err != nil {
+			log.Printf("Warning: Failed to read %s to generate its code: %v", dashboard.PersesFile, err)
+			continue
+		}
+		var persesDashboard persesv1.Dashboard
+		if err := json.Unmarshal(data, &persesDashboard); err != nil {
+			log.Printf("Warning: Failed to parse %s to generate its code: %v", dashboard.PersesFile, err)
+			continue
+		}
+
+		code, err := generateDashboardCode(&persesDashboard, dashboard.InputPath)
+		if err != nil {
+			log.Printf("Warning: Failed to generate the code of %s: %v", dashboard.PersesFile, err)
+			continue
+		}
+
+		// One directory per program, each one is a main package
+		relPath := strings.TrimPrefix(dashboard.PersesFile, "perses/")
+		programDir := filepath.Join(codeDir, filepath.FromSlash(strings.TrimSuffix(relPath, filepath.Ext(relPath))))
+		if err := os.MkdirAll(programDir, 0755); err != nil {
+			return written, fmt.Errorf("failed to create code output directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(programDir, "main.go"), code, 0644); err != nil {
+			return written, fmt.Errorf("failed to write the code of %s: %v", dashboard.PersesFile, err)
+		}
+		written++
+	}
+	return written, nil
+}
+
+// goModFile requires the Go and Perses versions of this tool, so the SDK matches the migrated dashboards. The other
+// requirements of the tool are listed as indirect ones, so that the go.mod holds the complete requirement graph
+// checked by the go.sum and the programs build as written, without go mod tidy.
+func goModFile() []byte {
+	goVersion, persesVersion := "", ""
+	var indirect []string
+	inBlock := false
+	for _, line := range strings.Split(toolGoMod, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case fields[0] == "require" && len(fields) > 1 && fields[1] == "(":
+			inBlock = true
+			continue
+		case fields[0] == ")":
+			inBlock = false
+			continue
+		case fields[0] == "go" && len(fields) >= 2:
+			goVersion = fields[1]
+			continue
+		case fields[0] == "require":
+			fields = fields[1:]
+		case !inBlock:
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[0] == persesModule {
+			persesVersion = fields[1]
+		} else {
+			indirect = append(indirect, fmt.Sprintf("\t%s %s // indirect\n", fields[0], fields[1]))
+		}
+	}
+
+	content := fmt.Sprintf("module dac\n\ngo %s\n", goVersion)
+	if persesVersion != "" {
+		content += fmt.Sprintf("\nrequire %s %s\n", persesModule, persesVersion)
+	}
+	if len(indirect) > 0 {
+		content += "\nrequire (\n" + strings.Join(indirect, "") + ")\n"
+	}
+	return []byte(content)
+}
+
+// goGenerator writes the source of a dashboard program and collects the packages it uses
+type goGenerator struct {
+	body    bytes.Buffer
+	imports map[string]string // package path -> name used in the code
+}
+
+func (g *goGenerator) pkg(name, path string) string {
+	g.imports[path] = name
+	return name
+}
+
+func (g *goGenerator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.body, format, args...)
+}
+
+// generateDashboardCode returns the formatted source of a program building the dashboard with the Go SDK
+func generateDashboardCode(dashboard *persesv1.Dashboard, inputPath string) ([]byte, error) {
+	g := &goGenerator{imports: make(map[string]string)}
+	spec := dashboard.Spec
+
+	g.printf("func main() {\n")
+	g.printf("%s.Parse()\n", g.pkg("flag", "flag"))
+	g.printf("exec := %s.NewExec()\n", g.pkg("sdk", sdkPackage))
+	g.printf("exec.BuildDashboard(%s.New(%s,\n", g.pkg("dashboard", sdkPackage+"/dashboard"), goString(dashboard.Metadata.Name))
+
+	if dashboard.Metadata.Project != "" {
+		g.printf("dashboard.ProjectName(%s),\n", goString(dashboard.Metadata.Project))
+	}
+	if spec.Display != nil {
+		g.printf("display(%s, %s),\n", goString(spec.Display.Name), goString(spec.Display.Description))
+	}
+	if spec.Duration != common.Duration(time.Hour) {
+		g.printf("dashboard.Duration(%s),\n", g.goDuration(time.Duration(spec.Duration)))
+	}
+	if spec.RefreshInterval != 0 {
+		g.printf("dashboard.RefreshInterval(%s),\n", g.goDuration(time.Duration(spec.RefreshInterval)))
+	}
+
+	for _, name := range sortedKeys(spec.Datasources) {
+		g.writeDatasource(name, spec.Datasources[name])
+	}
+	for _, v := range spec.Variables {
+		if err := g.writeVariable(v); err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range sortedKeys(spec.Panels) {
+		g.writePanel(key, spec.Panels[key])
+	}
+	for _, layout := range spec.Layouts {
+		if err := g.writeLayout(layout); err != nil {
+			return nil, err
+		}
+	}
+	// Without any, the SDK leaves the panels and layouts null instead of empty
+	if len(spec.Panels) == 0 || len(spec.Layouts) == 0 {
+		g.printf("func(builder *dashboard.Builder) error {\n")
+		if len(spec.Panels) == 0 {
+			g.printf("builder.Dashboard.Spec.Panels = map[string]*v1.Panel{}\n")
+		}
+		if len(spec.Layouts) == 0 {
+			g.printf("builder.Dashboard.Spec.Layouts = []persesdashboard.Layout{}\n")
+		}
+		g.printf("return nil\n},\n")
+	}
+	g.printf("))\n}\n")
+
+	g.writeHelpers()
+
+	var source bytes.Buffer
+	fmt.Fprintf(&source, "// Generated from the migration of %s. Edit it to maintain the dashboard as code.\n\n", inputPath)
+	source.WriteString("package main\n\nimport (\n")
+	paths := make([]string, 0, len(g.imports))
+	for path := range g.imports {
+		paths = append(paths, path)
+	}
+	// Standard library first, then the Perses packages
+	sort.Slice(paths, func(i, j int) bool {
+		stdI, stdJ := !strings.Contains(paths[i], "."), !strings.Contains(paths[j], ".")
+		if stdI != stdJ {
+			return stdI
+		}
+		return paths[i] < paths[j]
+	})
+	for i, path := range paths {
+		if i > 0 && !strings.Contains(paths[i-1], ".") && strings.Contains(path, ".") {
+			source.WriteString("\n")
+		}
+		name := g.imports[path]
+		if name == filepath.Base(path) {
+			fmt.Fprintf(&source, "%q\n", path)
+		} else {
+			fmt.Fprintf(&source, "%s %q\n", name, path)
+		}
+	}
+	source.WriteString(")\n\n")
+	source.Write(g.body.Bytes())
+
+	formatted, err := format.Source(source.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to format generated code: %v", err)
+	}
+	return formatted, nil
+}
+
+func (g *goGenerator) writeDatasource(name string, ds *persesv1.DatasourceSpec) {
+	pkg := g.pkg("datasource", sdkPackage+"/datasource")
+	g.printf("dashboard.AddDatasource(%s,\n", goString(name))
+	if ds.Default {
+		g.printf("%s.Default(true),\n", pkg)
+	}
+	g.printf("%s.Plugin(%s),\n", pkg, g.goPlugin(ds.Plugin))
+	if ds.Display != nil {
+		g.printf("func(builder *%s.Builder) error {\n", pkg)
+		g.printf("builder.Spec.Display = &common.Display{Name: %s, Description: %s}\n", goString(ds.Display.Name), goString(ds.Display.Description))
+		g.printf("return nil\n},\n")
+	}
+	g.printf("),\n")
+}
+
+func (g *goGenerator) writeVariable(v persesdashboard.Variable) error {
+	switch spec := v.Spec.(type) {
+	case *persesdashboard.ListVariableSpec:
+		pkg := g.pkg("listvariable", sdkPackage+"/variable/list-variable")
+		g.printf("dashboard.AddVariable(%s, %s.List(\n", goString(spec.Name), pkg)
+		g.writeVariableDisplay(pkg, spec.Display)
+		if spec.DefaultValue != nil {
+			if spec.DefaultValue.SliceValues != nil {
+				values := make([]string, len(spec.DefaultValue.SliceValues))
+				for i, value := range spec.DefaultValue.SliceValues {
+					values[i] = goString(value)
+				}
+				g.printf("%s.DefaultValues(%s),\n", pkg, strings.Join(values, ", "))
+			} else {
+				g.printf("%s.DefaultValue(%s),\n", pkg, goString(spec.DefaultValue.SingleValue))
+			}
+		}
+		if spec.AllowAllValue {
+			g.printf("%s.AllowAllValue(true),\n", pkg)
+		}
+		if spec.AllowMultiple {
+			g.printf("%s.AllowMultiple(true),\n", pkg)
+		}
+		if spec.CustomAllValue != "" {
+			g.printf("%s.CustomAllValue(%s),\n", pkg, goString(spec.CustomAllValue))
+		}
+		if spec.CapturingRegexp != "" {
+			g.printf("%s.CapturingRegexp(%s),\n", pkg, goString(spec.CapturingRegexp))
+		}
+		if spec.Sort != nil {
+			variablePkg := g.pkg("variable", modelPackage+"/variable")
+			g.printf("%s.SortingBy(%s.Sort(%s)),\n", pkg, variablePkg, goString(string(*spec.Sort)))
+		}
+		g.printf("listVariablePlugin(%s),\n", g.goPlugin(spec.Plugin))
+		g.printf(")),\n")
+	case *persesdashboard.TextVariableSpec:
+		pkg := g.pkg("textvariable", sdkPackage+"/variable/text-variable")
+		g.printf("dashboard.AddVariable(%s, %s.Text(%s,\n", goString(spec.Name), pkg, goString(spec.Value))
+		g.writeVariableDisplay(pkg, spec.Display)
+		if spec.Constant {
+			g.printf("%s.Constant(true),\n", pkg)
+		}
+		g.printf(")),\n")
+	default:
+		return fmt.Errorf("unsupported variable kind %s", v.Kind)
+	}
+	return nil
+}
+
+// writeVariableDisplay sets the display options; an empty display is kept with Hidden(false)
+func (g *goGenerator) writeVariableDisplay(pkg string, display *persesvariable.Display) {
+	if display == nil {
+		return
+	}
+	if display.Name != "" {
+		g.printf("%s.DisplayName(%s),\n", pkg, goString(display.Name))
+	}
+	if display.Description != "" {
+		g.printf("%s.Description(%s),\n", pkg, goString(display.Description))
+	}
+	if display.Hidden || display.Name == "" && display.Description == "" {
+		g.printf("%s.Hidden(%t),\n", pkg, display.Hidden)
+	}
+}
+
+func (g *goGenerator) writePanel(key string, p *persesv1.Panel) {
+	pkg := g.pkg("panel", sdkPackage+"/panel")
+	g.printf("addPanel(%s, %s,\n", goString(key), goString(p.Spec.Display.Name))
+	if p.Spec.Display.Description != "" {
+		g.printf("%s.Description(%s),\n", pkg, goString(p.Spec.Display.Description))
+	}
+	g.printf("%s.Plugin(%s),\n", pkg, g.goPlugin(p.Spec.Plugin))
+
+	for _, q := range p.Spec.Queries {
+		queryPkg := g.pkg("query", sdkPackage+"/query")
+		g.printf("%s.AddQuery(\n", pkg)
+		if q.Kind != "TimeSeriesQuery" {
+			g.printf("func(builder *%s.Builder) error {\nbuilder.Kind = %s\nreturn nil\n},\n", queryPkg, goString(q.Kind))
+		}
+		g.printf("%s.Plugin(%s),\n", queryPkg, g.goPlugin(q.Spec.Plugin))
+		g.printf("),\n")
+	}
+
+	for _, l := range p.Spec.Links {
+		linkPkg := g.pkg("link", sdkPackage+"/link")
+		g.printf("%s.AddLink(%s,\n", pkg, goString(l.URL))
+		if l.Name != "" {
+			g.printf("%s.Name(%s),\n", linkPkg, goString(l.Name))
+		}
+		if l.Tooltip != "" {
+			g.printf("%s.Tooltip(%s),\n", linkPkg, goString(l.Tooltip))
+		}
+		if l.RenderVariables {
+			g.printf("%s.RenderVariable(true),\n", linkPkg)
+		}
+		if l.TargetBlank {
+			g.printf("%s.TargetBlank(true),\n", linkPkg)
+		}
+		g.printf("),\n")
+	}
+	g.printf("),\n")
+}
+
+func (g *goGenerator) writeLayout(layout persesdashboard.Layout) error {
+	grid, ok := layout.Spec.(*persesdashboard.GridLayoutSpec)
+	if !ok {
+		return fmt.Errorf("unsupported layout kind %s", layout.Kind)
+	}
+
+	g.printf("addGridLayout(persesdashboard.GridLayoutSpec{\n")
+	if grid.Display != nil {
+		g.printf("Display: &persesdashboard.GridLayoutDisplay{Title: %s", goString(grid.Display.Title))
+		if grid.Display.Collapse != nil {
+			g.printf(", Collapse: &persesdashboard.GridLayoutCollapse{Open: %t}", grid.Display.Collapse.Open)
+		}
+		g.printf("},\n")
+	}
+	g.printf("Items: []persesdashboard.GridItem{\n")
+	for _, item := range grid.Items {
+		ref := ""
+		if item.Content != nil {
+			ref = item.Content.Ref
+		}
+		g.printf("{X: %d, Y: %d, Width: %d, Height: %d, Content: &common.JSONRef{Ref: %s}},\n", item.X, item.Y, item.Width, item.Height, goString(ref))
+	}
+	g.printf("},\n}),\n")
+	return nil
+}
+
+// writeHelpers writes the options the SDK has no equivalent for
+func (g *goGenerator) writeHelpers() {
+	g.pkg("common", modelPackage+"/common")
+	g.pkg("persesdashboard", modelPackage+"/dashboard")
+	g.pkg("v1", modelPackage)
+	g.pkg("panel", sdkPackage+"/panel")
+	g.pkg("listvariable", sdkPackage+"/variable/list-variable")
+
+	g.printf(`
+// display sets the name and description of the dashboard
+func display(name, description string) dashboard.Option {
+	return func(builder *dashboard.Builder) error {
+		builder.Dashboard.Spec.Display = &common.Display{Name: name, Description: description}
+		return nil
+	}
+}
+
+// addPanel adds a panel with the key referenced by the layouts
+func addPanel(key, title string, options ...panel.Option) dashboard.Option {
+	return func(builder *dashboard.Builder) error {
+		p, err := panel.New(title, options...)
+		if err != nil {
+			return err
+		}
+		if builder.Dashboard.Spec.Panels == nil {
+			builder.Dashboard.Spec.Panels = make(map[string]*v1.Panel)
+		}
+		builder.Dashboard.Spec.Panels[key] = &p.Panel
+		return nil
+	}
+}
+
+// addGridLayout adds a grid with the panel positions of the migrated dashboard
+func addGridLayout(spec persesdashboard.GridLayoutSpec) dashboard.Option {
+	return func(builder *dashboard.Builder) error {
+		builder.Dashboard.Spec.Layouts = append(builder.Dashboard.Spec.Layouts, persesdashboard.Layout{
+			Kind: persesdashboard.KindGridLayout,
+			Spec: &spec,
+		})
+		return nil
+	}
+}
+
+// listVariablePlugin sets the plugin that provides the values of a list variable
+func listVariablePlugin(plugin common.Plugin) listvariable.Option {
+	return func(builder *listvariable.Builder) error {
+		builder.ListVariableSpec.Plugin = plugin
+		return nil
+	}
+}
+`)
+}
+
+func (g *goGenerator) goPlugin(plugin common.Plugin) string {
+	return fmt.Sprintf("common.Plugin{Kind: %s, Spec: %s}", goString(plugin.Kind), goValue(plugin.Spec))
+}
+
+// goDuration returns a readable time.Duration expression
+func (g *goGenerator) goDuration(d time.Duration) string {
+	g.pkg("time", "time")
+	for _, unit := range []struct {
+		duration time.Duration
+		name     string
+	}{{time.Hour, "time.Hour"}, {time.Minute, "time.Minute"}, {time.Second, "time.Second"}} {
+		if d%unit.duration == 0 {
+			if d == unit.duration {
+				return unit.name
+			}
+			return fmt.Sprintf("%d * %s", d/unit.duration, unit.name)
+		}
+	}
+	return fmt.Sprintf("time.Duration(%d)", int64(d))
+}
+
+// goValue returns the Go literal of a decoded JSON value. Integers are written as such, they encode the same.
+func goValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return goString(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return fmt.Sprintf("float64(%s)", strconv.FormatFloat(v, 'g', -1, 64))
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = goValue(item)
+		}
+		return "[]any{\n" + strings.Join(items, ",\n") + ",\n}"
+	case map[string]any:
+		if len(v) == 0 {
+			return "map[string]any{}"
+		}
+		var entries []string
+		for _, key := range sortedKeys(v) {
+			entries = append(entries, goString(key)+": "+goValue(v[key]))
+		}
+		return "map[string]any{\n" + strings.Join(entries, ",\n") + ",\n}"
+	default:
+		// Typed plugin specs only come from code, migrated dashboards decode to the generic JSON types
+		data, _ := json.Marshal(v)
+		var generic any
+		_ = json.Unmarshal(data, &generic)
+		return goValue(generic)
+	}
+}
+
+// goString quotes a string, multi-line strings such as queries as raw strings when possible
+func goString(s string) string {
+	if strings.Contains(s, "\n") && !strings.ContainsAny(s, "`\r") && strconv.CanBackquote(strings.ReplaceAll(s, "\n", "")) {
+		return "`" + s + "`"
+	}
+	return strconv.Quote(s)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+)
+
+const (
+	codegenDashboard = `{"kind": "Dashboard", "metadata": {"name": "cpu", "project": "team"}, "spec": {
+		"display": {"name": "CPU", "description": "CPU usage"},
+		"duration": "6h",
+		"refreshInterval": "30s",
+		"datasources": {"thanos": {"default": true, "display": {"name": "Thanos"},
+			"plugin": {"kind": "PrometheusDatasource", "spec": {"proxy": {"kind": "HTTPProxy", "spec": {"url": "http://thanos:9090"}}}}}},
+		"variables": [
+			{"kind": "ListVariable", "spec": {"name": "job", "display": {"name": "Job", "hidden": false},
+				"defaultValue": ["a", "b"], "allowAllValue": true, "allowMultiple": true, "customAllValue": ".*",
+				"capturingRegexp": "(.*)", "sort": "alphabetical-asc",
+				"plugin": {"kind": "PrometheusLabelValuesVariable", "spec": {"labelName": "job", "matchers": ["up"],
+					"datasource": {"kind": "PrometheusDatasource", "name": "thanos"}}}}},
+			{"kind": "ListVariable", "spec": {"name": "env", "display": {"hidden": false}, "defaultValue": "prod",
+				"allowAllValue": false, "allowMultiple": false,
+				"plugin": {"kind": "StaticListVariable", "spec": {"values": ["prod", "dev"]}}}},
+			{"kind": "TextVariable", "spec": {"name": "filter", "display": {"description": "Filter", "hidden": true}, "value": "api"}},
+			{"kind": "TextVariable", "spec": {"name": "region", "display": {"hidden": false}, "value": "eu", "constant": true}}
+		],
+		"panels": {
+			"0_0": {"kind": "Panel", "spec": {"display": {"name": "Usage", "description": "per job"},
+				"plugin": {"kind": "TimeSeriesChart", "spec": {"legend": {"position": "right", "mode": "table"},
+					"yAxis": {"format": {"unit": "percent", "decimalPlaces": 2}}}},
+				"queries": [
+					{"kind": "TimeSeriesQuery", "spec": {"plugin": {"kind": "PrometheusTimeSeriesQuery", "spec": {
+						"query": "sum by (job) (\n  rate(cpu{job=~\"$job\"}[5m])\n)", "seriesNameFormat": "{{job}}", "minStep": "1m"}}}},
+					{"kind": "TimeSeriesQuery", "spec": {"plugin": {"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "up"}}}}
+				],
+				"links": [{"name": "Docs", "url": "https://example.com/${job}", "tooltip": "Runbook", "renderVariables": true, "targetBlank": true}]}},
+			"0_1": {"kind": "Panel", "spec": {"display": {"name": "Up"},
+				"plugin": {"kind": "StatChart", "spec": {"calculation": "last-number", "thresholds": {"steps": [{"value": 0.5, "color": "red"}]}}},
+				"queries": [{"kind": "TimeSeriesQuery", "spec": {"plugin": {"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "count(up)"}}}}]}},
+			"1": {"kind": "Panel", "spec": {"display": {"name": "Notes"}, "plugin": {"kind": "Markdown", "spec": {"text": "# Notes\n` + "`code`" + `"}}}}
+		},
+		"layouts": [
+			{"kind": "Grid", "spec": {"display": {"title": "Row", "collapse": {"open": true}}, "items": [
+				{"x": 0, "y": 1, "width": 12, "height": 8, "content": {"$ref": "#/spec/panels/0_0"}},
+				{"x": 12, "y": 1, "width": 12, "height": 8, "content": {"$ref": "#/spec/panels/0_1"}}]}},
+			{"kind": "Grid", "spec": {"items": [{"x": 0, "y": 9, "width": 24, "height": 3, "content": {"$ref": "#/spec/panels/1"}}]}}
+		]}}`
+	codegenEmptyDashboard = `{"kind": "Dashboard", "metadata": {"name": "empty", "project": "team"}, "spec": {"duration": "1h", "panels": {}, "layouts": []}}`
+)
+
+// TestGeneratedCodeBuildsTheDashboard runs the generated programs with the Go toolchain and compares the dashboards
+// they build with the migrated dashboards
+func TestGeneratedCodeBuildsTheDashboard(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the Perses Go SDK")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("the Go toolchain is not installed")
+	}
+
+	previousOutputDir := *outputDir
+	defer func() { *outputDir = previousOutputDir }()
+	*outputDir = t.TempDir()
+
+	dashboards := map[string]string{"cpu": codegenDashboard, "empty": codegenEmptyDashboard}
+	var reports []dashboardReport
+	for name, fixture := range dashboards {
+		// Written like the migration writes its dashboards
+		var persesDashboard persesv1.Dashboard
+		if err := json.Unmarshal([]byte(fixture), &persesDashboard); err != nil {
+			t.Fatalf("invalid fixture %s: %v", name, err)
+		}
+		data, err := json.MarshalIndent(&persesDashboard, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		persesFile := "perses/team/" + name + ".json"
+		path := filepath.Join(*outputDir, filepath.FromSlash(persesFile))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, dashboardReport{InputPath: "team/" + name + ".json", PersesFile: persesFile})
+	}
+
+	codeDir := filepath.Join(*outputDir, codeDirName)
+	written, err := writeDashboardsAsCode(reports, codeDir)
+	if err != nil {
+		t.Fatalf("code generation failed: %v", err)
+	}
+	if written != len(dashboards) {
+		t.Fatalf("wrote %d programs, want %d", written, len(dashboards))
+	}
+
+	for name := range dashboards {
+		t.Run(name, func(t *testing.T) {
+			// The shipped go.mod and go.sum must build as they are, without changes and without downloads
+			cmd := exec.Command("go", "run", "-mod=readonly", "./team/"+name, "--output=json")
+			cmd.Dir = codeDir
+			cmd.Env = append(os.Environ(), "GOFLAGS=", "GOPROXY=off", "GOWORK=off")
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			built, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("running the generated program failed: %v\n%s", err, stderr.String())
+			}
+
+			migrated, err := os.ReadFile(filepath.Join(*outputDir, "perses", "team", name+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := decodeJSON(t, string(built)), decodeJSON(t, string(migrated)); !reflect.DeepEqual(got, want) {
+				t.Errorf("generated program built\n%s\nwant the migrated dashboard\n%s", built, migrated)
+			}
+		})
+	}
+}
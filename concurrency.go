@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// stdoutMutex serializes the flushes of the per-dashboard output buffers
+var stdoutMutex sync.Mutex
+
+// forEachConcurrently calls fn for every index in [0, count) using at most workers goroutines.
+// It returns once every call has completed.
+func forEachConcurrently(count, workers int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > count {
+		workers = count
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// dashboardOutput buffers the console output of a single dashboard so that concurrent workers don't interleave.
+// When running concurrently, every line is prefixed with the dashboard name.
+type dashboardOutput struct {
+	prefix string
+	buf    bytes.Buffer
+}
+
+func newDashboardOutput(name string) *dashboardOutput {
+	out := &dashboardOutput{}
+	if *concurrency > 1 {
+		out.prefix = fmt.Sprintf("[%s] ", name)
+	}
+	return out
+}
+
+func (o *dashboardOutput) Printf(format string, args ...any) {
+	fmt.Fprintf(&o.buf, format, args...)
+}
+
+// Flush writes the buffered output to stdout in one block
+func (o *dashboardOutput) Flush() {
+	if o.buf.Len() == 0 {
+		return
+	}
+
+	var block strings.Builder
+	for _, line := range strings.SplitAfter(o.buf.String(), "\n") {
+		if strings.TrimSpace(line) == "" {
+			block.WriteString(line)
+			continue
+		}
+		block.WriteString(o.prefix)
+		block.WriteString(line)
+	}
+	o.buf.Reset()
+
+	stdoutMutex.Lock()
+	defer stdoutMutex.Unlock()
+	fmt.Fprint(os.Stdout, block.String())
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A datasource mapping file rewrites the datasource selectors of the migrated queries to Perses datasources.
+// Migrated selectors reference the Grafana datasource by UID, or by name for dashboards older than schema
+// version 33. With --grafana-url, the datasources of the instance are listed so that rules can match the name,
+// UID and type of the datasource whichever one the dashboard references.
+//
+//	datasources:
+//	  - match: {name: Thanos EU}
+//	    datasource: {kind: PrometheusDatasource, name: thanos-eu}
+//	  - match: {regex: "^prometheus-.*", type: prometheus}
+//	    datasource: {kind: PrometheusDatasource, name: prometheus}
+
+// datasourceMapping is loaded from --datasource-mapping; nil when no mapping file is given
+var datasourceMapping *datasourceMapper
+
+// grafanaDatasources lists the datasources of the --grafana-url instance by UID and by name
+var grafanaDatasources map[string]grafanaDatasource
+
+type grafanaDatasource struct {
+	UID     string
+	Name    string
+	Type    string
+	Default bool
+}
+
+// datasourceKindTypes maps the Perses datasource and query plugin kinds to the Grafana datasource types
+var datasourceKindTypes = map[string]string{
+	"PrometheusDatasource":      "prometheus",
+	"PrometheusTimeSeriesQuery": "prometheus",
+	"TempoDatasource":           "tempo",
+	"TempoTraceQuery":           "tempo",
+	"LokiDatasource":            "loki",
+	"LokiLogQuery":              "loki",
+
+	"PrometheusLabelNamesVariable":  "prometheus",
+	"PrometheusLabelValuesVariable": "prometheus",
+	"PrometheusPromQLVariable":      "prometheus",
+}
+
+type datasourceMappingConfig struct {
+	Datasources []datasourceMappingRule `yaml:"datasources"`
+}
+
+type datasourceMappingRule struct {
+	Match struct {
+		Name  string `yaml:"name"`
+		UID   string `yaml:"uid"`
+		Type  string `yaml:"type"`
+		Regex string `yaml:"regex"` // matched against the name and the UID
+	} `yaml:"match"`
+	Datasource struct {
+		Kind string `yaml:"kind"`
+		Name string `yaml:"name"` // empty selects the default datasource of the kind
+	} `yaml:"datasource"`
+
+	regex *regexp.Regexp
+}
+
+// unmappedDatasource is a datasource referenced by migrated queries that no rule matched
+type unmappedDatasource struct {
+	Reference  string   `json:"reference"` // UID or name used by the dashboards
+	Name       string   `json:"name,omitempty"`
+	Type       string   `json:"type,omitempty"`
+	Dashboards []string `json:"dashboards"`
+}
+
+type datasourceMapper struct {
+	rules []datasourceMappingRule
+
+	unmapped map[string]*unmappedDatasource
+	mutex    sync.Mutex
+}
+
+// loadDatasourceMapping reads and validates a datasource mapping file
+func loadDatasourceMapping(path string) (*datasourceMapper, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read datasource mapping: %v", err)
+	}
+
+	var file datasourceMappingConfig
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse datasource mapping %s: %v", path, err)
+	}
+
+	for i := range file.Datasources {
+		rule := &file.Datasources[i]
+		if rule.Match.Name == "" && rule.Match.UID == "" && rule.Match.Type == "" && rule.Match.Regex == "" {
+			return nil, fmt.Errorf("datasource mapping rule %d has no match criteria", i+1)
+		}
+		if rule.Datasource.Kind == "" {
+			return nil, fmt.Errorf("datasource mapping rule %d has no target datasource kind", i+1)
+		}
+		if rule.Match.Regex != "" {
+			if rule.regex, err = regexp.Compile(rule.Match.Regex); err != nil {
+				return nil, fmt.Errorf("datasource mapping rule %d has an invalid regex: %v", i+1, err)
+			}
+		}
+	}
+
+	return &datasourceMapper{
+		rules:    file.Datasources,
+		unmapped: make(map[string]*unmappedDatasource),
+	}, nil
+}
+
+// resolveDatasource completes a datasource reference with the name and type known from the Grafana instance
+func resolveDatasource(reference, kind string) grafanaDatasource {
+	if ds, ok := grafanaDatasources[reference]; ok {
+		return ds
+	}
+	return grafanaDatasource{UID: reference, Name: reference, Type: datasourceKindTypes[kind]}
+}
+
+// find returns the first rule matching the datasource. Queries without a datasource only match type rules.
+func (m *datasourceMapper) find(ds grafanaDatasource) *datasourceMappingRule {
+	for i := range m.rules {
+		rule := &m.rules[i]
+		if rule.Match.Name != "" && rule.Match.Name != ds.Name {
+			continue
+		}
+		if rule.Match.UID != "" && rule.Match.UID != ds.UID {
+			continue
+		}
+		if rule.Match.Type != "" && !strings.EqualFold(rule.Match.Type, ds.Type) {
+			continue
+		}
+		if rule.regex != nil && !rule.regex.MatchString(ds.Name) && !rule.regex.MatchString(ds.UID) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// mapDatasource rewrites the datasource selector held by a plugin spec, or by a map nested in it. kind is the
+// plugin kind, used for the type of selectors without a kind. It returns false when no rule matched, in which
+// case the selector is left to the --use-default-perses-datasource handling.
+func (m *datasourceMapper) mapDatasource(pluginSpec map[string]any, kind, dashboardPath string) bool {
+	reference := ""
+	if selector, ok := pluginSpec["datasource"].(map[string]any); ok {
+		reference, _ = selector["name"].(string)
+		if selectorKind, ok := selector["kind"].(string); ok && selectorKind != "" {
+			kind = selectorKind
+		}
+	}
+
+	ds := grafanaDatasource{Type: datasourceKindTypes[kind]}
+	if reference != "" {
+		ds = resolveDatasource(reference, kind)
+	}
+
+	rule := m.find(ds)
+	if rule == nil {
+		if reference != "" {
+			m.recordUnmapped(reference, ds, dashboardPath)
+		}
+		return false
+	}
+
+	selector := map[string]any{"kind": rule.Datasource.Kind}
+	if rule.Datasource.Name != "" {
+		selector["name"] = rule.Datasource.Name
+	}
+	pluginSpec["datasource"] = selector
+	return true
+}
+
+func (m *datasourceMapper) recordUnmapped(reference string, ds grafanaDatasource, dashboardPath string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry, ok := m.unmapped[reference]
+	if !ok {
+		entry = &unmappedDatasource{Reference: reference, Type: ds.Type}
+		if ds.Name != reference {
+			entry.Name = ds.Name
+		}
+		m.unmapped[reference] = entry
+	}
+	for _, existing := range entry.Dashboards {
+		if existing == dashboardPath {
+			return
+		}
+	}
+	entry.Dashboards = append(entry.Dashboards, dashboardPath)
+}
+
+// unmappedDatasources returns the unmapped datasources sorted by reference, with their dashboards sorted
+func (m *datasourceMapper) unmappedDatasources() []unmappedDatasource {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := make([]unmappedDatasource, 0, len(m.unmapped))
+	for _, entry := range m.unmapped {
+		dashboards := append([]string(nil), entry.Dashboards...)
+		sort.Strings(dashboards)
+		result = append(result, unmappedDatasource{Reference: entry.Reference, Name: entry.Name, Type: entry.Type, Dashboards: dashboards})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Reference < result[j].Reference })
+	return result
+}
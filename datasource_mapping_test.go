@@ -0,0 +1,193 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMappingRules = `datasources:
+  - match: {uid: prom-eu}
+    datasource: {kind: PrometheusDatasource, name: thanos-eu}
+  - match: {name: Prometheus US}
+    datasource: {kind: PrometheusDatasource, name: thanos-us}
+  - match: {regex: "^prom-", type: prometheus}
+    datasource: {kind: PrometheusDatasource, name: thanos}
+  - match: {name: Logs, type: loki}
+    datasource: {kind: LokiDatasource, name: logs}
+  - match: {type: Prometheus}
+    datasource: {kind: PrometheusDatasource}
+`
+
+func loadTestMappingRules(t *testing.T, rules string) (*datasourceMapper, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return loadDatasourceMapping(path)
+}
+
+func TestLoadDatasourceMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr string
+	}{
+		{name: "valid", rules: testMappingRules},
+		{name: "invalid YAML", rules: "datasources: [", wantErr: "failed to parse datasource mapping"},
+		{name: "no match criteria", rules: "datasources:\n  - datasource: {kind: PrometheusDatasource}\n", wantErr: "datasource mapping rule 1 has no match criteria"},
+		{name: "no kind", rules: "datasources:\n  - match: {uid: a}\n    datasource: {name: b}\n", wantErr: "datasource mapping rule 1 has no target datasource kind"},
+		{name: "invalid regex", rules: testMappingRules + "  - match: {regex: '('}\n    datasource: {kind: LokiDatasource}\n", wantErr: "datasource mapping rule 6 has an invalid regex"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadTestMappingRules(t, test.rules)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("load failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFindDatasourceRule(t *testing.T) {
+	mapping, err := loadTestMappingRules(t, testMappingRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		ds   grafanaDatasource
+		want string // target name, "default" for the default datasource, empty for no rule
+	}{
+		{name: "uid", ds: grafanaDatasource{UID: "prom-eu", Name: "Prometheus EU", Type: "prometheus"}, want: "thanos-eu"},
+		{name: "name", ds: grafanaDatasource{UID: "p1", Name: "Prometheus US", Type: "prometheus"}, want: "thanos-us"},
+		{name: "regex on the uid", ds: grafanaDatasource{UID: "prom-ap", Name: "Asia", Type: "prometheus"}, want: "thanos"},
+		{name: "regex on the name", ds: grafanaDatasource{UID: "p2", Name: "prom-sa", Type: "prometheus"}, want: "thanos"},
+		{name: "regex needs the type", ds: grafanaDatasource{UID: "prom-logs", Name: "Logs", Type: "loki"}, want: "logs"},
+		{name: "name and type", ds: grafanaDatasource{UID: "l1", Name: "Logs", Type: "loki"}, want: "logs"},
+		{name: "name with another type", ds: grafanaDatasource{UID: "l2", Name: "Logs", Type: "elasticsearch"}},
+		{name: "type is case insensitive", ds: grafanaDatasource{UID: "p3", Name: "Other", Type: "prometheus"}, want: "default"},
+		{name: "query without datasource matches type rules", ds: grafanaDatasource{Type: "prometheus"}, want: "default"},
+		{name: "first matching rule wins", ds: grafanaDatasource{UID: "prom-eu", Name: "Prometheus US", Type: "prometheus"}, want: "thanos-eu"},
+		{name: "no rule", ds: grafanaDatasource{UID: "t1", Name: "Tempo", Type: "tempo"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := mapping.find(test.ds)
+			got := ""
+			if rule != nil {
+				got = rule.Datasource.Name
+				if got == "" {
+					got = "default"
+				}
+			}
+			if got != test.want {
+				t.Errorf("find(%+v) = %q, want %q", test.ds, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMapDatasource(t *testing.T) {
+	setDatasourceOptions(t, nil, true)
+	mapping, err := loadTestMappingRules(t, testMappingRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grafanaDatasources = indexDatasources([]provisionedDatasource{
+		{UID: "p-us", Name: "Prometheus US", Type: "prometheus"},
+		{UID: "tempo-1", Name: "Tempo", Type: "tempo"},
+	})
+
+	tests := []struct {
+		name      string
+		spec      map[string]any
+		kind      string
+		dashboard string
+		want      any // selector after the mapping
+		wantOK    bool
+	}{
+		{
+			name: "reference by uid", kind: "PrometheusTimeSeriesQuery", dashboard: "a.json",
+			spec:   map[string]any{"datasource": map[string]any{"kind": "PrometheusDatasource", "name": "prom-eu"}},
+			want:   map[string]any{"kind": "PrometheusDatasource", "name": "thanos-eu"},
+			wantOK: true,
+		},
+		{
+			name: "reference by name resolved with the instance", kind: "PrometheusTimeSeriesQuery", dashboard: "a.json",
+			spec:   map[string]any{"datasource": map[string]any{"kind": "PrometheusDatasource", "name": "Prometheus US"}},
+			want:   map[string]any{"kind": "PrometheusDatasource", "name": "thanos-us"},
+			wantOK: true,
+		},
+		{
+			name: "reference by uid matches a name rule with the instance", kind: "PrometheusTimeSeriesQuery", dashboard: "a.json",
+			spec:   map[string]any{"datasource": map[string]any{"kind": "PrometheusDatasource", "name": "p-us"}},
+			want:   map[string]any{"kind": "PrometheusDatasource", "name": "thanos-us"},
+			wantOK: true,
+		},
+		{
+			name: "type of the plugin kind", kind: "PrometheusLabelValuesVariable", dashboard: "a.json",
+			spec:   map[string]any{"datasource": map[string]any{"name": "unknown"}},
+			want:   map[string]any{"kind": "PrometheusDatasource"},
+			wantOK: true,
+		},
+		{
+			name: "without selector", kind: "PrometheusTimeSeriesQuery", dashboard: "a.json",
+			spec:   map[string]any{"query": "up"},
+			want:   map[string]any{"kind": "PrometheusDatasource"},
+			wantOK: true,
+		},
+		{
+			name: "unmapped", kind: "TempoTraceQuery", dashboard: "b.json",
+			spec: map[string]any{"datasource": map[string]any{"kind": "TempoDatasource", "name": "tempo-1"}},
+			want: map[string]any{"kind": "TempoDatasource", "name": "tempo-1"},
+		},
+		{
+			name: "unmapped in another dashboard", kind: "TempoTraceQuery", dashboard: "a.json",
+			spec: map[string]any{"datasource": map[string]any{"kind": "TempoDatasource", "name": "tempo-1"}},
+			want: map[string]any{"kind": "TempoDatasource", "name": "tempo-1"},
+		},
+		{
+			name: "unmapped again in the same dashboard", kind: "TempoTraceQuery", dashboard: "b.json",
+			spec: map[string]any{"datasource": map[string]any{"kind": "TempoDatasource", "name": "Tempo"}},
+			want: map[string]any{"kind": "TempoDatasource", "name": "Tempo"},
+		},
+		{
+			name: "unmapped without selector is not recorded", kind: "TempoTraceQuery", dashboard: "c.json",
+			spec: map[string]any{"query": "{}"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ok := mapping.mapDatasource(test.spec, test.kind, test.dashboard); ok != test.wantOK {
+				t.Errorf("mapDatasource = %t, want %t", ok, test.wantOK)
+			}
+			if got := test.spec["datasource"]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("selector = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Referenced by UID and by name, the Tempo datasource is reported under each reference
+	want := []unmappedDatasource{
+		{Reference: "Tempo", Name: "", Type: "tempo", Dashboards: []string{"b.json"}},
+		{Reference: "tempo-1", Name: "Tempo", Type: "tempo", Dashboards: []string{"a.json", "b.json"}},
+	}
+	if unmapped := mapping.unmappedDatasources(); !reflect.DeepEqual(unmapped, want) {
+		t.Errorf("unmapped = %+v\nwant %+v", unmapped, want)
+	}
+
+	var none *datasourceMapper
+	if unmapped := none.unmappedDatasources(); unmapped != nil {
+		t.Errorf("unmapped without mapping = %+v, want none", unmapped)
+	}
+}
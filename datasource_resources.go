@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+	"github.com/perses/perses/pkg/model/api/v1/common"
+	"gopkg.in/yaml.v3"
+)
+
+// Perses datasource resources are generated from the Grafana datasources, read from provisioning files or from the
+// --grafana-url instance, and written to <output-dir>/perses-datasources. Each resource is named like the selectors
+// of the migrated dashboards reference it, and the referenced datasources are cross-checked with the generated ones.
+
+const datasourcesDirName = "perses-datasources"
+
+// persesDatasourceKinds maps the Grafana datasource types to the Perses datasource plugin kinds
+var persesDatasourceKinds = map[string]string{
+	"prometheus":                   "PrometheusDatasource",
+	"tempo":                        "TempoDatasource",
+	"loki":                         "LokiDatasource",
+	"grafana-pyroscope-datasource": "PyroscopeDatasource",
+}
+
+var persesNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// provisionedDatasources are the Grafana datasources to generate Perses datasources for
+var provisionedDatasources []provisionedDatasource
+
+// provisionedDatasource is a datasource of a Grafana provisioning file or of the /api/datasources response
+type provisionedDatasource struct {
+	UID       string         `json:"uid" yaml:"uid"`
+	Name      string         `json:"name" yaml:"name"`
+	Type      string         `json:"type" yaml:"type"`
+	Access    string         `json:"access" yaml:"access"`
+	URL       string         `json:"url" yaml:"url"`
+	IsDefault bool           `json:"isDefault" yaml:"isDefault"`
+	BasicAuth bool           `json:"basicAuth" yaml:"basicAuth"`
+	JSONData  map[string]any `json:"jsonData" yaml:"jsonData"`
+	// Only present in provisioning files
+	SecureJSONData map[string]any `json:"-" yaml:"secureJsonData"`
+}
+
+type provisioningFile struct {
+	Datasources []provisionedDatasource `yaml:"datasources"`
+}
+
+// datasourceReference is a datasource selector found in the migrated dashboards; an empty name is the default
+// datasource of the kind
+type datasourceReference struct {
+	Kind string `json:"kind"`
+	Name string `json:"name,omitempty"`
+}
+
+// datasourceCheck is the result of the datasource generation, reported in the summary and the migration report
+type datasourceCheck struct {
+	Generated []string              `json:"generated"`
+	Skipped   []string              `json:"skipped,omitempty"` // Grafana datasources without a Perses plugin
+	Missing   []datasourceReference `json:"missing,omitempty"` // referenced by dashboards but not generated
+	Unused    []string              `json:"unused,omitempty"`  // generated but not referenced by any dashboard
+	Warnings  []string              `json:"warnings,omitempty"`
+}
+
+// loadProvisionedDatasources reads a Grafana provisioning file, or every YAML file of a provisioning directory.
+// Environment variables are expanded like Grafana does.
+func loadProvisionedDatasources(path string) ([]provisionedDatasource, error) {
+	files := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to read datasource provisioning: %v", err)
+	} else if info.IsDir() {
+		files = nil
+		for _, pattern := range []string{"*.yaml", "*.yml"} {
+			matches, err := filepath.Glob(filepath.Join(path, pattern))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+		sort.Strings(files)
+	}
+
+	var datasources []provisionedDatasource
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read datasource provisioning: %v", err)
+		}
+		var provisioning provisioningFile
+		if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(data))), &provisioning); err != nil {
+			return nil, fmt.Errorf("failed to parse datasource provisioning %s: %v", file, err)
+		}
+		datasources = append(datasources, provisioning.Datasources...)
+	}
+	return datasources, nil
+}
+
+// indexDatasources returns the datasources by UID and by name, to resolve the references of the dashboards
+func indexDatasources(datasources []provisionedDatasource) map[string]grafanaDatasource {
+	result := make(map[string]grafanaDatasource, 2*len(datasources))
+	for _, ds := range datasources {
+		entry := grafanaDatasource{UID: ds.UID, Name: ds.Name, Type: ds.Type, Default: ds.IsDefault}
+		if ds.Name != "" {
+			result[ds.Name] = entry
+		}
+		if ds.UID != "" {
+			result[ds.UID] = entry
+		}
+	}
+	return result
+}
+
+// persesDatasourceName returns the name the migrated selectors use for a Grafana datasource:
+// the target of the matching mapping rule, otherwise the UID or, without UID, the name
+func persesDatasourceName(ds provisionedDatasource) string {
+	if datasourceMapping != nil {
+		if rule := datasourceMapping.find(grafanaDatasource{UID: ds.UID, Name: ds.Name, Type: ds.Type}); rule != nil && rule.Datasource.Name != "" {
+			return rule.Datasource.Name
+		}
+	}
+	name := ds.UID
+	if name == "" {
+		name = ds.Name
+	}
+	return strings.Trim(persesNameRegexp.ReplaceAllString(name, "-"), "-")
+}
+
+// persesSelectorName returns the name of the Perses datasource generated for the Grafana datasource a selector
+// references by UID or name, empty if it has no usable name
+func persesSelectorName(reference, kind string) string {
+	ds := resolveDatasource(reference, kind)
+	return persesDatasourceName(provisionedDatasource{UID: ds.UID, Name: ds.Name, Type: ds.Type})
+}
+
+// convertDatasourceSpec converts a Grafana datasource to the Perses datasource spec of its plugin
+func convertDatasourceSpec(ds provisionedDatasource, kind string) (persesv1.DatasourceSpec, []string) {
+	var warnings []string
+	pluginSpec := map[string]any{}
+
+	// Browser access queries the datasource directly, server access goes through the Perses proxy
+	if ds.Access == "direct" {
+		pluginSpec["directUrl"] = ds.URL
+	} else {
+		pluginSpec["proxy"] = map[string]any{
+			"kind": "HTTPProxy",
+			"spec": map[string]any{"url": ds.URL},
+		}
+	}
+
+	if interval, ok := ds.JSONData["timeInterval"].(string); ok && interval != "" && kind == "PrometheusDatasource" {
+		if _, err := common.ParseDuration(interval); err == nil {
+			pluginSpec["scrapeInterval"] = interval
+		}
+	}
+
+	if ds.BasicAuth || len(ds.SecureJSONData) > 0 || ds.JSONData["httpHeaderName1"] != nil {
+		warnings = append(warnings, fmt.Sprintf("Datasource %s uses credentials, create a Perses secret and reference it in the proxy spec", ds.Name))
+	}
+
+	return persesv1.DatasourceSpec{
+		Display: &common.Display{Name: ds.Name},
+		Default: ds.IsDefault,
+		Plugin:  common.Plugin{Kind: kind, Spec: pluginSpec},
+	}, warnings
+}
+
+// generateDatasourceResources writes a Perses datasource for every supported Grafana datasource and cross-checks
+// them with the datasources referenced by the dashboards migrated in this run
+func generateDatasourceResources(datasources []provisionedDatasource, dashboards []dashboardReport, outputDir string) (*datasourceCheck, error) {
+	if err := os.RemoveAll(outputDir); err != nil {
+		return nil, fmt.Errorf("failed to clean datasources output directory: %v", err)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create datasources output directory: %v", err)
+	}
+
+	check := &datasourceCheck{}
+	generated := make(map[datasourceReference]bool)
+	defaults := make(map[string]string) // kind -> name of the default datasource
+	for _, ds := range datasources {
+		kind, ok := persesDatasourceKinds[ds.Type]
+		if !ok {
+			check.Skipped = append(check.Skipped, fmt.Sprintf("%s (%s)", ds.Name, ds.Type))
+			continue
+		}
+
+		name := persesDatasourceName(ds)
+		if name == "" {
+			check.Warnings = append(check.Warnings, fmt.Sprintf("Datasource of type %s has neither UID nor name, skipping it", ds.Type))
+			continue
+		}
+		ref := datasourceReference{Kind: kind, Name: name}
+		if generated[ref] {
+			check.Warnings = append(check.Warnings, fmt.Sprintf("Datasource %s is mapped to %s like a previous datasource, skipping it", ds.Name, name))
+			continue
+		}
+
+		spec, warnings := convertDatasourceSpec(ds, kind)
+		check.Warnings = append(check.Warnings, warnings...)
+		if spec.Default {
+			if defaults[kind] != "" {
+				check.Warnings = append(check.Warnings, fmt.Sprintf("Datasource %s is a second default %s, unsetting its default flag", ds.Name, kind))
+				spec.Default = false
+			} else {
+				defaults[kind] = name
+			}
+		}
+
+		var resource any
+		if *datasourceProject != "" {
+			resource = persesv1.Datasource{
+				Kind:     persesv1.KindDatasource,
+				Metadata: persesv1.ProjectMetadata{Metadata: persesv1.Metadata{Name: name}, ProjectMetadataWrapper: persesv1.ProjectMetadataWrapper{Project: *datasourceProject}},
+				Spec:     spec,
+			}
+		} else {
+			resource = persesv1.GlobalDatasource{
+				Kind:     persesv1.KindGlobalDatasource,
+				Metadata: persesv1.Metadata{Name: name},
+				Spec:     spec,
+			}
+		}
+
+		data, err := json.MarshalIndent(resource, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal datasource %s: %v", name, err)
+		}
+		if data, err = encodeOutput(data); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(outputDir, name+outputExtension()), data, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write datasource %s: %v", name, err)
+		}
+
+		generated[ref] = true
+		check.Generated = append(check.Generated, name)
+	}
+
+	referenced := collectDatasourceReferences(dashboards)
+	for ref := range referenced {
+		if ref.Name == "" {
+			if defaults[ref.Kind] == "" {
+				check.Missing = append(check.Missing, ref)
+			}
+			continue
+		}
+		if !generated[ref] {
+			check.Missing = append(check.Missing, ref)
+		}
+	}
+	for ref := range generated {
+		// Selectors without a name use the default datasource of their kind
+		if !referenced[ref] && !(defaults[ref.Kind] == ref.Name && referenced[datasourceReference{Kind: ref.Kind}]) {
+			check.Unused = append(check.Unused, ref.Name)
+		}
+	}
+
+	sort.Strings(check.Generated)
+	sort.Strings(check.Skipped)
+	sort.Strings(check.Unused)
+	sort.Slice(check.Missing, func(i, j int) bool {
+		if check.Missing[i].Kind != check.Missing[j].Kind {
+			return check.Missing[i].Kind < check.Missing[j].Kind
+		}
+		return check.Missing[i].Name < check.Missing[j].Name
+	})
+	for _, warning := range check.Warnings {
+		log.Printf("Warning: %s", warning)
+	}
+	return check, nil
+}
+
+// collectDatasourceReferences returns the datasource selectors of the migrated dashboards. Only the dashboards of
+// this run are read, dashboards left in the output directory by earlier runs are not.
+func collectDatasourceReferences(dashboards []dashboardReport) map[datasourceReference]bool {
+	references := make(map[datasourceReference]bool)
+	for _, dashboard := range dashboards {
+		if dashboard.PersesFile == "" {
+			continue
+		}
+		data, err := readOutputFile(filepath.Join(*outputDir, filepath.FromSlash(dashboard.PersesFile)))
+		if err != nil {
+			log.Printf("Warning: Failed to read %s to check its datasources: %v", dashboard.PersesFile, err)
+			continue
+		}
+		var persesDashboard any
+		if err := json.Unmarshal(data, &persesDashboard); err != nil {
+			log.Printf("Warning: Failed to parse %s to check its datasources: %v", dashboard.PersesFile, err)
+			continue
+		}
+		collectSelectors(persesDashboard, references)
+	}
+	return references
+}
+
+func collectSelectors(value any, references map[datasourceReference]bool) {
+	switch v := value.(type) {
+	case map[string]any:
+		if selector, ok := v["datasource"].(map[string]any); ok {
+			if kind, ok := selector["kind"].(string); ok && kind != "" {
+				name, _ := selector["name"].(string)
+				references[datasourceReference{Kind: kind, Name: name}] = true
+			}
+		}
+		for _, nested := range v {
+			collectSelectors(nested, references)
+		}
+	case []any:
+		for _, nested := range v {
+			collectSelectors(nested, references)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadProvisionedDatasources(t *testing.T) {
+	t.Setenv("PROMETHEUS_URL", "http://prometheus:9090")
+	dir := t.TempDir()
+	files := map[string]string{
+		"b.yml": "apiVersion: 1\ndatasources:\n  - {name: Loki, uid: loki, type: loki, url: http://loki:3100}\n",
+		"a.yaml": `apiVersion: 1
+datasources:
+  - name: Prometheus
+    uid: prom
+    type: prometheus
+    access: proxy
+    url: $PROMETHEUS_URL
+    isDefault: true
+    basicAuth: true
+    jsonData: {timeInterval: 30s}
+    secureJsonData: {basicAuthPassword: secret}
+`,
+		"notes.txt": "not provisioning",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	datasources, err := loadProvisionedDatasources(dir)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	want := []provisionedDatasource{
+		{
+			UID: "prom", Name: "Prometheus", Type: "prometheus", Access: "proxy", URL: "http://prometheus:9090",
+			IsDefault: true, BasicAuth: true, JSONData: map[string]any{"timeInterval": "30s"},
+			SecureJSONData: map[string]any{"basicAuthPassword": "secret"},
+		},
+		{UID: "loki", Name: "Loki", Type: "loki", URL: "http://loki:3100"},
+	}
+	if !reflect.DeepEqual(datasources, want) {
+		t.Errorf("datasources = %+v\nwant %+v", datasources, want)
+	}
+
+	// A single file is read like a directory with one file
+	datasources, err = loadProvisionedDatasources(filepath.Join(dir, "b.yml"))
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if len(datasources) != 1 || datasources[0].UID != "loki" {
+		t.Errorf("datasources = %+v, want the Loki datasource", datasources)
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("datasources: ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadProvisionedDatasources(invalid); err == nil || !strings.Contains(err.Error(), "failed to parse datasource provisioning") {
+		t.Errorf("error = %v, want a parse error", err)
+	}
+	if _, err := loadProvisionedDatasources(filepath.Join(dir, "missing")); err == nil {
+		t.Error("loading a missing path succeeded")
+	}
+}
+
+func TestConvertDatasourceSpec(t *testing.T) {
+	tests := []struct {
+		name         string
+		ds           provisionedDatasource
+		kind         string
+		wantSpec     map[string]any
+		wantWarnings int
+	}{
+		{
+			name:     "server access goes through the proxy",
+			ds:       provisionedDatasource{Name: "Prometheus", Access: "proxy", URL: "http://prometheus:9090"},
+			kind:     "PrometheusDatasource",
+			wantSpec: map[string]any{"proxy": map[string]any{"kind": "HTTPProxy", "spec": map[string]any{"url": "http://prometheus:9090"}}},
+		},
+		{
+			name:     "browser access uses the direct URL",
+			ds:       provisionedDatasource{Name: "Prometheus", Access: "direct", URL: "http://prometheus:9090"},
+			kind:     "PrometheusDatasource",
+			wantSpec: map[string]any{"directUrl": "http://prometheus:9090"},
+		},
+		{
+			name:     "scrape interval",
+			ds:       provisionedDatasource{Name: "Prometheus", Access: "direct", URL: "u", JSONData: map[string]any{"timeInterval": "15s"}},
+			kind:     "PrometheusDatasource",
+			wantSpec: map[string]any{"directUrl": "u", "scrapeInterval": "15s"},
+		},
+		{
+			name:     "invalid scrape interval is dropped",
+			ds:       provisionedDatasource{Name: "Prometheus", Access: "direct", URL: "u", JSONData: map[string]any{"timeInterval": "often"}},
+			kind:     "PrometheusDatasource",
+			wantSpec: map[string]any{"directUrl": "u"},
+		},
+		{
+			name:     "scrape interval only for Prometheus",
+			ds:       provisionedDatasource{Name: "Loki", Access: "direct", URL: "u", JSONData: map[string]any{"timeInterval": "15s"}},
+			kind:     "LokiDatasource",
+			wantSpec: map[string]any{"directUrl": "u"},
+		},
+		{
+			name:         "credentials",
+			ds:           provisionedDatasource{Name: "Prometheus", Access: "direct", URL: "u", BasicAuth: true},
+			kind:         "PrometheusDatasource",
+			wantSpec:     map[string]any{"directUrl": "u"},
+			wantWarnings: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec, warnings := convertDatasourceSpec(test.ds, test.kind)
+			if spec.Plugin.Kind != test.kind {
+				t.Errorf("plugin kind = %s, want %s", spec.Plugin.Kind, test.kind)
+			}
+			if !reflect.DeepEqual(spec.Plugin.Spec, test.wantSpec) {
+				t.Errorf("plugin spec = %v, want %v", spec.Plugin.Spec, test.wantSpec)
+			}
+			if spec.Display == nil || spec.Display.Name != test.ds.Name {
+				t.Errorf("display = %+v, want the name %s", spec.Display, test.ds.Name)
+			}
+			if len(warnings) != test.wantWarnings {
+				t.Errorf("warnings = %q, want %d", warnings, test.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestGenerateDatasourceResources(t *testing.T) {
+	setDatasourceOptions(t, nil, false)
+	previousOutputDir, previousProject := *outputDir, *datasourceProject
+	defer func() { *outputDir, *datasourceProject = previousOutputDir, previousProject }()
+	*outputDir, *datasourceProject = t.TempDir(), ""
+
+	dashboards := map[string]string{
+		"perses/team/cpu.json": `{"spec": {"panels": {"a": {"spec": {"queries": [{"spec": {"plugin": {"spec": {
+			"datasource": {"kind": "PrometheusDatasource", "name": "prom"}}}}}]}}},
+			"variables": [{"spec": {"plugin": {"spec": {"datasource": {"kind": "PrometheusDatasource"}}}}}]}}`,
+		"perses/team/logs.json": `{"spec": {"panels": {"a": {"spec": {"queries": [{"spec": {"plugin": {"spec": {
+			"datasource": {"kind": "LokiDatasource", "name": "gone"}}}}}]}}}}}`,
+		// Left by an earlier run, not in the reports of this run
+		"perses/team/stale.json": `{"spec": {"panels": {"a": {"spec": {"queries": [{"spec": {"plugin": {"spec": {
+			"datasource": {"kind": "TempoDatasource", "name": "stale"}}}}}]}}}}}`,
+	}
+	for file, content := range dashboards {
+		path := filepath.Join(*outputDir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reports := []dashboardReport{
+		{InputPath: "team/cpu.json", PersesFile: "perses/team/cpu.json"},
+		{InputPath: "team/logs.json", PersesFile: "perses/team/logs.json"},
+		{InputPath: "team/failed.json"},
+	}
+
+	datasourcesDir := filepath.Join(*outputDir, datasourcesDirName)
+	staleResource := filepath.Join(datasourcesDir, "removed.json")
+	if err := os.MkdirAll(datasourcesDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(staleResource, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	datasources := []provisionedDatasource{
+		{UID: "prom", Name: "Prometheus", Type: "prometheus", URL: "http://prometheus:9090", IsDefault: true},
+		{UID: "thanos", Name: "Thanos", Type: "prometheus", URL: "http://thanos:9090", IsDefault: true},
+		{UID: "prom", Name: "Prometheus copy", Type: "prometheus"},
+		{UID: "pg", Name: "Postgres", Type: "postgres"},
+		{Type: "loki"},
+	}
+	check, err := generateDatasourceResources(datasources, reports, datasourcesDir)
+	if err != nil {
+		t.Fatalf("generation failed: %v", err)
+	}
+
+	if want := []string{"prom", "thanos"}; !reflect.DeepEqual(check.Generated, want) {
+		t.Errorf("generated = %q, want %q", check.Generated, want)
+	}
+	if want := []string{"Postgres (postgres)"}; !reflect.DeepEqual(check.Skipped, want) {
+		t.Errorf("skipped = %q, want %q", check.Skipped, want)
+	}
+	// The Tempo datasource of the stale dashboard is not checked, the default selector uses prom
+	if want := []datasourceReference{{Kind: "LokiDatasource", Name: "gone"}}; !reflect.DeepEqual(check.Missing, want) {
+		t.Errorf("missing = %+v, want %+v", check.Missing, want)
+	}
+	if want := []string{"thanos"}; !reflect.DeepEqual(check.Unused, want) {
+		t.Errorf("unused = %q, want %q", check.Unused, want)
+	}
+	for _, warning := range []string{
+		"Datasource Thanos is a second default PrometheusDatasource, unsetting its default flag",
+		"Datasource Prometheus copy is mapped to prom like a previous datasource, skipping it",
+		"Datasource of type loki has neither UID nor name, skipping it",
+	} {
+		if !containsString(check.Warnings, warning) {
+			t.Errorf("warnings %q don't contain %q", check.Warnings, warning)
+		}
+	}
+
+	prom := decodeJSON(t, readTestFile(t, filepath.Join(datasourcesDir, "prom.json")))
+	if kind := lookup(prom, "kind"); kind != "GlobalDatasource" {
+		t.Errorf("kind = %v, want GlobalDatasource", kind)
+	}
+	if isDefault := lookup(prom, "spec", "default"); isDefault != true {
+		t.Errorf("prom default = %v, want true", isDefault)
+	}
+	thanos := decodeJSON(t, readTestFile(t, filepath.Join(datasourcesDir, "thanos.json")))
+	if isDefault := lookup(thanos, "spec", "default"); isDefault == true {
+		t.Error("the second default datasource kept its default flag")
+	}
+	if _, err := os.Stat(staleResource); !os.IsNotExist(err) {
+		t.Errorf("datasource of an earlier run was not removed: %v", err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
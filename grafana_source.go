@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dashboards of a live Grafana or Plutono instance are downloaded into <output-dir>/grafana-source, one
+// subdirectory per folder, and then go through the same pipeline as dashboards read from --input-dir.
+// Plutono is a fork of Grafana 7.5 and serves the same search and dashboard APIs.
+
+const (
+	sourceDirName   = "grafana-source"
+	searchPageLimit = 1000
+)
+
+// grafanaSearchHit is an entry of the /api/search response
+type grafanaSearchHit struct {
+	UID         string   `json:"uid"`
+	Title       string   `json:"title"`
+	Type        string   `json:"type"`
+	Tags        []string `json:"tags"`
+	FolderUID   string   `json:"folderUid"`
+	FolderTitle string   `json:"folderTitle"`
+}
+
+// grafanaFolder is the /api/folders/:uid response. Parents are only returned by Grafana versions with nested folders.
+type grafanaFolder struct {
+	UID     string          `json:"uid"`
+	Title   string          `json:"title"`
+	Parents []grafanaFolder `json:"parents"`
+}
+
+type grafanaClient struct {
+	baseURL  string
+	token    string
+	user     string
+	password string
+	http     *http.Client
+}
+
+func newGrafanaClient(baseURL string) *grafanaClient {
+	token := *grafanaToken
+	if token == "" {
+		token = os.Getenv("GRAFANA_TOKEN")
+	}
+	password := *grafanaPassword
+	if password == "" {
+		password = os.Getenv("GRAFANA_PASSWORD")
+	}
+
+	return &grafanaClient{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		token:    token,
+		user:     *grafanaUser,
+		password: password,
+		http:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// get requests an API path and decodes the JSON response into v
+func (c *grafanaClient) get(path string, query url.Values, v any) error {
+	requestURL := c.baseURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("request to %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("request to %s failed with status %d: %s", path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response of %s: %v", path, err)
+	}
+	return nil
+}
+
+// searchDashboards lists the dashboards matching the --grafana-tag, --grafana-folder and --grafana-dashboard-uid filters
+func (c *grafanaClient) searchDashboards() ([]grafanaSearchHit, error) {
+	query := url.Values{}
+	query.Set("type", "dash-db")
+	query.Set("limit", fmt.Sprint(searchPageLimit))
+	for _, tag := range splitList(*grafanaTags) {
+		query.Add("tag", tag)
+	}
+
+	folders := splitList(*grafanaFolders)
+	uids := splitList(*grafanaDashboardUIDs)
+
+	var hits []grafanaSearchHit
+	seen := make(map[string]bool)
+	for page := 1; ; page++ {
+		query.Set("page", fmt.Sprint(page))
+
+		var results []grafanaSearchHit
+		if err := c.get("/api/search", query, &results); err != nil {
+			return nil, err
+		}
+
+		// Old versions ignore the page parameter and return the first page again
+		added := 0
+		for _, hit := range results {
+			if hit.Type != "dash-db" || seen[hit.UID] {
+				continue
+			}
+			seen[hit.UID] = true
+			added++
+
+			if len(folders) > 0 && !matchesAny(folders, hit.FolderUID, folderTitleOrGeneral(hit.FolderTitle)) {
+				continue
+			}
+			if len(uids) > 0 && !matchesAny(uids, hit.UID) {
+				continue
+			}
+			hits = append(hits, hit)
+		}
+
+		if len(results) < searchPageLimit || added == 0 {
+			break
+		}
+	}
+
+	sort.Slice(hits, func(i, j int) bool { return hits[i].UID < hits[j].UID })
+	return hits, nil
+}
+
+// folderPath returns the relative directory of a folder, including its parent folders when the server has nested folders
+func (c *grafanaClient) folderPath(hit grafanaSearchHit) (string, error) {
+	if hit.FolderUID == "" {
+		// Plutono and old Grafana versions don't return the folder UID, only the title
+		if hit.FolderTitle == "" {
+			return "", nil
+		}
+		return folderDirName(hit.FolderTitle), nil
+	}
+
+	var folder grafanaFolder
+	if err := c.get("/api/folders/"+url.PathEscape(hit.FolderUID), nil, &folder); err != nil {
+		return "", err
+	}
+
+	var parts []string
+	for _, parent := range folder.Parents {
+		parts = append(parts, folderDirName(parent.Title))
+	}
+	parts = append(parts, folderDirName(folder.Title))
+	return filepath.Join(parts...), nil
+}
+
+// fetchDashboard returns the dashboard model of the /api/dashboards/uid/:uid response
+func (c *grafanaClient) fetchDashboard(uid string) (map[string]any, error) {
+	var response struct {
+		Dashboard map[string]any `json:"dashboard"`
+	}
+	if err := c.get("/api/dashboards/uid/"+url.PathEscape(uid), nil, &response); err != nil {
+		return nil, err
+	}
+	if response.Dashboard == nil {
+		return nil, fmt.Errorf("no dashboard found in response for %s", uid)
+	}
+	return response.Dashboard, nil
+}
+
+// fetchDatasources lists the datasources of the instance
+func (c *grafanaClient) fetchDatasources() ([]provisionedDatasource, error) {
+	var datasources []provisionedDatasource
+	if err := c.get("/api/datasources", nil, &datasources); err != nil {
+		return nil, err
+	}
+	return datasources, nil
+}
+
+// downloadFailure is a dashboard of the instance that could not be downloaded, reported as a failed migration
+type downloadFailure struct {
+	InputPath string // relative path the dashboard would have in the source directory
+	Title     string
+	UID       string
+	Err       error
+	StartedAt time.Time
+}
+
+// downloadDashboards fetches every matching dashboard into sourceDir, mirroring the folder hierarchy, and returns
+// the dashboards that failed to download. The directory is recreated so that dashboards deleted on the server are
+// not migrated again.
+func downloadDashboards(baseURL, sourceDir string) ([]downloadFailure, error) {
+	client := newGrafanaClient(baseURL)
+
+	fmt.Printf("Searching dashboards on %s...\n", client.baseURL)
+	hits, err := client.searchDashboards()
+	if err != nil {
+		return nil, fmt.Errorf("failed to search dashboards: %v", err)
+	}
+	if len(hits) == 0 {
+		return nil, fmt.Errorf("no dashboards found on %s matching the filters", client.baseURL)
+	}
+	fmt.Printf("Found %d dashboards, downloading to %s\n", len(hits), sourceDir)
+
+	// The datasources are needed to know the type of the datasources referenced by the queries, to match the mapping
+	// rules by name, UID and type, and to generate Perses datasources. Provisioning files given with
+	// --datasource-provisioning take precedence.
+	if *datasourceProvisioning == "" {
+		datasources, err := client.fetchDatasources()
+		if err != nil {
+			log.Printf("Warning: Failed to list datasources, only the queries of typed datasource references are migrated and mapping rules only match the references used by the dashboards: %v", err)
+		} else {
+			provisionedDatasources = datasources
+			grafanaDatasources = indexDatasources(datasources)
+		}
+	}
+
+	if err := os.RemoveAll(sourceDir); err != nil {
+		return nil, fmt.Errorf("failed to clean source directory: %v", err)
+	}
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create source directory: %v", err)
+	}
+
+	// Folder paths are shared by many dashboards, resolve each folder only once. The lock only guards the cache so
+	// that the dashboards of other folders are not held up by the request; the dashboards of the same folder wait
+	// for its first resolution.
+	type folderEntry struct {
+		once sync.Once
+		path string
+		err  error
+	}
+	var folderMutex sync.Mutex
+	folders := make(map[string]*folderEntry)
+	resolveFolder := func(hit grafanaSearchHit) (string, error) {
+		key := hit.FolderUID + "/" + hit.FolderTitle
+		folderMutex.Lock()
+		entry, ok := folders[key]
+		if !ok {
+			entry = &folderEntry{}
+			folders[key] = entry
+		}
+		folderMutex.Unlock()
+		entry.once.Do(func() {
+			entry.path, entry.err = client.folderPath(hit)
+		})
+		return entry.path, entry.err
+	}
+
+	var failedMutex sync.Mutex
+	var failed []downloadFailure
+	forEachConcurrently(len(hits), *concurrency, func(i int) {
+		hit := hits[i]
+		startedAt := time.Now()
+		path, err := downloadDashboard(client, hit, sourceDir, resolveFolder)
+		if err != nil {
+			log.Printf("Warning: Failed to download dashboard %s (%s): %v", hit.Title, hit.UID, err)
+			failedMutex.Lock()
+			failed = append(failed, downloadFailure{InputPath: path, Title: hit.Title, UID: hit.UID, Err: err, StartedAt: startedAt})
+			failedMutex.Unlock()
+		}
+	})
+
+	if len(failed) == len(hits) {
+		return nil, fmt.Errorf("failed to download any dashboard")
+	}
+	fmt.Printf("Downloaded %d/%d dashboards\n\n", len(hits)-len(failed), len(hits))
+	return failed, nil
+}
+
+// downloadDashboard writes a dashboard in the directory of its folder and returns its path relative to sourceDir,
+// which is also returned on failure to report the dashboard
+func downloadDashboard(client *grafanaClient, hit grafanaSearchHit, sourceDir string, resolveFolder func(grafanaSearchHit) (string, error)) (string, error) {
+	fileName := folderDirName(hit.UID) + ".json"
+	folder, err := resolveFolder(hit)
+	if err != nil {
+		if hit.FolderTitle != "" {
+			fileName = filepath.Join(folderDirName(hit.FolderTitle), fileName)
+		}
+		return fileName, fmt.Errorf("failed to resolve folder %s: %v", hit.FolderTitle, err)
+	}
+	path := filepath.Join(folder, fileName)
+
+	dashboard, err := client.fetchDashboard(hit.UID)
+	if err != nil {
+		return path, err
+	}
+
+	targetDir := filepath.Join(sourceDir, folder)
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return path, fmt.Errorf("failed to create folder directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(dashboard, "", "  ")
+	if err != nil {
+		return path, fmt.Errorf("failed to marshal dashboard: %v", err)
+	}
+	return path, os.WriteFile(filepath.Join(sourceDir, path), data, 0644)
+}
+
+// folderDirName makes a folder title usable as a single directory name
+func folderDirName(title string) string {
+	name := strings.NewReplacer("/", "-", "\\", "-").Replace(strings.TrimSpace(title))
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// folderTitleOrGeneral returns the title of the folder of a search hit; dashboards outside of folders are in "General"
+func folderTitleOrGeneral(title string) string {
+	if title == "" {
+		return "General"
+	}
+	return title
+}
+
+// splitList splits a comma separated flag value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func matchesAny(filters []string, values ...string) bool {
+	for _, filter := range filters {
+		for _, value := range values {
+			if value != "" && strings.EqualFold(filter, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeGrafana is a stand-in for the search, folders, dashboards and datasources endpoints of the Grafana API
+type fakeGrafana struct {
+	mutex       sync.Mutex
+	hits        []grafanaSearchHit
+	folders     map[string]grafanaFolder // by UID
+	failing     map[string]bool          // dashboard UIDs answered with an error
+	ignorePages bool                     // answer every search with the first page, like old versions
+	requests    []string                 // path and query of every request
+}
+
+func newFakeGrafana(t *testing.T) (*fakeGrafana, *grafanaClient) {
+	fake := &fakeGrafana{folders: make(map[string]grafanaFolder), failing: make(map[string]bool)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, &grafanaClient{baseURL: server.URL, http: server.Client()}
+}
+
+func (f *fakeGrafana) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests = append(f.requests, r.URL.RequestURI())
+
+	switch path := r.URL.Path; {
+	case path == "/api/search":
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if f.ignorePages || page < 1 {
+			page = 1
+		}
+		start, end := min((page-1)*limit, len(f.hits)), min(page*limit, len(f.hits))
+		_ = json.NewEncoder(w).Encode(f.hits[start:end])
+	case strings.HasPrefix(path, "/api/folders/"):
+		folder, ok := f.folders[strings.TrimPrefix(path, "/api/folders/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(folder)
+	case strings.HasPrefix(path, "/api/dashboards/uid/"):
+		uid := strings.TrimPrefix(path, "/api/dashboards/uid/")
+		if f.failing[uid] {
+			http.Error(w, `{"message":"forced"}`, http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"dashboard": map[string]any{"uid": uid, "title": "Dashboard " + uid}})
+	case path == "/api/datasources":
+		_ = json.NewEncoder(w).Encode([]provisionedDatasource{{UID: "prom", Name: "Prometheus", Type: "prometheus", IsDefault: true}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// count returns how many requests started with a path
+func (f *fakeGrafana) count(prefix string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	count := 0
+	for _, request := range f.requests {
+		if strings.HasPrefix(request, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+// setGrafanaFilters sets the --grafana-tag, --grafana-folder and --grafana-dashboard-uid flags of a test and
+// restores them after it
+func setGrafanaFilters(t *testing.T, tags, folders, uids string) {
+	t.Helper()
+	previousTags, previousFolders, previousUIDs := *grafanaTags, *grafanaFolders, *grafanaDashboardUIDs
+	t.Cleanup(func() {
+		*grafanaTags, *grafanaFolders, *grafanaDashboardUIDs = previousTags, previousFolders, previousUIDs
+	})
+	*grafanaTags, *grafanaFolders, *grafanaDashboardUIDs = tags, folders, uids
+}
+
+func TestSearchDashboards(t *testing.T) {
+	// A full first page and a second one, sorted by UID in the result
+	var paged []grafanaSearchHit
+	for i := searchPageLimit; i > 0; i-- {
+		paged = append(paged, grafanaSearchHit{UID: fmt.Sprintf("d%04d", i), Type: "dash-db"})
+	}
+	paged = append(paged, grafanaSearchHit{UID: "f", Type: "dash-folder"}, grafanaSearchHit{UID: "d0000", Type: "dash-db"})
+
+	filtered := []grafanaSearchHit{
+		{UID: "cpu", Type: "dash-db", FolderUID: "infra-uid", FolderTitle: "Infra"},
+		{UID: "mem", Type: "dash-db", FolderUID: "infra-uid", FolderTitle: "Infra"},
+		{UID: "home", Type: "dash-db"},
+		{UID: "logs", Type: "dash-db", FolderUID: "apps", FolderTitle: "Apps"},
+		{UID: "apps", Type: "dash-folder", FolderTitle: "Apps"},
+	}
+
+	tests := []struct {
+		name         string
+		hits         []grafanaSearchHit
+		ignorePages  bool
+		folders      string
+		uids         string
+		wantCount    int
+		wantUIDs     []string // checked when set
+		wantSearches int
+	}{
+		{name: "pages", hits: paged, wantCount: searchPageLimit + 1, wantSearches: 2},
+		{name: "pages ignored by the server", hits: paged[:searchPageLimit], ignorePages: true, wantCount: searchPageLimit, wantSearches: 2},
+		{name: "no filter", hits: filtered, wantUIDs: []string{"cpu", "home", "logs", "mem"}, wantSearches: 1},
+		{name: "folder title", hits: filtered, folders: "infra", wantUIDs: []string{"cpu", "mem"}, wantSearches: 1},
+		{name: "folder uid and General", hits: filtered, folders: "apps, general", wantUIDs: []string{"home", "logs"}, wantSearches: 1},
+		{name: "dashboard uids", hits: filtered, uids: "CPU,logs,missing", wantUIDs: []string{"cpu", "logs"}, wantSearches: 1},
+		{name: "folder and uid", hits: filtered, folders: "Infra", uids: "mem,logs", wantUIDs: []string{"mem"}, wantSearches: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setGrafanaFilters(t, "team-a,prod", test.folders, test.uids)
+			fake, client := newFakeGrafana(t)
+			fake.hits, fake.ignorePages = test.hits, test.ignorePages
+
+			hits, err := client.searchDashboards()
+			if err != nil {
+				t.Fatalf("search failed: %v", err)
+			}
+
+			var uids []string
+			for _, hit := range hits {
+				uids = append(uids, hit.UID)
+			}
+			if test.wantUIDs != nil && !reflect.DeepEqual(uids, test.wantUIDs) {
+				t.Errorf("uids = %q, want %q", uids, test.wantUIDs)
+			}
+			if test.wantCount != 0 && len(hits) != test.wantCount {
+				t.Errorf("found %d dashboards, want %d", len(hits), test.wantCount)
+			}
+			for i := 1; i < len(uids); i++ {
+				if uids[i-1] >= uids[i] {
+					t.Fatalf("uids are not sorted and unique: %q before %q", uids[i-1], uids[i])
+				}
+			}
+			if searches := fake.count("/api/search"); searches != test.wantSearches {
+				t.Errorf("%d searches, want %d", searches, test.wantSearches)
+			}
+			if !strings.Contains(fake.requests[0], "tag=team-a&tag=prod") || !strings.Contains(fake.requests[0], "type=dash-db") {
+				t.Errorf("search request %s doesn't filter by type and tags", fake.requests[0])
+			}
+		})
+	}
+}
+
+func TestDownloadDashboards(t *testing.T) {
+	setGrafanaFilters(t, "", "", "")
+	setDatasourceOptions(t, nil, false)
+	previousProvisioned, previousProvisioning, previousConcurrency := provisionedDatasources, *datasourceProvisioning, *concurrency
+	defer func() {
+		provisionedDatasources, *datasourceProvisioning, *concurrency = previousProvisioned, previousProvisioning, previousConcurrency
+	}()
+	*datasourceProvisioning, *concurrency = "", 4
+
+	fake, client := newFakeGrafana(t)
+	fake.hits = []grafanaSearchHit{
+		{UID: "cpu", Title: "CPU", Type: "dash-db", FolderUID: "nodes", FolderTitle: "Nodes"},
+		{UID: "mem", Title: "Memory", Type: "dash-db", FolderUID: "nodes", FolderTitle: "Nodes"},
+		{UID: "disk", Title: "Disk", Type: "dash-db", FolderUID: "nodes", FolderTitle: "Nodes"},
+		{UID: "home", Title: "Home", Type: "dash-db"},
+		{UID: "legacy", Title: "Legacy", Type: "dash-db", FolderTitle: "Old/Plutono"},
+		{UID: "broken", Title: "Broken", Type: "dash-db", FolderUID: "nodes", FolderTitle: "Nodes"},
+		{UID: "lost", Title: "Lost", Type: "dash-db", FolderUID: "deleted", FolderTitle: "Deleted"},
+	}
+	fake.folders["nodes"] = grafanaFolder{UID: "nodes", Title: "Nodes", Parents: []grafanaFolder{{UID: "infra", Title: "Infra"}}}
+	fake.failing["broken"] = true
+
+	sourceDir := filepath.Join(t.TempDir(), sourceDirName)
+	stale := filepath.Join(sourceDir, "deleted-on-the-server.json")
+	if err := os.MkdirAll(sourceDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	failed, err := downloadDashboards(client.baseURL, sourceDir)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+
+	for _, file := range []string{"Infra/Nodes/cpu.json", "Infra/Nodes/mem.json", "Infra/Nodes/disk.json", "home.json", "Old-Plutono/legacy.json"} {
+		data, err := os.ReadFile(filepath.Join(sourceDir, filepath.FromSlash(file)))
+		if err != nil {
+			t.Errorf("dashboard %s was not downloaded: %v", file, err)
+			continue
+		}
+		uid := strings.TrimSuffix(filepath.Base(file), ".json")
+		if got := lookup(decodeJSON(t, string(data)), "uid"); got != uid {
+			t.Errorf("%s has the uid %v, want %s", file, got, uid)
+		}
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("dashboard of an earlier download was not removed: %v", err)
+	}
+
+	var failedPaths []string
+	for _, failure := range failed {
+		failedPaths = append(failedPaths, filepath.ToSlash(failure.InputPath))
+	}
+	if want := []string{"Infra/Nodes/broken.json", "Deleted/lost.json"}; !sameElements(failedPaths, want) {
+		t.Errorf("failed = %q, want %q", failedPaths, want)
+	}
+
+	// Each folder is resolved once however many dashboards it has; title-only folders need no request
+	if requests := fake.count("/api/folders/nodes"); requests != 1 {
+		t.Errorf("folder nodes was requested %d times, want 1", requests)
+	}
+	if requests := fake.count("/api/folders/"); requests != 2 {
+		t.Errorf("%d folder requests, want 2", requests)
+	}
+
+	if ds, ok := grafanaDatasources["prom"]; !ok || ds.Type != "prometheus" || !ds.Default {
+		t.Errorf("datasources of the instance were not indexed: %+v", grafanaDatasources)
+	}
+	if len(provisionedDatasources) != 1 {
+		t.Errorf("provisioned datasources = %+v, want the datasource of the instance", provisionedDatasources)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+)
+
+const testDatasourceMapping = `datasources:
+  - match: {uid: prom-eu}
+    datasource: {kind: PrometheusDatasource, name: thanos-eu}
+  - match: {type: loki}
+    datasource: {kind: LokiDatasource}
+`
+
+// setDatasourceOptions sets the datasource options of a test and restores them after it
+func setDatasourceOptions(t *testing.T, mapping *datasourceMapper, useDefault bool) {
+	t.Helper()
+	previousMapping, previousDefault, previousDatasources := datasourceMapping, *useDefaultPersesDatasource, grafanaDatasources
+	t.Cleanup(func() {
+		datasourceMapping, *useDefaultPersesDatasource, grafanaDatasources = previousMapping, previousDefault, previousDatasources
+	})
+	datasourceMapping, *useDefaultPersesDatasource, grafanaDatasources = mapping, useDefault, nil
+}
+
+func loadTestDatasourceMapping(t *testing.T) *datasourceMapper {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(path, []byte(testDatasourceMapping), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapping, err := loadDatasourceMapping(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mapping
+}
+
+// lookup returns the value at a path of map keys and slice indexes, nil if there is none
+func lookup(value any, path ...any) any {
+	for _, step := range path {
+		switch key := step.(type) {
+		case string:
+			m, ok := value.(map[string]any)
+			if !ok {
+				return nil
+			}
+			value = m[key]
+		case int:
+			s, ok := value.([]any)
+			if !ok || key >= len(s) {
+				return nil
+			}
+			value = s[key]
+		}
+	}
+	return value
+}
+
+const (
+	queryFixture = `{"panels": {"cpu": {"kind": "Panel", "spec": {
+		"display": {"name": "CPU"},
+		"plugin": {"kind": "TimeSeriesChart", "spec": {}},
+		"queries": [{"kind": "TimeSeriesQuery", "spec": {"plugin": {"kind": "PrometheusTimeSeriesQuery", "spec": {
+			"query": "up", "datasource": {"kind": "PrometheusDatasource", "name": %q}}}}}]}}}}`
+	untypedQueryFixture = `{"panels": {"logs": {"kind": "Panel", "spec": {
+		"display": {"name": "Logs"},
+		"plugin": {"kind": "LogsTable", "spec": {}},
+		"queries": [{"kind": "LogQuery", "spec": {"plugin": {"kind": "LokiLogQuery", "spec": {"query": "{app=\"x\"}"}}}}]}}}}`
+	panelFixture = `{"panels": {"trace": {"kind": "Panel", "spec": {
+		"display": {"name": "Trace"},
+		"plugin": {"kind": "TracingGanttChart", "spec": {
+			"links": [{"kind": "LokiLogQuery", "datasource": {"kind": "LokiDatasource", "name": "loki-uid"}}]}}}}}}`
+	variableFixture = `{"variables": [{"kind": "ListVariable", "spec": {"name": "job", "plugin": {
+		"kind": "PrometheusLabelValuesVariable", "spec": {
+			"labelName": "job", "datasource": {"kind": "PrometheusDatasource", "name": %q}}}}}]}`
+	embeddedFixture = `{"datasources": {"tempo": {"default": false, "plugin": {"kind": "TempoDatasource", "spec": {
+		"serviceMap": {"datasource": {"kind": "PrometheusDatasource", "name": "prom-eu"}},
+		"options": {"datasource": {"uid": "prom-eu"}}}}}}}`
+)
+
+var (
+	querySelector    = []any{"panels", "cpu", "spec", "queries", 0, "spec", "plugin", "spec", "datasource"}
+	logsSelector     = []any{"panels", "logs", "spec", "queries", 0, "spec", "plugin", "spec", "datasource"}
+	panelSelector    = []any{"panels", "trace", "spec", "plugin", "spec", "links", 0, "datasource"}
+	variableSelector = []any{"variables", 0, "spec", "plugin", "spec", "datasource"}
+	embeddedSelector = []any{"datasources", "tempo", "plugin", "spec", "serviceMap", "datasource"}
+	embeddedOptions  = []any{"datasources", "tempo", "plugin", "spec", "options", "datasource"}
+)
+
+func TestCleanDatasources(t *testing.T) {
+	tests := []struct {
+		name         string
+		spec         string // spec of the migrated dashboard, without the duration
+		mapping      bool
+		useDefault   bool
+		path         []any
+		want         any
+		wantUnmapped []string
+	}{
+		{
+			name: "query mapped by uid", spec: fmt.Sprintf(queryFixture, "prom-eu"), mapping: true, useDefault: true,
+			path: querySelector, want: map[string]any{"kind": "PrometheusDatasource", "name": "thanos-eu"},
+		},
+		{
+			name: "unmapped query uses the default datasource", spec: fmt.Sprintf(queryFixture, "prom-us"), mapping: true, useDefault: true,
+			path: querySelector, want: map[string]any{"kind": "PrometheusDatasource"}, wantUnmapped: []string{"prom-us"},
+		},
+		{
+			name: "unmapped query keeps its datasource", spec: fmt.Sprintf(queryFixture, "prom-us"), mapping: true,
+			path: querySelector, want: map[string]any{"kind": "PrometheusDatasource", "name": "prom-us"}, wantUnmapped: []string{"prom-us"},
+		},
+		{
+			name: "query without mapping uses the default datasource", spec: fmt.Sprintf(queryFixture, "prom-eu"), useDefault: true,
+			path: querySelector, want: map[string]any{"kind": "PrometheusDatasource"},
+		},
+		{
+			name: "kept selector is named like the generated datasource", spec: fmt.Sprintf(queryFixture, "prom:eu/1"),
+			path: querySelector, want: map[string]any{"kind": "PrometheusDatasource", "name": "prom-eu-1"},
+		},
+		{
+			name: "query without selector mapped by type", spec: untypedQueryFixture, mapping: true, useDefault: true,
+			path: logsSelector, want: map[string]any{"kind": "LokiDatasource"},
+		},
+		{
+			name: "query without selector and mapping", spec: untypedQueryFixture, useDefault: true,
+			path: logsSelector, want: nil,
+		},
+		{
+			name: "selector nested in a panel plugin", spec: panelFixture, mapping: true, useDefault: true,
+			path: panelSelector, want: map[string]any{"kind": "LokiDatasource"},
+		},
+		{
+			name: "list variable mapped by uid", spec: fmt.Sprintf(variableFixture, "prom-eu"), mapping: true, useDefault: true,
+			path: variableSelector, want: map[string]any{"kind": "PrometheusDatasource", "name": "thanos-eu"},
+		},
+		{
+			name: "list variable uses the default datasource", spec: fmt.Sprintf(variableFixture, "prom-us"), useDefault: true,
+			path: variableSelector, want: map[string]any{"kind": "PrometheusDatasource"},
+		},
+		{
+			name: "selector nested in an embedded datasource", spec: embeddedFixture, mapping: true, useDefault: true,
+			path: embeddedSelector, want: map[string]any{"kind": "PrometheusDatasource", "name": "thanos-eu"},
+		},
+		{
+			name: "nested map without kind is not a selector", spec: embeddedFixture, mapping: true, useDefault: true,
+			path: embeddedOptions, want: map[string]any{"uid": "prom-eu"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mapping *datasourceMapper
+			if test.mapping {
+				mapping = loadTestDatasourceMapping(t)
+			}
+			setDatasourceOptions(t, mapping, test.useDefault)
+
+			var spec map[string]any
+			if err := json.Unmarshal([]byte(test.spec), &spec); err != nil {
+				t.Fatalf("invalid fixture: %v", err)
+			}
+			spec["duration"] = "1h"
+			data, err := json.Marshal(map[string]any{
+				"kind":     "Dashboard",
+				"metadata": map[string]any{"name": "test", "project": "team"},
+				"spec":     spec,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dashboard persesv1.Dashboard
+			if err := json.Unmarshal(data, &dashboard); err != nil {
+				t.Fatalf("invalid fixture: %v", err)
+			}
+
+			cleanDatasources(&dashboard, "team/test.json")
+
+			data, err = json.Marshal(dashboard.Spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var cleaned any
+			if err := json.Unmarshal(data, &cleaned); err != nil {
+				t.Fatal(err)
+			}
+			if got := lookup(cleaned, test.path...); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("selector = %v, want %v", got, test.want)
+			}
+
+			if mapping != nil {
+				var unmapped []string
+				for _, ds := range mapping.unmappedDatasources() {
+					unmapped = append(unmapped, ds.Reference)
+				}
+				if !reflect.DeepEqual(unmapped, test.wantUnmapped) {
+					t.Errorf("unmapped datasources = %v, want %v", unmapped, test.wantUnmapped)
+				}
+			}
+		})
+	}
+}
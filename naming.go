@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Output filenames are derived from the input dashboards only, so they are the same on every run.
+// They are planned for all dashboards before the pipeline starts, which lets collisions be resolved
+// in input path order instead of depending on which worker finishes first.
+
+const (
+	namingTitle            = "title"
+	namingUID              = "uid"
+	namingOriginalFilename = "original-filename"
+	namingTitleUID         = "title+uid"
+
+	collisionSuffix = "suffix"
+	collisionError  = "error"
+)
+
+// namingData is the data available to a --naming Go template
+type namingData struct {
+	Title    string
+	UID      string
+	Filename string // input filename without extension
+	Folder   string // relative directory of the input file
+}
+
+// validateNamingStrategy checks the --naming and --filename-collision flags
+func validateNamingStrategy() error {
+	switch *naming {
+	case namingTitle, namingUID, namingOriginalFilename, namingTitleUID:
+	default:
+		if !strings.Contains(*naming, "{{") {
+			return fmt.Errorf("invalid naming strategy %q. Use %s, %s, %s, %s or a Go template", *naming, namingTitle, namingUID, namingOriginalFilename, namingTitleUID)
+		}
+		if _, err := template.New("naming").Parse(*naming); err != nil {
+			return fmt.Errorf("invalid naming template: %v", err)
+		}
+	}
+
+	if *filenameCollision != collisionSuffix && *filenameCollision != collisionError {
+		return fmt.Errorf("invalid filename collision handling %q. Use %s or %s", *filenameCollision, collisionSuffix, collisionError)
+	}
+	return nil
+}
+
+// plannedOutput is the output filename of an input file together with the dashboard fields it was derived from
+type plannedOutput struct {
+	namingData
+	Name        string // output filename without extension, empty if it collides with --filename-collision=error
+	Warning     string
+	ContentHash string // SHA-256 of the input file, empty if it couldn't be read
+}
+
+// planOutputNames returns the output filename (without extension) for every input file.
+// Files whose name collides with another dashboard of the same directory get a suffix, or no name at all
+// with --filename-collision=error.
+func planOutputNames(inputDir string, files []string) map[string]plannedOutput {
+	sorted := append([]string(nil), files...)
+	sort.Strings(sorted)
+
+	plans := make(map[string]plannedOutput, len(files))
+	claimed := make(map[string]string) // output path without extension -> input file
+	for _, file := range sorted {
+		var plan plannedOutput
+		plan.namingData, plan.ContentHash = readNamingData(inputDir, file)
+		name := outputBaseName(plan.namingData)
+
+		key := filepath.Join(plan.Folder, name)
+		if owner, taken := claimed[key]; taken {
+			if *filenameCollision == collisionError {
+				plan.Warning = fmt.Sprintf("Output filename %s%s of %s collides with %s, skipping it", key, outputExtension(), file, owner)
+				log.Printf("Warning: %s", plan.Warning)
+				plans[file] = plan
+				continue
+			}
+			name = resolveCollision(claimed, plan.namingData, name)
+			plan.Warning = fmt.Sprintf("Output filename %s%s of %s collides with %s, using %s%s", key, outputExtension(), file, owner, filepath.Join(plan.Folder, name), outputExtension())
+			log.Printf("Warning: %s", plan.Warning)
+			key = filepath.Join(plan.Folder, name)
+		}
+
+		claimed[key] = file
+		plan.Name = name
+		plans[file] = plan
+	}
+	return plans
+}
+
+// resolveCollision appends the UID to a colliding name, or a counter if that is taken as well
+func resolveCollision(claimed map[string]string, data namingData, name string) string {
+	if uid := sanitizeFilenameForRegex(data.UID); data.UID != "" && !strings.HasSuffix(name, uid) {
+		candidate := fmt.Sprintf("%s-%s", name, uid)
+		if _, taken := claimed[filepath.Join(data.Folder, candidate)]; !taken {
+			return candidate
+		}
+	}
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s-%d", name, i)
+		if _, taken := claimed[filepath.Join(data.Folder, candidate)]; !taken {
+			return candidate
+		}
+	}
+}
+
+// readNamingData reads the naming fields of an input file and hashes its content, so that the file is read once
+// before the pipeline
+func readNamingData(inputDir, file string) (namingData, string) {
+	data := namingData{
+		Filename: strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+	}
+	if rel, err := filepath.Rel(inputDir, file); err == nil && filepath.Dir(rel) != "." {
+		data.Folder = filepath.Dir(rel)
+	}
+
+	// Invalid dashboards fail later in the pipeline, the filename is enough to name them here
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return data, ""
+	}
+	sum := sha256.Sum256(content)
+	data.Title, data.UID = decodeTitleAndUID(content)
+	return data, hex.EncodeToString(sum[:])
+}
+
+// decodeTitleAndUID returns the top-level title and uid of a dashboard. Only the top-level keys are decoded, the
+// other values are skipped, and the decoding stops once both are found.
+func decodeTitleAndUID(content []byte) (title, uid string) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return "", ""
+	}
+	var foundTitle, foundUID bool
+	for decoder.More() && !(foundTitle && foundUID) {
+		token, err := decoder.Token()
+		if err != nil {
+			return title, uid
+		}
+		key, _ := token.(string)
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return title, uid
+		}
+		switch key {
+		case "title":
+			foundTitle = json.Unmarshal(value, &title) == nil
+		case "uid":
+			foundUID = json.Unmarshal(value, &uid) == nil
+		}
+	}
+	return title, uid
+}
+
+// outputBaseName applies the naming strategy. The result always matches the Perses name pattern.
+func outputBaseName(data namingData) string {
+	var name string
+	switch *naming {
+	case namingTitle:
+		name = firstNonEmpty(data.Title, data.UID, data.Filename)
+	case namingUID:
+		name = firstNonEmpty(data.UID, data.Title, data.Filename)
+	case namingOriginalFilename:
+		name = data.Filename
+	case namingTitleUID:
+		name = strings.Trim(firstNonEmpty(data.Title, data.Filename)+"-"+data.UID, "-")
+	default:
+		var buf bytes.Buffer
+		tmpl := template.Must(template.New("naming").Parse(*naming))
+		if err := tmpl.Execute(&buf, data); err != nil {
+			log.Printf("Warning: Failed to apply naming template to %s: %v, using the title", data.Filename, err)
+			name = firstNonEmpty(data.Title, data.UID, data.Filename)
+		} else {
+			name = buf.String()
+		}
+	}
+
+	name = sanitizeFilenameForRegex(name)
+	if !validateFilenameRegex(name) {
+		name = sanitizeFilenameForRegex(data.Filename)
+	}
+	return name
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// outputNameOf returns the output filename without extension of a recorded output path
+func outputNameOf(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// setNamingOptions sets the --naming and --filename-collision flags of a test and restores them after it
+func setNamingOptions(t *testing.T, strategy, collision string) {
+	t.Helper()
+	previousNaming, previousCollision := *naming, *filenameCollision
+	t.Cleanup(func() { *naming, *filenameCollision = previousNaming, previousCollision })
+	*naming, *filenameCollision = strategy, collision
+}
+
+func TestOutputBaseName(t *testing.T) {
+	full := namingData{Title: "CPU Usage (Nodes)", UID: "abc_123", Filename: "cpu-old", Folder: "infra"}
+	tests := []struct {
+		name     string
+		strategy string
+		data     namingData
+		want     string
+	}{
+		{name: "title", strategy: namingTitle, data: full, want: "cpu-usage-nodes"},
+		{name: "title falls back to the uid", strategy: namingTitle, data: namingData{UID: "abc", Filename: "f"}, want: "abc"},
+		{name: "title falls back to the filename", strategy: namingTitle, data: namingData{Title: "  ", Filename: "My File"}, want: "my-file"},
+		{name: "uid", strategy: namingUID, data: full, want: "abc-123"},
+		{name: "uid falls back to the title", strategy: namingUID, data: namingData{Title: "CPU", Filename: "f"}, want: "cpu"},
+		{name: "original filename", strategy: namingOriginalFilename, data: full, want: "cpu-old"},
+		{name: "title and uid", strategy: namingTitleUID, data: full, want: "cpu-usage-nodes-abc-123"},
+		{name: "title and missing uid", strategy: namingTitleUID, data: namingData{Title: "CPU", Filename: "f"}, want: "cpu"},
+		{name: "template", strategy: "{{.Folder}}-{{.Title}}", data: full, want: "infra-cpu-usage-nodes"},
+		{name: "template with an unknown field falls back to the title", strategy: "{{.Owner}}", data: full, want: "cpu-usage-nodes"},
+		{name: "name without allowed characters", strategy: namingTitle, data: namingData{Title: "Übersicht ✓", Filename: "f"}, want: "bersicht"},
+		{name: "empty name", strategy: namingTitle, data: namingData{Title: "✓✓"}, want: "dashboard"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setNamingOptions(t, test.strategy, collisionSuffix)
+			if got := outputBaseName(test.data); got != test.want {
+				t.Errorf("outputBaseName(%+v) = %q, want %q", test.data, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPlanOutputNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		strategy  string
+		collision string
+		files     map[string]string // input file -> content
+		want      map[string]string // input file -> planned name
+		warnings  []string          // input files planned with a warning
+	}{
+		{
+			name: "distinct titles", strategy: namingTitle, collision: collisionSuffix,
+			files: map[string]string{"a.json": `{"title": "A", "uid": "1"}`, "b.json": `{"title": "B", "uid": "2"}`},
+			want:  map[string]string{"a.json": "a", "b.json": "b"},
+		},
+		{
+			name: "collision gets the uid", strategy: namingTitle, collision: collisionSuffix,
+			files:    map[string]string{"a.json": `{"title": "CPU", "uid": "one"}`, "b.json": `{"title": "CPU", "uid": "Two"}`},
+			want:     map[string]string{"a.json": "cpu", "b.json": "cpu-two"},
+			warnings: []string{"b.json"},
+		},
+		{
+			name: "collision without uid gets a counter", strategy: namingTitle, collision: collisionSuffix,
+			files:    map[string]string{"a.json": `{"title": "CPU"}`, "b.json": `{"title": "CPU"}`, "c.json": `{"title": "CPU"}`},
+			want:     map[string]string{"a.json": "cpu", "b.json": "cpu-2", "c.json": "cpu-3"},
+			warnings: []string{"b.json", "c.json"},
+		},
+		{
+			name: "taken uid suffix gets a counter", strategy: namingTitle, collision: collisionSuffix,
+			files: map[string]string{
+				"a.json": `{"title": "CPU", "uid": "x"}`,
+				"b.json": `{"title": "CPU x", "uid": "y"}`,
+				"c.json": `{"title": "CPU", "uid": "x"}`,
+			},
+			want:     map[string]string{"a.json": "cpu", "b.json": "cpu-x", "c.json": "cpu-2"},
+			warnings: []string{"c.json"},
+		},
+		{
+			name: "uid already in the name gets a counter", strategy: namingTitleUID, collision: collisionSuffix,
+			files:    map[string]string{"a.json": `{"title": "CPU", "uid": "x"}`, "b.json": `{"title": "CPU", "uid": "x"}`},
+			want:     map[string]string{"a.json": "cpu-x", "b.json": "cpu-x-2"},
+			warnings: []string{"b.json"},
+		},
+		{
+			name: "same name in different folders", strategy: namingTitle, collision: collisionError,
+			files: map[string]string{"team-a/cpu.json": `{"title": "CPU"}`, "team-b/cpu.json": `{"title": "CPU"}`},
+			want:  map[string]string{"team-a/cpu.json": "cpu", "team-b/cpu.json": "cpu"},
+		},
+		{
+			name: "collision error skips the later file", strategy: namingTitle, collision: collisionError,
+			files:    map[string]string{"b.json": `{"title": "CPU", "uid": "2"}`, "a.json": `{"title": "CPU", "uid": "1"}`},
+			want:     map[string]string{"a.json": "cpu", "b.json": ""},
+			warnings: []string{"b.json"},
+		},
+		{
+			name: "invalid dashboard is named after its file", strategy: namingTitle, collision: collisionSuffix,
+			files: map[string]string{"broken.json": `{"title": `},
+			want:  map[string]string{"broken.json": "broken"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setNamingOptions(t, test.strategy, test.collision)
+			inputDir := t.TempDir()
+			var files []string
+			for file, content := range test.files {
+				path := filepath.Join(inputDir, file)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+				files = append(files, path)
+			}
+
+			plans := planOutputNames(inputDir, files)
+
+			got := make(map[string]string)
+			var warnings []string
+			for _, file := range files {
+				plan := plans[file]
+				rel, _ := filepath.Rel(inputDir, file)
+				got[rel] = plan.Name
+				if plan.Warning != "" {
+					warnings = append(warnings, rel)
+				}
+				if plan.ContentHash == "" {
+					t.Errorf("%s has no content hash", rel)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("names = %v, want %v", got, test.want)
+			}
+			if !sameElements(warnings, test.warnings) {
+				t.Errorf("warnings for %v, want %v", warnings, test.warnings)
+			}
+		})
+	}
+}
+
+// sameElements reports whether two lists hold the same elements in any order
+func sameElements(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		counts[s]--
+	}
+	for _, count := range counts {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDecodeTitleAndUID(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		wantTitle string
+		wantUID   string
+	}{
+		{name: "top-level keys", content: `{"uid": "abc", "title": "CPU"}`, wantTitle: "CPU", wantUID: "abc"},
+		{
+			name:      "nested keys are skipped",
+			content:   `{"panels": [{"title": "Panel", "uid": "p"}], "templating": {"uid": "t"}, "title": "CPU"}`,
+			wantTitle: "CPU",
+		},
+		{name: "non-string values", content: `{"title": 42, "uid": null}`},
+		{name: "stops once both are found", content: `{"title": "CPU", "uid": "abc", "panels": [`, wantTitle: "CPU", wantUID: "abc"},
+		{name: "truncated", content: `{"title": "CPU", "uid": `, wantTitle: "CPU"},
+		{name: "not an object", content: `["title", "CPU"]`},
+		{name: "empty", content: ``},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			title, uid := decodeTitleAndUID([]byte(test.content))
+			if title != test.wantTitle || uid != test.wantUID {
+				t.Errorf("decodeTitleAndUID = %q, %q, want %q, %q", title, uid, test.wantTitle, test.wantUID)
+			}
+		})
+	}
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+	"github.com/perses/perses/pkg/model/api/v1/common"
+	"github.com/perses/perses/pkg/model/api/v1/dashboard"
+	"github.com/perses/perses/pkg/model/api/v1/variable"
+)
+
+// The native backend converts Grafana dashboards to Perses in-process. The Perses migration engine lives in an
+// internal package of github.com/perses/perses and relies on CUE scripts shipped with the plugin archives, so this
+// file mirrors its structure (rows, grid layout, variables) and implements the plugin migrations for the panel,
+// query and variable types we encounter in Plutono/Grafana dashboards.
+
+const (
+	grafanaPanelRowType = "row"
+)
+
+var (
+	// Same placeholders as the Perses migration engine uses when a plugin cannot be migrated
+	unsupportedPanelPlugin = common.Plugin{
+		Kind: "Markdown",
+		Spec: map[string]any{
+			"text": "**Migration from Grafana not supported !**",
+		},
+	}
+	unsupportedQueryPlugin = common.Plugin{
+		Kind: "PrometheusTimeSeriesQuery",
+		Spec: map[string]any{
+			"query": "migration_from_grafana_not_supported",
+		},
+	}
+	unsupportedVariablePlugin = common.Plugin{
+		Kind: "StaticListVariable",
+		Spec: map[string]any{
+			"values": []string{"grafana", "migration", "not", "supported"},
+		},
+	}
+
+	grafanaSortMapping = []variable.Sort{
+		variable.SortNone,
+		variable.SortAlphabeticalAsc,
+		variable.SortAlphabeticalDesc,
+		variable.SortNumericalAsc,
+		variable.SortNumericalDesc,
+		variable.SortAlphabeticalCaseInsensitiveAsc,
+		variable.SortAlphabeticalCaseInsensitiveDesc,
+	}
+
+	// Grafana units that have a direct equivalent in the Perses format model
+	grafanaUnitMapping = map[string]string{
+		"percent":     "percent",
+		"percentunit": "percent-decimal",
+		"short":       "decimal",
+		"none":        "decimal",
+		"bytes":       "bytes",
+		"decbytes":    "decbytes",
+		"bits":        "bits",
+		"decbits":     "decbits",
+		"ms":          "milliseconds",
+		"s":           "seconds",
+		"m":           "minutes",
+		"h":           "hours",
+		"d":           "days",
+		"reqps":       "requests/sec",
+		"ops":         "ops/sec",
+		"Bps":         "bytes/sec",
+		"bps":         "bits/sec",
+	}
+
+	labelValuesRegex = regexp.MustCompile(`^\s*label_values\(\s*(?:(.*)\s*,\s*)?([a-zA-Z_][a-zA-Z0-9_]*)\s*\)\s*$`)
+	labelNamesRegex  = regexp.MustCompile(`^\s*label_names\(\s*(.*)\s*\)\s*$`)
+	queryResultRegex = regexp.MustCompile(`^\s*query_result\(\s*(.+)\s*\)\s*$`)
+)
+
+type grafanaGridPos struct {
+	Height int `json:"h"`
+	Width  int `json:"w"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+}
+
+type grafanaPanel struct {
+	Type        string           `json:"type"`
+	Title       string           `json:"title"`
+	Description string           `json:"description"`
+	Collapsed   bool             `json:"collapsed"`
+	Panels      []grafanaPanel   `json:"panels"`
+	GridPos     grafanaGridPos   `json:"gridPos"`
+	Datasource  any              `json:"datasource"`
+	Targets     []map[string]any `json:"targets"`
+	Options     map[string]any   `json:"options"`
+	FieldConfig map[string]any   `json:"fieldConfig"`
+	Content     string           `json:"content"`
+	Links       []map[string]any `json:"links"`
+}
+
+type grafanaTemplateVar struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+	Hide        int    `json:"hide"`
+	Sort        *int   `json:"sort"`
+	IncludeAll  bool   `json:"includeAll"`
+	AllValue    string `json:"allValue"`
+	Multi       bool   `json:"multi"`
+	Regex       string `json:"regex"`
+	Auto        bool   `json:"auto"` // interval variables with an auto option
+	Datasource  any    `json:"datasource"`
+	Query       any    `json:"query"`
+	Definition  string `json:"definition"`
+	Current     struct {
+		Value any `json:"value"`
+	} `json:"current"`
+	Options []struct {
+		Text  any `json:"text"`
+		Value any `json:"value"`
+	} `json:"options"`
+}
+
+type grafanaDashboard struct {
+	UID     string         `json:"uid"`
+	Title   string         `json:"title"`
+	Refresh any            `json:"refresh"`
+	Panels  []grafanaPanel `json:"panels"`
+	Time    struct {
+		From string `json:"from"`
+	} `json:"time"`
+	Templating struct {
+		List []grafanaTemplateVar `json:"list"`
+	} `json:"templating"`
+}
+
+// migrateDashboardNative converts a Grafana dashboard file (latest schema) into a Perses dashboard
+// and returns it as indented JSON, the same shape as `percli migrate -o json` prints.
+func migrateDashboardNative(file string) ([]byte, error) {
+	data, err := readOutputFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dashboard file: %v", err)
+	}
+
+	persesDashboard, err := convertGrafanaDashboard(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(persesDashboard, "", "  ")
+}
+
+func convertGrafanaDashboard(data []byte) (*persesv1.Dashboard, error) {
+	var grafana grafanaDashboard
+	if err := json.Unmarshal(data, &grafana); err != nil {
+		return nil, fmt.Errorf("failed to parse Grafana dashboard JSON: %v", err)
+	}
+	if grafana.UID == "" {
+		return nil, fmt.Errorf("dashboard has no uid, unable to name the Perses dashboard")
+	}
+
+	grafana.Panels = rearrangePanelsWithinExpandedRows(grafana.Panels)
+
+	result := &persesv1.Dashboard{
+		Kind: persesv1.KindDashboard,
+		Metadata: persesv1.ProjectMetadata{
+			Metadata: persesv1.Metadata{
+				Name: grafana.UID,
+			},
+		},
+		Spec: persesv1.DashboardSpec{
+			Display: &common.Display{
+				Name: grafana.Title,
+			},
+			Duration:  convertTimeRange(grafana.Time.From),
+			Panels:    convertPanels(grafana.Panels, grafana.Templating.List),
+			Layouts:   convertGridLayouts(grafana.Panels),
+			Variables: convertVariables(grafana.Templating.List),
+		},
+	}
+
+	if refresh, ok := grafana.Refresh.(string); ok && refresh != "" {
+		if interval, err := common.ParseDuration(refresh); err == nil {
+			result.Spec.RefreshInterval = interval
+		}
+	}
+
+	return result, nil
+}
+
+// rearrangePanelsWithinExpandedRows moves the panels that follow an expanded row into that row,
+// since Grafana stores them as siblings while Perses expects them grouped under the row.
+func rearrangePanelsWithinExpandedRows(panels []grafanaPanel) []grafanaPanel {
+	var result []grafanaPanel
+	var parentRow *grafanaPanel
+	for _, panel := range panels {
+		if panel.Type == grafanaPanelRowType {
+			if parentRow != nil {
+				result = append(result, *parentRow)
+				parentRow = nil
+			}
+			if panel.Collapsed {
+				result = append(result, panel)
+			} else {
+				row := panel
+				parentRow = &row
+			}
+			continue
+		}
+
+		if parentRow != nil {
+			parentRow.Panels = append(parentRow.Panels, panel)
+		} else {
+			result = append(result, panel)
+		}
+	}
+	if parentRow != nil {
+		result = append(result, *parentRow)
+	}
+	return result
+}
+
+func convertTimeRange(from string) common.Duration {
+	// Grafana uses relative ranges such as "now-6h"
+	if strings.HasPrefix(from, "now-") {
+		if duration, err := common.ParseDuration(strings.TrimPrefix(from, "now-")); err == nil {
+			return duration
+		}
+	}
+	return common.Duration(time.Hour)
+}
+
+func convertPanels(panels []grafanaPanel, variables []grafanaTemplateVar) map[string]*persesv1.Panel {
+	result := make(map[string]*persesv1.Panel)
+	for i, panel := range panels {
+		if panel.Type == grafanaPanelRowType {
+			for j, innerPanel := range panel.Panels {
+				result[fmt.Sprintf("%d_%d", i, j)] = convertPanel(innerPanel, variables)
+			}
+		} else {
+			result[fmt.Sprintf("%d", i)] = convertPanel(panel, variables)
+		}
+	}
+	return result
+}
+
+func convertGridLayouts(panels []grafanaPanel) []dashboard.Layout {
+	defaultSpec := &dashboard.GridLayoutSpec{}
+	result := []dashboard.Layout{{
+		Kind: dashboard.KindGridLayout,
+		Spec: defaultSpec,
+	}}
+
+	for i, panel := range panels {
+		if panel.Type != grafanaPanelRowType {
+			defaultSpec.Items = append(defaultSpec.Items, newGridItem(panel.GridPos, fmt.Sprintf("%d", i)))
+			continue
+		}
+
+		spec := &dashboard.GridLayoutSpec{
+			Display: &dashboard.GridLayoutDisplay{
+				Title: panel.Title,
+				Collapse: &dashboard.GridLayoutCollapse{
+					Open: !panel.Collapsed,
+				},
+			},
+		}
+		for j, innerPanel := range panel.Panels {
+			spec.Items = append(spec.Items, newGridItem(innerPanel.GridPos, fmt.Sprintf("%d_%d", i, j)))
+		}
+		if len(spec.Items) > 0 {
+			result = append(result, dashboard.Layout{
+				Kind: dashboard.KindGridLayout,
+				Spec: spec,
+			})
+		}
+	}
+
+	// Drop the default layout if every panel lives in a row
+	if len(defaultSpec.Items) == 0 {
+		result = result[1:]
+	}
+	return result
+}
+
+func newGridItem(pos grafanaGridPos, panelKey string) dashboard.GridItem {
+	return dashboard.GridItem{
+		Width:  pos.Width,
+		Height: pos.Height,
+		X:      pos.X,
+		Y:      pos.Y,
+		Content: &common.JSONRef{
+			Ref:  fmt.Sprintf("#/spec/panels/%s", panelKey),
+			Path: []string{"spec", "panels", panelKey},
+		},
+	}
+}
+
+func convertPanel(panel grafanaPanel, variables []grafanaTemplateVar) *persesv1.Panel {
+	result := &persesv1.Panel{
+		Kind: "Panel",
+		Spec: persesv1.PanelSpec{
+			Display: persesv1.PanelDisplay{
+				Name:        "empty",
+				Description: panel.Description,
+			},
+			Plugin: convertPanelPlugin(panel),
+		},
+	}
+	if panel.Title != "" {
+		result.Spec.Display.Name = panel.Title
+	}
+
+	for _, link := range panel.Links {
+		url, _ := link["url"].(string)
+		if url == "" {
+			continue
+		}
+		title, _ := link["title"].(string)
+		targetBlank, _ := link["targetBlank"].(bool)
+		result.Spec.Links = append(result.Spec.Links, persesv1.Link{
+			Name:        title,
+			URL:         url,
+			TargetBlank: targetBlank,
+		})
+	}
+
+	// Text panels don't carry queries
+	if result.Spec.Plugin.Kind == "Markdown" {
+		return result
+	}
+
+	for _, target := range panel.Targets {
+		result.Spec.Queries = append(result.Spec.Queries, persesv1.Query{
+			Kind: "TimeSeriesQuery",
+			Spec: persesv1.QuerySpec{
+				Plugin: convertQueryPlugin(target, panel.Datasource, variables),
+			},
+		})
+	}
+	return result
+}
+
+func convertPanelPlugin(panel grafanaPanel) common.Plugin {
+	switch panel.Type {
+	case "timeseries", "graph":
+		spec := map[string]any{}
+		if legend := convertLegend(panel.Options); legend != nil {
+			spec["legend"] = legend
+		}
+		if format := convertFormat(panel.FieldConfig); format != nil {
+			spec["yAxis"] = map[string]any{"format": format}
+		}
+		return common.Plugin{Kind: "TimeSeriesChart", Spec: spec}
+	case "stat", "singlestat":
+		spec := map[string]any{"calculation": convertCalculation(panel.Options)}
+		if format := convertFormat(panel.FieldConfig); format != nil {
+			spec["format"] = format
+		}
+		return common.Plugin{Kind: "StatChart", Spec: spec}
+	case "gauge":
+		spec := map[string]any{"calculation": convertCalculation(panel.Options)}
+		if format := convertFormat(panel.FieldConfig); format != nil {
+			spec["format"] = format
+		}
+		return common.Plugin{Kind: "GaugeChart", Spec: spec}
+	case "bargauge":
+		spec := map[string]any{"calculation": convertCalculation(panel.Options)}
+		if format := convertFormat(panel.FieldConfig); format != nil {
+			spec["format"] = format
+		}
+		return common.Plugin{Kind: "BarChart", Spec: spec}
+	case "table", "table-old":
+		return common.Plugin{Kind: "Table", Spec: map[string]any{}}
+	case "text":
+		content := panel.Content
+		if optionContent, ok := panel.Options["content"].(string); ok && optionContent != "" {
+			content = optionContent
+		}
+		return common.Plugin{Kind: "Markdown", Spec: map[string]any{"text": content}}
+	default:
+		return unsupportedPanelPlugin
+	}
+}
+
+func convertLegend(options map[string]any) map[string]any {
+	legend, ok := options["legend"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	if show, ok := legend["showLegend"].(bool); ok && !show {
+		return nil
+	}
+	if mode, _ := legend["displayMode"].(string); mode == "hidden" {
+		return nil
+	}
+
+	result := map[string]any{"position": "bottom", "mode": "list"}
+	if placement, _ := legend["placement"].(string); placement == "right" {
+		result["position"] = "right"
+	}
+	if mode, _ := legend["displayMode"].(string); mode == "table" {
+		result["mode"] = "table"
+	}
+	return result
+}
+
+func convertCalculation(options map[string]any) string {
+	reduceOptions, _ := options["reduceOptions"].(map[string]any)
+	calcs, _ := reduceOptions["calcs"].([]any)
+	if len(calcs) == 0 {
+		return "last-number"
+	}
+	switch calcs[0] {
+	case "mean":
+		return "mean"
+	case "first":
+		return "first"
+	case "firstNotNull":
+		return "first-number"
+	case "last":
+		return "last"
+	case "sum":
+		return "sum"
+	case "min":
+		return "min"
+	case "max":
+		return "max"
+	default:
+		return "last-number"
+	}
+}
+
+func convertFormat(fieldConfig map[string]any) map[string]any {
+	defaults, _ := fieldConfig["defaults"].(map[string]any)
+	unit, _ := defaults["unit"].(string)
+	persesUnit, ok := grafanaUnitMapping[unit]
+	if !ok {
+		return nil
+	}
+
+	format := map[string]any{"unit": persesUnit}
+	if decimals, ok := defaults["decimals"].(float64); ok {
+		format["decimalPlaces"] = int(decimals)
+	}
+	return format
+}
+
+// convertQueryPlugin converts the targets of Prometheus datasources. Other datasources, like Loki whose targets also
+// have an expr, and unknown datasources get the placeholder, so that the analysis reports them.
+func convertQueryPlugin(target map[string]any, panelDatasource any, variables []grafanaTemplateVar) common.Plugin {
+	datasource := target["datasource"]
+	if datasource == nil {
+		datasource = panelDatasource
+	}
+	if datasourceType(datasource, variables) != "prometheus" {
+		return unsupportedQueryPlugin
+	}
+
+	expr, ok := target["expr"].(string)
+	if !ok {
+		return unsupportedQueryPlugin
+	}
+
+	spec := map[string]any{"query": expr}
+	if selector := convertDatasourceSelector(datasource, "prometheus", "PrometheusDatasource"); selector != nil {
+		spec["datasource"] = selector
+	}
+	if legendFormat, ok := target["legendFormat"].(string); ok && legendFormat != "" && legendFormat != "__auto" {
+		spec["seriesNameFormat"] = legendFormat
+	}
+	if interval, ok := target["interval"].(string); ok && interval != "" {
+		spec["minStep"] = interval
+	}
+	return common.Plugin{Kind: "PrometheusTimeSeriesQuery", Spec: spec}
+}
+
+// convertDatasourceSelector maps a Grafana datasource reference to a Perses datasource selector.
+// Variable references such as "${datasource}" are dropped so Perses falls back to the default datasource.
+func convertDatasourceSelector(datasource any, grafanaType, persesKind string) map[string]any {
+	var name string
+	switch ds := datasource.(type) {
+	case string:
+		name = ds
+	case map[string]any:
+		if dsType, ok := ds["type"].(string); ok && dsType != grafanaType {
+			return nil
+		}
+		name, _ = ds["uid"].(string)
+	}
+	if name == "" || strings.HasPrefix(name, "$") || name == "default" {
+		return nil
+	}
+	return map[string]any{"kind": persesKind, "name": name}
+}
+
+// datasourceType returns the Grafana type of a datasource reference: its own type, the type of the datasource
+// variable it uses, or the type of the datasource known from --grafana-url, --datasource-provisioning or a mapping
+// rule. The default datasource is Prometheus unless it is known. An empty type is an unknown datasource.
+func datasourceType(datasource any, variables []grafanaTemplateVar) string {
+	if ds, ok := datasource.(map[string]any); ok {
+		if dsType, _ := ds["type"].(string); dsType != "" {
+			return dsType
+		}
+	}
+
+	reference := datasourceUID(datasource)
+	if reference == "" || reference == "default" {
+		for _, ds := range grafanaDatasources {
+			if ds.Default {
+				return ds.Type
+			}
+		}
+		return "prometheus"
+	}
+	if match := grafanaVariableUsageRegex.FindStringSubmatch(reference); match != nil && match[0] == reference {
+		name := match[1] + match[3] + match[5]
+		for _, v := range variables {
+			if v.Name == name && v.Type == "datasource" {
+				query, _ := v.Query.(string)
+				return query
+			}
+		}
+		return ""
+	}
+	if ds, ok := grafanaDatasources[reference]; ok {
+		return ds.Type
+	}
+	if datasourceMapping != nil {
+		if rule := datasourceMapping.find(grafanaDatasource{UID: reference, Name: reference}); rule != nil {
+			return datasourceKindTypes[rule.Datasource.Kind]
+		}
+	}
+	return ""
+}
+
+// datasourceUID returns the UID of a datasource reference, or the name of the references older than schema 33
+func datasourceUID(datasource any) string {
+	switch ds := datasource.(type) {
+	case string:
+		return ds
+	case map[string]any:
+		uid, _ := ds["uid"].(string)
+		return uid
+	}
+	return ""
+}
+
+func convertVariables(templateVars []grafanaTemplateVar) []dashboard.Variable {
+	var result []dashboard.Variable
+	for _, v := range templateVars {
+		if v.Type == "constant" || v.Type == "textbox" {
+			result = append(result, convertTextVariable(v))
+			continue
+		}
+		result = append(result, convertListVariable(v, templateVars))
+	}
+	return result
+}
+
+func convertTextVariable(v grafanaTemplateVar) dashboard.Variable {
+	value, _ := v.Query.(string)
+	return dashboard.Variable{
+		Kind: variable.KindText,
+		Spec: &dashboard.TextVariableSpec{
+			TextSpec: variable.TextSpec{
+				Display:  convertVariableDisplay(v),
+				Constant: v.Type == "constant",
+				Value:    value,
+			},
+			Name: v.Name,
+		},
+	}
+}
+
+func convertListVariable(v grafanaTemplateVar, variables []grafanaTemplateVar) dashboard.Variable {
+	spec := &dashboard.ListVariableSpec{
+		ListSpec: variable.ListSpec{
+			Display:         convertVariableDisplay(v),
+			AllowAllValue:   v.IncludeAll,
+			AllowMultiple:   v.Multi,
+			DefaultValue:    convertDefaultValue(v.Current.Value),
+			Sort:            convertSort(v.Sort),
+			CapturingRegexp: strings.Trim(v.Regex, "/"),
+		},
+		Name: v.Name,
+	}
+
+	// Only set CustomAllValue if IncludeAll is enabled for the variable
+	if v.IncludeAll {
+		spec.CustomAllValue = v.AllValue
+	}
+
+	plugin, ok := convertVariablePlugin(v, variables)
+	if !ok {
+		plugin = unsupportedVariablePlugin
+		spec.CapturingRegexp = ""
+	}
+	spec.Plugin = plugin
+
+	return dashboard.Variable{
+		Kind: variable.KindList,
+		Spec: spec,
+	}
+}
+
+func convertVariablePlugin(v grafanaTemplateVar, variables []grafanaTemplateVar) (common.Plugin, bool) {
+	switch v.Type {
+	case "custom", "interval":
+		query, _ := v.Query.(string)
+		values := splitCustomValues(query)
+		if len(values) == 0 {
+			for _, option := range v.Options {
+				if value, ok := option.Value.(string); ok {
+					values = append(values, value)
+				}
+			}
+		}
+		if len(values) == 0 {
+			return common.Plugin{}, false
+		}
+		return common.Plugin{Kind: "StaticListVariable", Spec: map[string]any{"values": values}}, true
+	case "datasource":
+		query, _ := v.Query.(string)
+		if query != "prometheus" {
+			return common.Plugin{}, false
+		}
+		return common.Plugin{Kind: "DatasourceVariable", Spec: map[string]any{"datasourcePluginKind": "PrometheusDatasource"}}, true
+	case "query":
+		return convertQueryVariablePlugin(v, variables)
+	default:
+		return common.Plugin{}, false
+	}
+}
+
+func convertQueryVariablePlugin(v grafanaTemplateVar, variables []grafanaTemplateVar) (common.Plugin, bool) {
+	if datasourceType(v.Datasource, variables) != "prometheus" {
+		return common.Plugin{}, false
+	}
+
+	var query string
+	switch q := v.Query.(type) {
+	case string:
+		query = q
+	case map[string]any:
+		query, _ = q["query"].(string)
+	}
+	if query == "" {
+		query = v.Definition
+	}
+
+	spec := map[string]any{}
+	if selector := convertDatasourceSelector(v.Datasource, "prometheus", "PrometheusDatasource"); selector != nil {
+		spec["datasource"] = selector
+	}
+
+	if matches := labelValuesRegex.FindStringSubmatch(query); matches != nil {
+		spec["labelName"] = matches[2]
+		if matcher := strings.TrimSpace(matches[1]); matcher != "" {
+			spec["matchers"] = []string{matcher}
+		}
+		return common.Plugin{Kind: "PrometheusLabelValuesVariable", Spec: spec}, true
+	}
+	if matches := labelNamesRegex.FindStringSubmatch(query); matches != nil {
+		if matcher := strings.TrimSpace(matches[1]); matcher != "" {
+			spec["matchers"] = []string{matcher}
+		}
+		return common.Plugin{Kind: "PrometheusLabelNamesVariable", Spec: spec}, true
+	}
+	if matches := queryResultRegex.FindStringSubmatch(query); matches != nil {
+		spec["expr"] = strings.TrimSpace(matches[1])
+		spec["labelName"] = "__name__"
+		return common.Plugin{Kind: "PrometheusPromQLVariable", Spec: spec}, true
+	}
+	return common.Plugin{}, false
+}
+
+func convertVariableDisplay(v grafanaTemplateVar) *variable.Display {
+	return &variable.Display{
+		Name:        v.Label,
+		Description: v.Description,
+		Hidden:      v.Hide > 0,
+	}
+}
+
+func convertDefaultValue(value any) *variable.DefaultValue {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return &variable.DefaultValue{SingleValue: v}
+	case []any:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		if len(values) == 0 {
+			return nil
+		}
+		return &variable.DefaultValue{SliceValues: values}
+	default:
+		return nil
+	}
+}
+
+func convertSort(sort *int) *variable.Sort {
+	if sort == nil || *sort < 0 || *sort >= len(grafanaSortMapping) {
+		return nil
+	}
+	result := grafanaSortMapping[*sort]
+	return &result
+}
+
+// splitCustomValues splits the comma separated values of custom and interval variables.
+// Grafana allows "key : value" pairs in custom variables, only the value is kept.
+func splitCustomValues(query string) []string {
+	var values []string
+	for _, item := range strings.Split(query, ",") {
+		item = strings.TrimSpace(item)
+		if parts := strings.SplitN(item, " : ", 2); len(parts) == 2 {
+			item = strings.TrimSpace(parts[1])
+		}
+		if item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
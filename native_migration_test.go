@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/perses/perses/pkg/model/api/v1/variable"
+)
+
+// assertJSON compares the JSON encodings of a converted value and of the expected JSON
+func assertJSON(t *testing.T, got any, want string) {
+	t.Helper()
+	if gotValue, wantValue := decodeJSON(t, got), decodeJSON(t, want); !reflect.DeepEqual(gotValue, wantValue) {
+		gotJSON, _ := json.Marshal(gotValue)
+		wantJSON, _ := json.Marshal(wantValue)
+		t.Errorf("got  %s\nwant %s", gotJSON, wantJSON)
+	}
+}
+
+func TestConvertPanelPlugin(t *testing.T) {
+	tests := []struct {
+		name  string
+		panel string
+		want  string
+	}{
+		{
+			name:  "time series with legend and unit",
+			panel: `{"type": "timeseries", "options": {"legend": {"showLegend": true, "displayMode": "table", "placement": "right"}}, "fieldConfig": {"defaults": {"unit": "percentunit", "decimals": 2}}}`,
+			want:  `{"kind": "TimeSeriesChart", "spec": {"legend": {"position": "right", "mode": "table"}, "yAxis": {"format": {"unit": "percent-decimal", "decimalPlaces": 2}}}}`,
+		},
+		{
+			name:  "time series with hidden legend and unknown unit",
+			panel: `{"type": "timeseries", "options": {"legend": {"showLegend": false}}, "fieldConfig": {"defaults": {"unit": "celsius"}}}`,
+			want:  `{"kind": "TimeSeriesChart", "spec": {}}`,
+		},
+		{
+			name:  "stat",
+			panel: `{"type": "stat", "options": {"reduceOptions": {"calcs": ["firstNotNull"]}}, "fieldConfig": {"defaults": {"unit": "bytes"}}}`,
+			want:  `{"kind": "StatChart", "spec": {"calculation": "first-number", "format": {"unit": "bytes"}}}`,
+		},
+		{
+			name:  "gauge without calculation",
+			panel: `{"type": "gauge"}`,
+			want:  `{"kind": "GaugeChart", "spec": {"calculation": "last-number"}}`,
+		},
+		{
+			name:  "bar gauge",
+			panel: `{"type": "bargauge", "options": {"reduceOptions": {"calcs": ["max"]}}}`,
+			want:  `{"kind": "BarChart", "spec": {"calculation": "max"}}`,
+		},
+		{
+			name:  "old table",
+			panel: `{"type": "table-old"}`,
+			want:  `{"kind": "Table", "spec": {}}`,
+		},
+		{
+			name:  "text with options content",
+			panel: `{"type": "text", "content": "old", "options": {"content": "# Title"}}`,
+			want:  `{"kind": "Markdown", "spec": {"text": "# Title"}}`,
+		},
+		{
+			name:  "unsupported",
+			panel: `{"type": "piechart"}`,
+			want:  `{"kind": "Markdown", "spec": {"text": "**Migration from Grafana not supported !**"}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var panel grafanaPanel
+			if err := json.Unmarshal([]byte(test.panel), &panel); err != nil {
+				t.Fatalf("invalid fixture: %v", err)
+			}
+			assertJSON(t, convertPanelPlugin(panel), test.want)
+		})
+	}
+}
+
+func TestConvertQueryPlugin(t *testing.T) {
+	setDatasourceOptions(t, nil, true)
+	grafanaDatasources = indexDatasources([]provisionedDatasource{
+		{UID: "prom-eu", Name: "Prom EU", Type: "prometheus", IsDefault: true},
+		{UID: "loki-eu", Name: "Loki EU", Type: "loki"},
+	})
+	variables := []grafanaTemplateVar{
+		{Name: "ds", Type: "datasource", Query: "prometheus"},
+		{Name: "logs", Type: "datasource", Query: "loki"},
+	}
+	const placeholder = `{"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "migration_from_grafana_not_supported"}}`
+
+	tests := []struct {
+		name            string
+		target          string
+		panelDatasource any
+		want            string
+	}{
+		{
+			name:   "typed prometheus target",
+			target: `{"expr": "up", "legendFormat": "{{job}}", "interval": "1m", "datasource": {"type": "prometheus", "uid": "thanos"}}`,
+			want:   `{"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "up", "seriesNameFormat": "{{job}}", "minStep": "1m", "datasource": {"kind": "PrometheusDatasource", "name": "thanos"}}}`,
+		},
+		{
+			name:            "panel datasource resolved by uid",
+			target:          `{"expr": "up", "legendFormat": "__auto"}`,
+			panelDatasource: map[string]any{"uid": "prom-eu"},
+			want:            `{"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "up", "datasource": {"kind": "PrometheusDatasource", "name": "prom-eu"}}}`,
+		},
+		{
+			name:            "legacy datasource name",
+			target:          `{"expr": "up"}`,
+			panelDatasource: "Prom EU",
+			want:            `{"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "up", "datasource": {"kind": "PrometheusDatasource", "name": "Prom EU"}}}`,
+		},
+		{
+			name:   "default datasource",
+			target: `{"expr": "up"}`,
+			want:   `{"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "up"}}`,
+		},
+		{
+			name:   "prometheus datasource variable",
+			target: `{"expr": "up", "datasource": {"uid": "${ds}"}}`,
+			want:   `{"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "up"}}`,
+		},
+		{
+			name:   "loki datasource variable",
+			target: `{"expr": "{app=\"api\"}", "datasource": {"uid": "$logs"}}`,
+			want:   placeholder,
+		},
+		{
+			name:   "loki target with an expr",
+			target: `{"expr": "{app=\"api\"}", "datasource": {"type": "loki", "uid": "loki-eu"}}`,
+			want:   placeholder,
+		},
+		{
+			name:            "loki resolved by uid",
+			target:          `{"expr": "{app=\"api\"}"}`,
+			panelDatasource: map[string]any{"uid": "loki-eu"},
+			want:            placeholder,
+		},
+		{
+			name:   "unknown datasource",
+			target: `{"expr": "up", "datasource": {"uid": "elsewhere"}}`,
+			want:   placeholder,
+		},
+		{
+			name:   "prometheus target without expr",
+			target: `{"datasource": {"type": "prometheus", "uid": "prom-eu"}}`,
+			want:   placeholder,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var target map[string]any
+			if err := json.Unmarshal([]byte(test.target), &target); err != nil {
+				t.Fatalf("invalid fixture: %v", err)
+			}
+			assertJSON(t, convertQueryPlugin(target, test.panelDatasource, variables), test.want)
+		})
+	}
+}
+
+func TestDatasourceType(t *testing.T) {
+	tests := []struct {
+		name        string
+		datasources []provisionedDatasource
+		mapping     bool
+		datasource  any
+		want        string
+	}{
+		{name: "own type", datasource: map[string]any{"type": "tempo", "uid": "x"}, want: "tempo"},
+		{name: "unknown default", datasource: nil, want: "prometheus"},
+		{
+			name:        "known default",
+			datasources: []provisionedDatasource{{UID: "loki", Type: "loki", IsDefault: true}},
+			datasource:  "default", want: "loki",
+		},
+		{name: "datasource variable", datasource: "${ds}", want: "prometheus"},
+		{name: "unknown variable", datasource: "$other", want: ""},
+		{
+			name:        "known name",
+			datasources: []provisionedDatasource{{UID: "l1", Name: "Logs", Type: "loki"}},
+			datasource:  "Logs", want: "loki",
+		},
+		{name: "mapping rule", mapping: true, datasource: map[string]any{"uid": "prom-eu"}, want: "prometheus"},
+		{name: "unknown", datasource: map[string]any{"uid": "prom-eu"}, want: ""},
+	}
+	variables := []grafanaTemplateVar{{Name: "ds", Type: "datasource", Query: "prometheus"}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mapping *datasourceMapper
+			if test.mapping {
+				mapping = loadTestDatasourceMapping(t)
+			}
+			setDatasourceOptions(t, mapping, true)
+			grafanaDatasources = indexDatasources(test.datasources)
+			if got := datasourceType(test.datasource, variables); got != test.want {
+				t.Errorf("datasourceType(%v) = %q, want %q", test.datasource, got, test.want)
+			}
+		})
+	}
+}
+
+func TestConvertVariables(t *testing.T) {
+	setDatasourceOptions(t, nil, true)
+	const unsupported = `{"kind": "StaticListVariable", "spec": {"values": ["grafana", "migration", "not", "supported"]}}`
+
+	tests := []struct {
+		name     string
+		variable string
+		want     string
+	}{
+		{
+			name:     "constant",
+			variable: `{"name": "env", "type": "constant", "query": "prod", "hide": 2}`,
+			want:     `{"kind": "TextVariable", "spec": {"name": "env", "value": "prod", "constant": true, "display": {"hidden": true}}}`,
+		},
+		{
+			name:     "text box",
+			variable: `{"name": "filter", "type": "textbox", "query": "api", "label": "Filter"}`,
+			want:     `{"kind": "TextVariable", "spec": {"name": "filter", "value": "api", "display": {"name": "Filter", "hidden": false}}}`,
+		},
+		{
+			name: "label values with all value",
+			variable: `{"name": "job", "type": "query", "datasource": {"type": "prometheus", "uid": "prom"}, "query": {"query": "label_values(up{env=\"prod\"}, job)"},
+				"includeAll": true, "allValue": ".+", "multi": true, "sort": 1, "regex": "/api-.*/", "current": {"value": ["$__all"]}}`,
+			want: `{"kind": "ListVariable", "spec": {"name": "job", "display": {"hidden": false}, "allowAllValue": true, "allowMultiple": true,
+				"customAllValue": ".+", "capturingRegexp": "api-.*", "sort": "alphabetical-asc", "defaultValue": ["$__all"],
+				"plugin": {"kind": "PrometheusLabelValuesVariable", "spec": {"labelName": "job", "matchers": ["up{env=\"prod\"}"],
+					"datasource": {"kind": "PrometheusDatasource", "name": "prom"}}}}}`,
+		},
+		{
+			name:     "label names from the definition",
+			variable: `{"name": "label", "type": "query", "query": "", "definition": "label_names(up)", "current": {"value": "job"}}`,
+			want: `{"kind": "ListVariable", "spec": {"name": "label", "display": {"hidden": false}, "allowAllValue": false, "allowMultiple": false,
+				"defaultValue": "job", "plugin": {"kind": "PrometheusLabelNamesVariable", "spec": {"matchers": ["up"]}}}}`,
+		},
+		{
+			name:     "query result",
+			variable: `{"name": "top", "type": "query", "query": "query_result(topk(5, up))"}`,
+			want: `{"kind": "ListVariable", "spec": {"name": "top", "display": {"hidden": false}, "allowAllValue": false, "allowMultiple": false,
+				"plugin": {"kind": "PrometheusPromQLVariable", "spec": {"expr": "topk(5, up)", "labelName": "__name__"}}}}`,
+		},
+		{
+			name:     "custom with key value pairs",
+			variable: `{"name": "size", "type": "custom", "query": "small : 1, large : 10,", "sort": 7}`,
+			want: `{"kind": "ListVariable", "spec": {"name": "size", "display": {"hidden": false}, "allowAllValue": false, "allowMultiple": false,
+				"plugin": {"kind": "StaticListVariable", "spec": {"values": ["1", "10"]}}}}`,
+		},
+		{
+			name:     "interval from the options",
+			variable: `{"name": "step", "type": "interval", "options": [{"text": "1m", "value": "1m"}, {"text": "5m", "value": "5m"}]}`,
+			want: `{"kind": "ListVariable", "spec": {"name": "step", "display": {"hidden": false}, "allowAllValue": false, "allowMultiple": false,
+				"plugin": {"kind": "StaticListVariable", "spec": {"values": ["1m", "5m"]}}}}`,
+		},
+		{
+			name:     "prometheus datasource",
+			variable: `{"name": "ds", "type": "datasource", "query": "prometheus"}`,
+			want: `{"kind": "ListVariable", "spec": {"name": "ds", "display": {"hidden": false}, "allowAllValue": false, "allowMultiple": false,
+				"plugin": {"kind": "DatasourceVariable", "spec": {"datasourcePluginKind": "PrometheusDatasource"}}}}`,
+		},
+		{
+			name:     "loki query",
+			variable: `{"name": "app", "type": "query", "datasource": {"type": "loki", "uid": "loki"}, "query": "label_values(app)", "regex": "/.*/"}`,
+			want: `{"kind": "ListVariable", "spec": {"name": "app", "display": {"hidden": false}, "allowAllValue": false, "allowMultiple": false,
+				"plugin": ` + unsupported + `}}`,
+		},
+		{
+			name:     "unsupported query",
+			variable: `{"name": "metric", "type": "query", "query": "metrics(node_)"}`,
+			want: `{"kind": "ListVariable", "spec": {"name": "metric", "display": {"hidden": false}, "allowAllValue": false, "allowMultiple": false,
+				"plugin": ` + unsupported + `}}`,
+		},
+		{
+			name:     "ad hoc filter",
+			variable: `{"name": "filters", "type": "adhoc"}`,
+			want: `{"kind": "ListVariable", "spec": {"name": "filters", "display": {"hidden": false}, "allowAllValue": false, "allowMultiple": false,
+				"plugin": ` + unsupported + `}}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var templateVar grafanaTemplateVar
+			if err := json.Unmarshal([]byte(test.variable), &templateVar); err != nil {
+				t.Fatalf("invalid fixture: %v", err)
+			}
+			variables := convertVariables([]grafanaTemplateVar{templateVar})
+			if len(variables) != 1 {
+				t.Fatalf("got %d variables, want 1", len(variables))
+			}
+			assertJSON(t, variables[0], test.want)
+		})
+	}
+}
+
+func TestConvertSortReturnsACopy(t *testing.T) {
+	sort := 1
+	converted := convertSort(&sort)
+	*converted = variable.SortNone
+	if grafanaSortMapping[1] != variable.SortAlphabeticalAsc {
+		t.Errorf("changing a converted sort changed the mapping to %s", grafanaSortMapping[1])
+	}
+}
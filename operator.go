@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// For Perses instances managed by the perses-operator, the migrated dashboards are also written as PersesDashboard
+// custom resources to <output-dir>/perses-operator, mirroring the perses directory with a kustomization.yaml per
+// directory, so the tree can be applied with kubectl apply -k.
+
+const (
+	operatorDirName       = "perses-operator"
+	operatorAPIVersion    = "perses.dev/v1alpha1"
+	operatorDashboardKind = "PersesDashboard"
+	kustomizationFileName = "kustomization.yaml"
+)
+
+// Parsed from --operator-labels and --operator-instance-selector
+var (
+	operatorLabels           map[string]string
+	operatorInstanceSelector map[string]string
+)
+
+type persesDashboardResource struct {
+	APIVersion string           `yaml:"apiVersion"`
+	Kind       string           `yaml:"kind"`
+	Metadata   operatorMetadata `yaml:"metadata"`
+	// The v1alpha1 spec is the Perses dashboard spec with the instance selector next to it
+	Spec map[string]any `yaml:"spec"`
+}
+
+type operatorMetadata struct {
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+type kustomization struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Kind       string   `yaml:"kind"`
+	Resources  []string `yaml:"resources"`
+}
+
+// parseLabels parses a comma separated list of key=value labels
+func parseLabels(flagName, value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, item := range splitList(value) {
+		key, labelValue, ok := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid label %q in --%s, expected <key>=<value>", item, flagName)
+		}
+		labels[key] = strings.TrimSpace(labelValue)
+	}
+	return labels, nil
+}
+
+// writeOperatorManifests writes a PersesDashboard resource for every migrated dashboard and returns how many were
+// written. The namespace is --operator-namespace, otherwise the project of the dashboard.
+func writeOperatorManifests(dashboards []dashboardReport, outputDir string) (int, error) {
+	if err := os.RemoveAll(outputDir); err != nil {
+		return 0, fmt.Errorf("failed to clean operator output directory: %v", err)
+	}
+
+	// Resources of every directory, to write the kustomization files
+	resources := map[string][]string{".": nil}
+	names := make(map[string]string)
+	written := 0
+	for _, dashboard := range dashboards {
+		if dashboard.PersesFile == "" {
+			continue
+		}
+
+		resource, err := newPersesDashboardResource(dashboard)
+		if err != nil {
+			log.Printf("Warning: Failed to convert %s to a PersesDashboard: %v", dashboard.PersesFile, err)
+			continue
+		}
+
+		// Different Perses names can give the same Kubernetes name, which is resolved like colliding output filenames
+		key := filepath.Join(resource.Metadata.Namespace, resource.Metadata.Name)
+		if previous, ok := names[key]; ok {
+			data := namingData{UID: dashboard.OriginalUID, Folder: resource.Metadata.Namespace}
+			resource.Metadata.Name = resolveCollision(names, data, resource.Metadata.Name)
+			log.Printf("Warning: PersesDashboard %s of %s collides with %s, using %s", key, dashboard.PersesFile, previous, resource.Metadata.Name)
+			key = filepath.Join(resource.Metadata.Namespace, resource.Metadata.Name)
+		}
+		names[key] = dashboard.PersesFile
+
+		data, err := marshalYAML(resource)
+		if err != nil {
+			return written, fmt.Errorf("failed to marshal PersesDashboard %s: %v", resource.Metadata.Name, err)
+		}
+
+		// PersesFile is relative to the output directory, below the perses directory
+		relPath := strings.TrimPrefix(dashboard.PersesFile, "perses/")
+		relPath = strings.TrimSuffix(relPath, filepath.Ext(relPath)) + ".yaml"
+		file := filepath.Join(outputDir, filepath.FromSlash(relPath))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return written, fmt.Errorf("failed to create operator output directory: %v", err)
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			return written, fmt.Errorf("failed to write PersesDashboard %s: %v", file, err)
+		}
+		written++
+
+		// Register the file in its directory and every parent directory in the one above it
+		dir, name := filepath.Split(filepath.FromSlash(relPath))
+		dir = filepath.Clean(dir)
+		resources[dir] = append(resources[dir], name)
+		for ; dir != "."; dir = filepath.Dir(dir) {
+			parent := filepath.Dir(dir)
+			if !containsString(resources[parent], filepath.Base(dir)) {
+				resources[parent] = append(resources[parent], filepath.Base(dir))
+			}
+		}
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return written, fmt.Errorf("failed to create operator output directory: %v", err)
+	}
+	for dir, entries := range resources {
+		sort.Strings(entries)
+		data, err := marshalYAML(kustomization{
+			APIVersion: "kustomize.config.k8s.io/v1beta1",
+			Kind:       "Kustomization",
+			Resources:  entries,
+		})
+		if err != nil {
+			return written, err
+		}
+		if err := os.WriteFile(filepath.Join(outputDir, dir, kustomizationFileName), data, 0644); err != nil {
+			return written, fmt.Errorf("failed to write kustomization: %v", err)
+		}
+	}
+	return written, nil
+}
+
+// newPersesDashboardResource wraps a migrated dashboard file into a PersesDashboard resource
+func newPersesDashboardResource(dashboard dashboardReport) (*persesDashboardResource, error) {
+	data, err := readOutputFile(filepath.Join(*outputDir, filepath.FromSlash(dashboard.PersesFile)))
+	if err != nil {
+		return nil, err
+	}
+	var persesDashboard persesv1.Dashboard
+	if err := json.Unmarshal(data, &persesDashboard); err != nil {
+		return nil, err
+	}
+
+	// Go through JSON so that the spec keeps the field names of the Perses API
+	specData, err := json.Marshal(persesDashboard.Spec)
+	if err != nil {
+		return nil, err
+	}
+	var spec map[string]any
+	if err := json.Unmarshal(specData, &spec); err != nil {
+		return nil, err
+	}
+	if len(operatorInstanceSelector) > 0 {
+		spec["instanceSelector"] = map[string]any{"matchLabels": operatorInstanceSelector}
+	}
+
+	namespace := *operatorNamespace
+	if namespace == "" {
+		namespace = persesDashboard.Metadata.Project
+	}
+
+	return &persesDashboardResource{
+		APIVersion: operatorAPIVersion,
+		Kind:       operatorDashboardKind,
+		Metadata: operatorMetadata{
+			// Kubernetes names are lowercase DNS labels, Perses names are not
+			Name:      sanitizeFilenameForRegex(persesDashboard.Metadata.Name),
+			Namespace: namespace,
+			Labels:    operatorLabels,
+		},
+		Spec: spec,
+	}, nil
+}
+
+// marshalYAML marshals with the two space indentation of Kubernetes manifests
+func marshalYAML(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
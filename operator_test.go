@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: map[string]string{}},
+		{value: "team=infra, app.kubernetes.io/part-of = perses", want: map[string]string{"team": "infra", "app.kubernetes.io/part-of": "perses"}},
+		{value: "empty=", want: map[string]string{"empty": ""}},
+		{value: "team", wantErr: true},
+		{value: "=infra", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			labels, err := parseLabels("operator-labels", test.value)
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "--operator-labels") {
+					t.Errorf("error = %v, want an invalid label error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if !reflect.DeepEqual(labels, test.want) {
+				t.Errorf("labels = %v, want %v", labels, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteOperatorManifests(t *testing.T) {
+	previousOutputDir, previousNamespace := *outputDir, *operatorNamespace
+	previousLabels, previousSelector := operatorLabels, operatorInstanceSelector
+	defer func() {
+		*outputDir, *operatorNamespace = previousOutputDir, previousNamespace
+		operatorLabels, operatorInstanceSelector = previousLabels, previousSelector
+	}()
+	*outputDir, *operatorNamespace = t.TempDir(), ""
+	operatorLabels = map[string]string{"team": "infra"}
+	operatorInstanceSelector = map[string]string{"app": "perses"}
+
+	dashboards := []struct {
+		file, name, project, uid string
+	}{
+		{file: "team-a/cpu.json", name: "CPU_Usage", project: "team-a"},
+		// Same Kubernetes name in the same namespace, resolved with the UID, then with a counter
+		{file: "team-a/nodes/cpu-usage.json", name: "cpu-usage", project: "team-a", uid: "Abc"},
+		{file: "team-a/nodes/other.json", name: "cpu.usage", project: "team-a"},
+		// Same name in another namespace
+		{file: "team-b/cpu.json", name: "cpu-usage", project: "team-b"},
+	}
+	var reports []dashboardReport
+	for _, dashboard := range dashboards {
+		persesFile := "perses/" + dashboard.file
+		content := `{"kind": "Dashboard", "metadata": {"name": "` + dashboard.name + `", "project": "` + dashboard.project + `"},
+			"spec": {"display": {"name": "CPU"}, "duration": "1h", "panels": {}, "layouts": []}}`
+		path := filepath.Join(*outputDir, filepath.FromSlash(persesFile))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		reports = append(reports, dashboardReport{InputPath: dashboard.file, OriginalUID: dashboard.uid, PersesFile: persesFile})
+	}
+	reports = append(reports, dashboardReport{InputPath: "team-a/failed.json", Status: statusFailed})
+
+	operatorDir := filepath.Join(*outputDir, operatorDirName)
+	stale := filepath.Join(operatorDir, "removed", "old.yaml")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := writeOperatorManifests(reports, operatorDir)
+	if err != nil {
+		t.Fatalf("writing the manifests failed: %v", err)
+	}
+	if written != len(dashboards) {
+		t.Errorf("wrote %d manifests, want %d", written, len(dashboards))
+	}
+
+	readYAML := func(t *testing.T, file string, v any) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(operatorDir, filepath.FromSlash(file)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := yaml.Unmarshal(data, v); err != nil {
+			t.Fatalf("invalid YAML in %s: %v", file, err)
+		}
+	}
+
+	wantNames := map[string]string{
+		"team-a/cpu.yaml":             "team-a/cpu-usage",
+		"team-a/nodes/cpu-usage.yaml": "team-a/cpu-usage-abc",
+		"team-a/nodes/other.yaml":     "team-a/cpu-usage-2",
+		"team-b/cpu.yaml":             "team-b/cpu-usage",
+	}
+	for file, want := range wantNames {
+		var resource persesDashboardResource
+		readYAML(t, file, &resource)
+		if got := resource.Metadata.Namespace + "/" + resource.Metadata.Name; got != want {
+			t.Errorf("%s is named %s, want %s", file, got, want)
+		}
+		if resource.APIVersion != operatorAPIVersion || resource.Kind != operatorDashboardKind {
+			t.Errorf("%s is a %s %s", file, resource.APIVersion, resource.Kind)
+		}
+		if !reflect.DeepEqual(resource.Metadata.Labels, operatorLabels) {
+			t.Errorf("%s has the labels %v, want %v", file, resource.Metadata.Labels, operatorLabels)
+		}
+		if selector := lookup(resource.Spec, "instanceSelector", "matchLabels", "app"); selector != "perses" {
+			t.Errorf("%s has the instance selector %v, want app=perses", file, selector)
+		}
+		if duration := resource.Spec["duration"]; duration != "1h" {
+			t.Errorf("%s has the duration %v, want the dashboard spec", file, duration)
+		}
+	}
+
+	wantResources := map[string][]string{
+		".":            {"team-a", "team-b"},
+		"team-a":       {"cpu.yaml", "nodes"},
+		"team-a/nodes": {"cpu-usage.yaml", "other.yaml"},
+		"team-b":       {"cpu.yaml"},
+	}
+	for dir, want := range wantResources {
+		var kustomize kustomization
+		readYAML(t, dir+"/"+kustomizationFileName, &kustomize)
+		if kustomize.APIVersion != "kustomize.config.k8s.io/v1beta1" || kustomize.Kind != "Kustomization" {
+			t.Errorf("%s/%s is a %s %s", dir, kustomizationFileName, kustomize.APIVersion, kustomize.Kind)
+		}
+		if !reflect.DeepEqual(kustomize.Resources, want) {
+			t.Errorf("%s/%s lists %q, want %q", dir, kustomizationFileName, kustomize.Resources, want)
+		}
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("manifest of an earlier run was not removed: %v", err)
+	}
+
+	// With --operator-namespace, every resource is in that namespace and the names collide across projects
+	*operatorNamespace = "monitoring"
+	if _, err := writeOperatorManifests(reports, operatorDir); err != nil {
+		t.Fatalf("writing the manifests failed: %v", err)
+	}
+	var resource persesDashboardResource
+	readYAML(t, "team-b/cpu.yaml", &resource)
+	if got := resource.Metadata.Namespace + "/" + resource.Metadata.Name; got != "monitoring/cpu-usage-3" {
+		t.Errorf("team-b/cpu.yaml is named %s, want monitoring/cpu-usage-3", got)
+	}
+}
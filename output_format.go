@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The exported Grafana dashboards and the Perses resources are written as JSON or, with --output-format=yaml, as
+// YAML. YAML is converted from the JSON encoding, so it has the same field names and the same key order: the field
+// order of the Perses types and sorted map keys, which keeps the files stable between runs.
+
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+)
+
+func validateOutputFormat() error {
+	if *outputFormat != formatJSON && *outputFormat != formatYAML {
+		return fmt.Errorf("invalid output format %q. Use --output-format=%s or --output-format=%s", *outputFormat, formatJSON, formatYAML)
+	}
+	return nil
+}
+
+// outputExtension returns the file extension of the --output-format
+func outputExtension() string {
+	return "." + *outputFormat
+}
+
+// encodeOutput converts indented JSON to the --output-format
+func encodeOutput(jsonData []byte) ([]byte, error) {
+	if *outputFormat == formatJSON {
+		return jsonData, nil
+	}
+
+	// JSON is valid YAML, decoding it into a node keeps the key order
+	var node yaml.Node
+	if err := yaml.Unmarshal(jsonData, &node); err != nil {
+		return nil, fmt.Errorf("failed to convert to YAML: %v", err)
+	}
+	resetYAMLStyle(&node)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&node); err != nil {
+		return nil, fmt.Errorf("failed to convert to YAML: %v", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to convert to YAML: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// yaml11Scalar matches the strings YAML 1.1 parsers, such as the one of kubectl, read as booleans or base 60
+// numbers. YAML 1.2 reads them as strings, so the encoder doesn't quote them.
+var yaml11Scalar = regexp.MustCompile(`^(?:[yY]|[yY]es|YES|[nN]|[nN]o|NO|[oO]n|ON|[oO]ff|OFF|[tT]rue|TRUE|[fF]alse|FALSE|[-+]?[0-9][0-9_]*(?::[0-5]?[0-9])+(?:\.[0-9_]*)?)$`)
+
+// resetYAMLStyle switches the flow style and quoted strings of decoded JSON to the block style, with multi-line
+// strings such as queries as literal blocks. Strings that would read as another type stay quoted, in YAML 1.2 and
+// in YAML 1.1.
+func resetYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" {
+		if strings.Contains(node.Value, "\n") {
+			node.Style = yaml.LiteralStyle
+		} else if yaml11Scalar.MatchString(node.Value) {
+			node.Style = yaml.DoubleQuotedStyle
+		}
+	}
+	for _, child := range node.Content {
+		resetYAMLStyle(child)
+	}
+}
+
+// readOutputFile reads a file written in either output format and returns it as JSON
+func readOutputFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isYAMLFile(path) {
+		return data, nil
+	}
+
+	var value any
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return json.MarshalIndent(value, "", "  ")
+}
+
+func isYAMLFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
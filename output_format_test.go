@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeOutput(t *testing.T) {
+	previousFormat := *outputFormat
+	defer func() { *outputFormat = previousFormat }()
+	*outputFormat = formatYAML
+
+	values := map[string]any{
+		"bool": true, "number": 1.5, "null": nil, "list": []any{"a", 2.0},
+		"query": "sum(rate(up[5m]))\n  by (job)",
+	}
+	// Strings that YAML 1.2 or YAML 1.1 would read as another type
+	quoted := []string{
+		"y", "Y", "yes", "Yes", "YES", "n", "N", "no", "No", "NO",
+		"on", "On", "ON", "off", "Off", "OFF", "true", "True", "TRUE", "false", "False", "FALSE",
+		"10:30", "1:20:05.5", "null", "~", "12", "0x1F", "1e3", ".inf",
+	}
+	for i, value := range quoted {
+		values[fmt.Sprintf("quoted%d", i)] = value
+	}
+	plain := []string{"yesterday", "none", "1h", "$job", "10:30 UTC"}
+	for i, value := range plain {
+		values[fmt.Sprintf("plain%d", i)] = value
+	}
+	jsonData, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yamlData, err := encodeOutput(jsonData)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	lines := make(map[string]string)
+	for _, line := range strings.Split(string(yamlData), "\n") {
+		if key, value, ok := strings.Cut(line, ": "); ok {
+			lines[key] = value
+		}
+	}
+	for i, value := range quoted {
+		if got := lines[fmt.Sprintf("quoted%d", i)]; got != `"`+value+`"` && got != `'`+value+`'` {
+			t.Errorf("%q is written as %s, want it quoted", value, got)
+		}
+	}
+	for i, value := range plain {
+		if got := lines[fmt.Sprintf("plain%d", i)]; got != value {
+			t.Errorf("%q is written as %s, want it plain", value, got)
+		}
+	}
+	if got := lines["query"]; got != "|-" {
+		t.Errorf("multi-line query is written as %s, want a literal block", got)
+	}
+
+	// Reading the YAML back gives the same values
+	path := filepath.Join(t.TempDir(), "dashboard.yaml")
+	if err := os.WriteFile(path, yamlData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip, err := readOutputFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(roundTrip, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, values) {
+		t.Errorf("round trip = %v\nwant %v", decoded, values)
+	}
+
+	*outputFormat = formatJSON
+	if data, err := encodeOutput(jsonData); err != nil || string(data) != string(jsonData) {
+		t.Errorf("JSON output = %s, %v, want the JSON unchanged", data, err)
+	}
+}
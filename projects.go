@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+)
+
+// The Perses project of a dashboard is derived from the subdirectory of its input file (the Grafana folder with
+// --grafana-url). It is set on the migrated dashboards with --project-from-folder, used for publishing, and the
+// Project resources can be written to <output-dir>/perses-projects so the output tree can be applied as-is.
+
+const projectsDirName = "perses-projects"
+
+// projectRules are parsed from --project-mapping
+var projectRules []projectRule
+
+// projectRule maps the input subdirectories matching a glob pattern to a Perses project
+type projectRule struct {
+	pattern string
+	project string
+}
+
+// parseProjectMapping parses --project-mapping rules of the form "pattern=project,pattern=project"
+func parseProjectMapping(value string) ([]projectRule, error) {
+	var rules []projectRule
+	for _, item := range splitList(value) {
+		pattern, project, ok := strings.Cut(item, "=")
+		pattern = strings.Trim(strings.TrimSpace(pattern), "/")
+		project = strings.TrimSpace(project)
+		if !ok || pattern == "" || project == "" {
+			return nil, fmt.Errorf("invalid project mapping rule %q, expected <directory pattern>=<project>", item)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid directory pattern %q: %v", pattern, err)
+		}
+		if !validateFilenameRegex(project) {
+			return nil, fmt.Errorf("invalid project name %q, it must match ^[a-z0-9]([-a-z0-9]*[a-z0-9])?$", project)
+		}
+		rules = append(rules, projectRule{pattern: pattern, project: project})
+	}
+	return rules, nil
+}
+
+// projectFor returns the project of a dashboard from its relative input path. The first rule matching the
+// directory or one of its parents wins; without a match, the top-level directory name is used.
+func projectFor(relativePath string) string {
+	dir := filepath.ToSlash(filepath.Dir(relativePath))
+	if dir == "." {
+		return *defaultProject
+	}
+
+	for _, rule := range projectRules {
+		for candidate := dir; candidate != "."; candidate = path.Dir(candidate) {
+			if matched, _ := path.Match(rule.pattern, candidate); matched {
+				return rule.project
+			}
+		}
+	}
+	return sanitizeFilenameForRegex(strings.Split(dir, "/")[0])
+}
+
+// writeProjectResources writes a Project resource for every project of the migrated dashboards and returns the
+// project names
+func writeProjectResources(dashboards []dashboardReport, outputDir string) ([]string, error) {
+	seen := make(map[string]bool)
+	var projects []string
+	for _, dashboard := range dashboards {
+		if dashboard.Project == "" || dashboard.PersesFile == "" || seen[dashboard.Project] {
+			continue
+		}
+		seen[dashboard.Project] = true
+		projects = append(projects, dashboard.Project)
+	}
+	sort.Strings(projects)
+
+	if err := os.RemoveAll(outputDir); err != nil {
+		return nil, fmt.Errorf("failed to clean projects output directory: %v", err)
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create projects output directory: %v", err)
+	}
+
+	for _, project := range projects {
+		resource := persesv1.Project{
+			Kind:     persesv1.KindProject,
+			Metadata: persesv1.Metadata{Name: project},
+		}
+		data, err := json.MarshalIndent(resource, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal project %s: %v", project, err)
+		}
+		if data, err = encodeOutput(data); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(outputDir, project+outputExtension()), data, 0644); err != nil {
+			return nil, fmt.Errorf("failed to write project %s: %v", project, err)
+		}
+	}
+	return projects, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// The PromQL of every migrated query and variable is parsed offline with the Prometheus parser to find the queries
+// that would fail in Perses: syntax errors, unknown functions and wrong numbers or types of arguments. Variables are
+// replaced by placeholders first: a duration in ranges and offsets, a label name in matchers and label lists, a part
+// of the name when glued to one, like node_${mode}_total, and a number or else a selector elsewhere. Label values are
+// strings, so the variables in them are never a problem.
+
+func init() {
+	// Prometheus 3 functions like double_exponential_smoothing and limitk are experimental, dashboards may use them
+	parser.EnableExperimentalFunctions = true
+}
+
+// promqlError is a query that doesn't parse
+type promqlError struct {
+	Location string `json:"location"`
+	Query    string `json:"query"`
+	Error    string `json:"error"`
+}
+
+// checkPromQL parses the PromQL of the Prometheus plugins of a migrated dashboard and returns the queries that
+// don't parse
+func checkPromQL(jsonData []byte) ([]promqlError, error) {
+	var persesDashboard persesv1.Dashboard
+	if err := json.Unmarshal(jsonData, &persesDashboard); err != nil {
+		return nil, fmt.Errorf("failed to parse Perses dashboard: %v", err)
+	}
+
+	var errs []promqlError
+	walkPromQL(&persesDashboard, func(location, field, text string) string {
+		if field == "labelName" || strings.TrimSpace(text) == "" {
+			return text
+		}
+		if err := parsePromQL(text); err != nil {
+			errs = append(errs, promqlError{Location: location, Query: text, Error: err.Error()})
+		}
+		return text
+	})
+	return errs, nil
+}
+
+// parsePromQL returns the first syntax error of an expression. The variables standing for an expression are tried as
+// a number, then as a selector, and the error of the placeholder that parsed further is returned.
+func parsePromQL(expr string) error {
+	substituted, ambiguous := substitutePromQLVariables(expr, "1")
+	_, err := parser.ParseExpr(substituted)
+	if err == nil || !ambiguous {
+		return promqlParseError(err)
+	}
+
+	substituted, _ = substitutePromQLVariables(expr, "x")
+	_, selectorErr := parser.ParseExpr(substituted)
+	if selectorErr == nil {
+		return nil
+	}
+	if parseErrorPosition(selectorErr) > parseErrorPosition(err) {
+		err = selectorErr
+	}
+	return promqlParseError(err)
+}
+
+// promqlParseError drops the position of a parse error, which is a position in the expression with placeholders
+func promqlParseError(err error) error {
+	var parseErrs parser.ParseErrors
+	if errors.As(err, &parseErrs) && len(parseErrs) > 0 {
+		return fmt.Errorf("parse error: %v", parseErrs[0].Err)
+	}
+	return err
+}
+
+func parseErrorPosition(err error) int {
+	var parseErrs parser.ParseErrors
+	if errors.As(err, &parseErrs) && len(parseErrs) > 0 {
+		return int(parseErrs[0].PositionRange.Start)
+	}
+	return -1
+}
+
+// substitutePromQLVariables replaces the variables of an expression by placeholders, with the given placeholder for
+// the variables standing for an expression. It reports whether there were any.
+func substitutePromQLVariables(expr, placeholder string) (string, bool) {
+	tokens := tokenizePromQL(expr)
+	var result strings.Builder
+	last, ambiguous := 0, false
+	labelLists := []bool{false} // open parentheses, braces and brackets, true for matchers and label lists
+	pendingGrouping := false
+
+	for i, token := range tokens {
+		switch token.kind {
+		case tokenOperator:
+			switch token.text {
+			case "(":
+				labelLists = append(labelLists, pendingGrouping)
+			case "{":
+				labelLists = append(labelLists, true)
+			case "[":
+				labelLists = append(labelLists, false)
+			case ")", "}", "]":
+				if len(labelLists) > 1 {
+					labelLists = labelLists[:len(labelLists)-1]
+				}
+			}
+			pendingGrouping = false
+			continue
+		case tokenIdentifier:
+			pendingGrouping = promqlGroupingKeywords[strings.ToLower(token.text)]
+			continue
+		case tokenVariable:
+		default:
+			pendingGrouping = false
+			continue
+		}
+
+		previous, next := "", ""
+		if i > 0 {
+			previous = strings.ToLower(tokens[i-1].text)
+		}
+		if i+1 < len(tokens) {
+			next = tokens[i+1].text
+		}
+		gluedBefore := i > 0 && tokens[i-1].end == token.start && tokens[i-1].kind != tokenOperator
+		gluedAfter := i+1 < len(tokens) && tokens[i+1].start == token.end && tokens[i+1].kind != tokenOperator
+
+		var value string
+		switch {
+		case previous == "[" || previous == ":" || previous == "offset" ||
+			(previous == "-" || previous == "+") && i > 1 && strings.ToLower(tokens[i-2].text) == "offset":
+			// A unit glued after the variable, like ${interval}m, completes the duration
+			value = "5m"
+			if gluedAfter && tokens[i+1].kind == tokenIdentifier {
+				value = "5"
+			}
+		case gluedBefore || gluedAfter || labelLists[len(labelLists)-1] || promqlMatchOperators[next]:
+			value = "x"
+		default:
+			value = placeholder
+			ambiguous = true
+		}
+		result.WriteString(expr[last:token.start])
+		result.WriteString(value)
+		last = token.end
+	}
+	result.WriteString(expr[last:])
+	return result.String(), ambiguous
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePromQL(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		wantErr string
+	}{
+		{name: "selector", expr: `rate(http_requests_total{job="api", code=~"5.."}[5m])`},
+		{name: "aggregation", expr: `sum by (job) (rate(up[5m])) / on(job) group_left(team) max(team_info)`},
+		{name: "subquery and modifiers", expr: `max_over_time(rate(up[5m])[1h:1m] offset -1d @ end())`},
+		{name: "experimental function", expr: `limitk(5, double_exponential_smoothing(up[10m], 0.5, 0.5))`},
+		{name: "range variable", expr: `rate(up[$__rate_interval])`},
+		{name: "subquery variables", expr: `max_over_time(up[${__range}:$step])`},
+		{name: "offset variable", expr: `up offset $shift`},
+		{name: "duration with a variable number", expr: `rate(up[${minutes}m])`},
+		{name: "label value variable", expr: `up{job=~"$job", instance="[[instance]]"}`},
+		{name: "label name variable", expr: `up{$label="a"}`},
+		{name: "grouping variable", expr: `sum by ($group, job) (up) > $threshold`},
+		{name: "scalar variable", expr: `topk($n, up) * $factor`},
+		{name: "selector variable", expr: `rate(${metric}[5m]) / $metric{job="api"}`},
+		{name: "glued variable", expr: `node_${mode}_seconds_total{mode="idle"} + ${prefix}_up`},
+		{name: "unclosed parenthesis", expr: `rate(up[5m]`, wantErr: "parse error: unclosed left parenthesis"},
+		{name: "unknown function", expr: `irate_over_time(up[5m])`, wantErr: `parse error: unknown function with name "irate_over_time"`},
+		{name: "wrong number of arguments", expr: `histogram_quantile(up)`, wantErr: "parse error: expected 2 argument(s) in call to \"histogram_quantile\", got 1"},
+		{name: "range of an expression", expr: `rate(sum(up)[5m])`, wantErr: "parse error: ranges only allowed for vector selectors"},
+		{name: "bad duration", expr: `rate(up[5x])`, wantErr: "parse error: bad number or duration syntax"},
+		{name: "error after a variable", expr: `sum by ($group) (up) +`, wantErr: "parse error: unexpected end of input"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := parsePromQL(test.expr)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("parsePromQL(%q) = %v, want no error", test.expr, err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+				t.Errorf("parsePromQL(%q) = %v, want %q", test.expr, err, test.wantErr)
+			}
+		})
+	}
+}
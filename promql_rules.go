@@ -0,0 +1,566 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+	"github.com/perses/perses/pkg/model/api/v1/common"
+	"github.com/perses/perses/pkg/model/api/v1/dashboard"
+	"gopkg.in/yaml.v3"
+)
+
+// A PromQL rules file rewrites the PromQL of the migrated Prometheus queries and variables, for metrics and labels
+// renamed since the dashboards were written and for Grafana macros Perses doesn't know. Metric and label rules
+// match the tokens of the expression: a metric rule renames metric names and __name__ matchers, a label rule
+// renames label matchers, grouping labels and the label arguments of functions like label_replace. Macro rules
+// substitute $name, ${name} and [[name]]. Expr rules are regular expressions applied to the whole expression. The
+// first rule of a type matching a token applies.
+//
+//	rules:
+//	  - metric: {from: node_cpu, to: node_cpu_seconds_total}
+//	  - metric: {regex: "plutono_(.+)", to: "perses_$1"}
+//	  - label: {from: instance_name, to: instance}
+//	  - macro: {from: __auto_interval_interval, to: 5m}
+//	  - expr: {regex: 'irate\((.+)\[1m\]\)', to: 'rate($1[$$__rate_interval])'}
+
+// promqlRules is loaded from --promql-rules; nil when no rules file is given
+var promqlRules *promqlRewriter
+
+const (
+	promqlRuleMetric = "metric"
+	promqlRuleLabel  = "label"
+	promqlRuleMacro  = "macro"
+	promqlRuleExpr   = "expr"
+)
+
+type promqlRulesConfig struct {
+	Rules []promqlRule `yaml:"rules"`
+}
+
+type promqlRule struct {
+	Metric *promqlRuleMatch `yaml:"metric"`
+	Label  *promqlRuleMatch `yaml:"label"`
+	Macro  *promqlRuleMatch `yaml:"macro"`
+	Expr   *promqlRuleMatch `yaml:"expr"`
+
+	kind  string
+	match *promqlRuleMatch
+	regex *regexp.Regexp
+}
+
+type promqlRuleMatch struct {
+	From  string `yaml:"from"`
+	Regex string `yaml:"regex"` // matches the whole name, except for expr rules
+	To    string `yaml:"to"`    // may reference the regex groups as $1
+}
+
+// promqlRewrite is the change log entry of a rewritten expression
+type promqlRewrite struct {
+	Location string   `json:"location"`
+	Changes  []string `json:"changes"`
+	Before   string   `json:"before"`
+	After    string   `json:"after"`
+}
+
+type promqlRewriter struct {
+	rules []promqlRule
+
+	// hits counts the rewrites of every rule, to report the rules that never applied
+	hits  []int
+	mutex sync.Mutex
+}
+
+// loadPromQLRules reads and validates a PromQL rules file
+func loadPromQLRules(path string) (*promqlRewriter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PromQL rules: %v", err)
+	}
+
+	var file promqlRulesConfig
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse PromQL rules %s: %v", path, err)
+	}
+
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		for kind, match := range map[string]*promqlRuleMatch{promqlRuleMetric: rule.Metric, promqlRuleLabel: rule.Label, promqlRuleMacro: rule.Macro, promqlRuleExpr: rule.Expr} {
+			if match == nil {
+				continue
+			}
+			if rule.match != nil {
+				return nil, fmt.Errorf("PromQL rule %d has more than one type", i+1)
+			}
+			rule.kind, rule.match = kind, match
+		}
+		if rule.match == nil {
+			return nil, fmt.Errorf("PromQL rule %d has no type, use metric, label, macro or expr", i+1)
+		}
+		if (rule.match.From == "") == (rule.match.Regex == "") {
+			return nil, fmt.Errorf("PromQL rule %d needs either from or regex", i+1)
+		}
+		if rule.match.Regex != "" {
+			pattern := rule.match.Regex
+			if rule.kind != promqlRuleExpr {
+				pattern = "^(?:" + pattern + ")$"
+			}
+			if rule.regex, err = regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("PromQL rule %d has an invalid regex: %v", i+1, err)
+			}
+		}
+	}
+
+	return &promqlRewriter{rules: file.Rules, hits: make([]int, len(file.Rules))}, nil
+}
+
+// describe describes a rule for the summary, like "rule 2 (metric node_cpu)"
+func (r *promqlRule) describe(index int) string {
+	match := r.match.From
+	if match == "" {
+		match = "/" + r.match.Regex + "/"
+	}
+	return fmt.Sprintf("rule %d (%s %s)", index+1, r.kind, match)
+}
+
+// replace applies the rules of a kind to a name and returns the new name of the first rule matching it
+func (r *promqlRewriter) replace(kind, name string, hits []int) (string, bool) {
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if rule.kind != kind {
+			continue
+		}
+		var replaced string
+		switch {
+		case rule.regex != nil && rule.regex.MatchString(name):
+			replaced = rule.regex.ReplaceAllString(name, rule.match.To)
+		case rule.match.From != "" && rule.match.From == name:
+			replaced = rule.match.To
+		default:
+			continue
+		}
+		if replaced == name {
+			return name, false
+		}
+		hits[i]++
+		return replaced, true
+	}
+	return name, false
+}
+
+// rewrite applies the rules to an expression. It returns the new expression and the changes made.
+func (r *promqlRewriter) rewrite(expr string) (string, []string) {
+	hits := make([]int, len(r.rules))
+	var changes []string
+	change := func(description string) {
+		for _, existing := range changes {
+			if existing == description {
+				return
+			}
+		}
+		changes = append(changes, description)
+	}
+
+	tokens := tokenizePromQL(expr)
+	var result strings.Builder
+	last := 0
+	replaceToken := func(token promqlToken, start, end int, kind string) {
+		name := token.text[start:end]
+		if replaced, ok := r.replace(kind, name, hits); ok {
+			result.WriteString(expr[last : token.start+start])
+			result.WriteString(replaced)
+			last = token.start + end
+			change(fmt.Sprintf("%s %s to %s", kind, name, replaced))
+		}
+	}
+
+	for i, role := range classifyPromQL(tokens) {
+		token := tokens[i]
+		switch role {
+		case roleMetric:
+			replaceToken(token, 0, len(token.text), promqlRuleMetric)
+		case roleLabel:
+			replaceToken(token, 0, len(token.text), promqlRuleLabel)
+		case roleMetricString:
+			replaceToken(token, 1, len(token.text)-1, promqlRuleMetric)
+		case roleLabelString:
+			replaceToken(token, 1, len(token.text)-1, promqlRuleLabel)
+		case roleVariable:
+			match := grafanaVariableUsageRegex.FindStringSubmatch(token.text)
+			if match == nil {
+				continue
+			}
+			name := match[1] + match[3] + match[5]
+			if replaced, ok := r.replace(promqlRuleMacro, name, hits); ok {
+				result.WriteString(expr[last:token.start])
+				result.WriteString(replaced)
+				last = token.end
+				change(fmt.Sprintf("macro %s to %s", token.text, replaced))
+			}
+		}
+	}
+	result.WriteString(expr[last:])
+	rewritten := result.String()
+
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if rule.kind != promqlRuleExpr {
+			continue
+		}
+		var replaced string
+		if rule.regex != nil {
+			replaced = rule.regex.ReplaceAllString(rewritten, rule.match.To)
+		} else {
+			replaced = strings.ReplaceAll(rewritten, rule.match.From, rule.match.To)
+		}
+		if replaced != rewritten {
+			hits[i]++
+			change(rule.describe(i))
+			rewritten = replaced
+		}
+	}
+
+	r.record(hits)
+	return rewritten, changes
+}
+
+// rewriteLabel applies the label rules to a label name
+func (r *promqlRewriter) rewriteLabel(name string) (string, []string) {
+	hits := make([]int, len(r.rules))
+	replaced, ok := r.replace(promqlRuleLabel, name, hits)
+	r.record(hits)
+	if !ok {
+		return name, nil
+	}
+	return replaced, []string{fmt.Sprintf("label %s to %s", name, replaced)}
+}
+
+func (r *promqlRewriter) record(hits []int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, count := range hits {
+		r.hits[i] += count
+	}
+}
+
+// unusedRules describes the rules that rewrote nothing
+func (r *promqlRewriter) unusedRules() []string {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var unused []string
+	for i := range r.rules {
+		if r.hits[i] == 0 {
+			unused = append(unused, r.rules[i].describe(i))
+		}
+	}
+	return unused
+}
+
+// promqlFields are the PromQL fields of the Prometheus plugin specs; labelName holds a label name
+var promqlFields = map[string][]string{
+	"PrometheusTimeSeriesQuery":     {"query"},
+	"PrometheusPromQLVariable":      {"expr", "labelName"},
+	"PrometheusLabelValuesVariable": {"labelName", "matchers"},
+	"PrometheusLabelNamesVariable":  {"matchers"},
+}
+
+// rewritePromQL applies the PromQL rules to the Prometheus plugin specs of a migrated dashboard and returns the
+// change log
+func rewritePromQL(persesDashboard *persesv1.Dashboard) []promqlRewrite {
+	var rewrites []promqlRewrite
+	walkPromQL(persesDashboard, func(location, field, text string) string {
+		rewrite := promqlRules.rewrite
+		if field == "labelName" {
+			rewrite = promqlRules.rewriteLabel
+		}
+		rewritten, changes := rewrite(text)
+		if len(changes) == 0 {
+			return text
+		}
+		rewrites = append(rewrites, promqlRewrite{Location: location, Changes: changes, Before: text, After: rewritten})
+		return rewritten
+	})
+	return rewrites
+}
+
+// promqlVisitor is called for every PromQL field with the location of the plugin, like panel "CPU", and returns the
+// new value of the field
+type promqlVisitor func(location, field, text string) string
+
+// walkPromQL visits the PromQL fields of the panel, query and list variable plugins of a dashboard, and of the
+// plugins nested in them, in a stable order
+func walkPromQL(persesDashboard *persesv1.Dashboard, visit promqlVisitor) {
+	keys := make([]string, 0, len(persesDashboard.Spec.Panels))
+	for key := range persesDashboard.Spec.Panels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		panel := persesDashboard.Spec.Panels[key]
+		location := fmt.Sprintf("panel %q", panel.Spec.Display.Name)
+		walkPromQLPlugin(&panel.Spec.Plugin, location, visit)
+		for i := range panel.Spec.Queries {
+			walkPromQLPlugin(&panel.Spec.Queries[i].Spec.Plugin, location, visit)
+		}
+	}
+	for _, v := range persesDashboard.Spec.Variables {
+		if listSpec, ok := v.Spec.(*dashboard.ListVariableSpec); ok {
+			walkPromQLPlugin(&listSpec.Plugin, "variable "+listSpec.Name, visit)
+		}
+	}
+}
+
+func walkPromQLPlugin(plugin *common.Plugin, location string, visit promqlVisitor) {
+	if spec, ok := plugin.Spec.(map[string]any); ok {
+		walkPromQLSpec(plugin.Kind, spec, location, visit)
+	}
+}
+
+func walkPromQLSpec(kind string, spec map[string]any, location string, visit promqlVisitor) {
+	for _, field := range promqlFields[kind] {
+		switch value := spec[field].(type) {
+		case string:
+			spec[field] = visit(location, field, value)
+		case []any:
+			for i := range value {
+				if text, ok := value[i].(string); ok {
+					value[i] = visit(location, field, text)
+				}
+			}
+		}
+	}
+	keys := make([]string, 0, len(spec))
+	for key := range spec {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		walkNestedPromQL(spec[key], location, visit)
+	}
+}
+
+// walkNestedPromQL walks a plugin spec value for nested plugins, like the queries of a panel plugin
+func walkNestedPromQL(value any, location string, visit promqlVisitor) {
+	switch v := value.(type) {
+	case map[string]any:
+		kind, _ := v["kind"].(string)
+		if spec, ok := v["spec"].(map[string]any); ok && kind != "" {
+			walkPromQLSpec(kind, spec, location, visit)
+			return
+		}
+		for _, nested := range v {
+			walkNestedPromQL(nested, location, visit)
+		}
+	case []any:
+		for _, nested := range v {
+			walkNestedPromQL(nested, location, visit)
+		}
+	}
+}
+
+// promqlToken is a token of a PromQL expression; whitespace and comments are not tokens
+type promqlToken struct {
+	kind       int
+	text       string
+	start, end int
+}
+
+const (
+	tokenIdentifier = iota
+	tokenString
+	tokenNumber
+	tokenVariable
+	tokenOperator
+)
+
+// Roles of the tokens that rules rewrite
+const (
+	roleOther = iota
+	roleMetric
+	roleLabel
+	roleMetricString // string holding a metric name, like the value of a __name__ matcher
+	roleLabelString  // string holding a label name, like the arguments of label_replace
+	roleVariable
+)
+
+// grafanaBracketVariableRegex matches the [[var]] syntax, which can't be a PromQL subquery
+var grafanaBracketVariableRegex = regexp.MustCompile(`^\[\[\w+(?::\w+)?\]\]`)
+
+// promqlKeywords are the identifiers that are not metric names when they are not followed by a parenthesis
+var promqlKeywords = map[string]bool{
+	"and": true, "or": true, "unless": true, "atan2": true, "bool": true, "offset": true, "start": true, "end": true,
+	"by": true, "without": true, "on": true, "ignoring": true, "group_left": true, "group_right": true,
+	"inf": true, "nan": true,
+	"sum": true, "min": true, "max": true, "avg": true, "group": true, "stddev": true, "stdvar": true, "count": true,
+	"count_values": true, "bottomk": true, "topk": true, "quantile": true, "limitk": true, "limit_ratio": true,
+}
+
+// promqlGroupingKeywords are followed by a list of label names
+var promqlGroupingKeywords = map[string]bool{
+	"by": true, "without": true, "on": true, "ignoring": true, "group_left": true, "group_right": true,
+}
+
+// promqlLabelArguments tells which string arguments of a function are label names
+var promqlLabelArguments = map[string]func(index int) bool{
+	"label_replace":      func(index int) bool { return index == 1 || index == 3 },
+	"label_join":         func(index int) bool { return index == 1 || index >= 3 },
+	"sort_by_label":      func(index int) bool { return index >= 1 },
+	"sort_by_label_desc": func(index int) bool { return index >= 1 },
+	"count_values":       func(index int) bool { return index == 0 },
+}
+
+var promqlMatchOperators = map[string]bool{"=": true, "!=": true, "=~": true, "!~": true}
+
+// tokenizePromQL splits a PromQL expression into tokens. Grafana and Perses variables are single tokens, so that
+// they are never taken for metric names.
+func tokenizePromQL(expr string) []promqlToken {
+	var tokens []promqlToken
+	brackets := 0 // a colon in brackets separates the range and the step of a subquery
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		start := i
+		kind := tokenOperator
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '#':
+			for i < len(expr) && expr[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '"' || c == '\'' || c == '`':
+			kind = tokenString
+			for i++; i < len(expr) && expr[i] != c; i++ {
+				if expr[i] == '\\' && c != '`' {
+					i++
+				}
+			}
+			i = min(i+1, len(expr))
+		case c == '$' || c == '[' && grafanaBracketVariableRegex.MatchString(expr[i:]):
+			if match := grafanaVariableUsageRegex.FindStringIndex(expr[i:]); match != nil && match[0] == 0 {
+				kind = tokenVariable
+				i += match[1]
+			} else {
+				i++
+			}
+		case isIdentifierStart(c) && (c != ':' || brackets == 0):
+			kind = tokenIdentifier
+			for i < len(expr) && (isIdentifierStart(expr[i]) || isDigit(expr[i])) {
+				i++
+			}
+		case isDigit(c) || c == '.':
+			kind = tokenNumber
+			for i < len(expr) && (isIdentifierStart(expr[i]) && expr[i] != ':' || isDigit(expr[i]) || expr[i] == '.' ||
+				(expr[i] == '+' || expr[i] == '-') && (expr[i-1] == 'e' || expr[i-1] == 'E') && !strings.HasPrefix(expr[start:], "0x")) {
+				i++
+			}
+		default:
+			i++
+			if i < len(expr) && (expr[i] == '=' && strings.ContainsRune("=!<>", rune(c)) || expr[i] == '~' && strings.ContainsRune("=!", rune(c))) {
+				i++
+			}
+			switch c {
+			case '[':
+				brackets++
+			case ']':
+				brackets--
+			}
+		}
+		tokens = append(tokens, promqlToken{kind: kind, text: expr[start:i], start: start, end: i})
+	}
+	return tokens
+}
+
+func isIdentifierStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// promqlFrame is an open parenthesis, brace or bracket while classifying tokens
+type promqlFrame struct {
+	open     string
+	function string // function called with the parenthesis
+	grouping bool   // parenthesis of a label list, like by (job)
+	argument int
+}
+
+// classifyPromQL returns the role of every token: metric names, label names, strings holding one of them and
+// variables. Identifiers glued to a variable, like node_$metric, are part of a templated name and left alone.
+func classifyPromQL(tokens []promqlToken) []int {
+	roles := make([]int, len(tokens))
+	frames := []promqlFrame{{}}
+	pendingFunction, pendingGrouping := "", false
+
+	for i, token := range tokens {
+		frame := &frames[len(frames)-1]
+		next := ""
+		if i+1 < len(tokens) {
+			next = tokens[i+1].text
+		}
+
+		switch token.kind {
+		case tokenVariable:
+			roles[i] = roleVariable
+		case tokenIdentifier:
+			templated := i > 0 && tokens[i-1].kind == tokenVariable && tokens[i-1].end == token.start ||
+				i+1 < len(tokens) && tokens[i+1].kind == tokenVariable && tokens[i+1].start == token.end
+			switch {
+			case frame.open == "{":
+				if promqlMatchOperators[next] && !templated {
+					roles[i] = roleLabel
+					if token.text == "__name__" && next == "=" && i+2 < len(tokens) && tokens[i+2].kind == tokenString {
+						roles[i+2] = roleMetricString
+					}
+				}
+			case frame.grouping:
+				if !templated {
+					roles[i] = roleLabel
+				}
+			case next == "(":
+				if promqlGroupingKeywords[token.text] {
+					pendingGrouping = true
+				} else {
+					pendingFunction = token.text
+				}
+			case promqlKeywords[token.text]:
+			case frame.open == "[":
+			default:
+				if !templated {
+					roles[i] = roleMetric
+				}
+			}
+		case tokenString:
+			if frame.open == "(" && frame.function != "" {
+				if isLabel, ok := promqlLabelArguments[frame.function]; ok && isLabel(frame.argument) {
+					roles[i] = roleLabelString
+				}
+			}
+		case tokenOperator:
+			switch token.text {
+			case "(":
+				frames = append(frames, promqlFrame{open: "(", function: pendingFunction, grouping: pendingGrouping})
+			case "{", "[":
+				frames = append(frames, promqlFrame{open: token.text})
+			case ")", "}", "]":
+				if len(frames) > 1 {
+					frames = frames[:len(frames)-1]
+				}
+			case ",":
+				frame.argument++
+			}
+			pendingFunction, pendingGrouping = "", false
+		}
+	}
+	return roles
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+)
+
+const testPromQLRules = `rules:
+  - metric: {from: node_cpu, to: node_cpu_seconds_total}
+  - metric: {regex: "plutono_(.+)", to: "perses_$1"}
+  - label: {from: instance_name, to: instance}
+  - label: {regex: "k8s_(.+)", to: "$1"}
+  - macro: {from: __auto_interval_interval, to: 5m}
+  - expr: {regex: 'irate\((.+)\[1m\]\)', to: 'rate($1[$$__rate_interval])'}
+  - expr: {from: " offset 1d", to: " offset 1w"}
+`
+
+func loadTestPromQLRules(t *testing.T, rules string) (*promqlRewriter, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return loadPromQLRules(path)
+}
+
+func TestLoadPromQLRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		wantErr string
+	}{
+		{name: "valid", rules: testPromQLRules},
+		{name: "invalid YAML", rules: "rules: [", wantErr: "failed to parse PromQL rules"},
+		{name: "no type", rules: "rules:\n  - {}\n", wantErr: "PromQL rule 1 has no type"},
+		{name: "two types", rules: "rules:\n  - metric: {from: a, to: b}\n    label: {from: a, to: b}\n", wantErr: "PromQL rule 1 has more than one type"},
+		{name: "from and regex", rules: "rules:\n  - metric: {from: a, to: b}\n  - label: {from: a, regex: a, to: b}\n", wantErr: "PromQL rule 2 needs either from or regex"},
+		{name: "no match", rules: "rules:\n  - macro: {to: b}\n", wantErr: "PromQL rule 1 needs either from or regex"},
+		{name: "invalid regex", rules: "rules:\n  - expr: {regex: 'rate(', to: b}\n", wantErr: "PromQL rule 1 has an invalid regex"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := loadTestPromQLRules(t, test.rules)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("load failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestPromQLRewrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		expr        string
+		want        string
+		wantChanges []string
+	}{
+		{
+			name: "metric name", expr: `rate(node_cpu{mode="idle"}[5m])`,
+			want:        `rate(node_cpu_seconds_total{mode="idle"}[5m])`,
+			wantChanges: []string{"metric node_cpu to node_cpu_seconds_total"},
+		},
+		{
+			name: "metric regex", expr: `plutono_requests_total / plutono_requests_total offset 5m`,
+			want:        `perses_requests_total / perses_requests_total offset 5m`,
+			wantChanges: []string{"metric plutono_requests_total to perses_requests_total"},
+		},
+		{
+			name: "name matcher", expr: `{__name__="node_cpu", instance_name="a"}`,
+			want:        `{__name__="node_cpu_seconds_total", instance="a"}`,
+			wantChanges: []string{"metric node_cpu to node_cpu_seconds_total", "label instance_name to instance"},
+		},
+		{
+			name: "grouping and label arguments", expr: `sum by (k8s_pod) (label_replace(up, "k8s_node", "$1", "instance_name", "(.*)"))`,
+			want:        `sum by (pod) (label_replace(up, "node", "$1", "instance", "(.*)"))`,
+			wantChanges: []string{"label k8s_pod to pod", "label k8s_node to node", "label instance_name to instance"},
+		},
+		{
+			name: "vector matching", expr: `a * on(instance_name) group_left(k8s_team) b`,
+			want:        `a * on(instance) group_left(team) b`,
+			wantChanges: []string{"label instance_name to instance", "label k8s_team to team"},
+		},
+		{
+			name: "keywords and functions are not metrics", expr: `sum(rate(up[5m])) and on() vector(1)`,
+			want: `sum(rate(up[5m])) and on() vector(1)`,
+		},
+		{
+			name: "label values are not labels", expr: `up{job="instance_name"}`,
+			want: `up{job="instance_name"}`,
+		},
+		{
+			name: "templated names are left alone", expr: `node_cpu_$suffix{instance_name_${x}="a"}`,
+			want: `node_cpu_$suffix{instance_name_${x}="a"}`,
+		},
+		{
+			name: "macros", expr: `rate(up[$__auto_interval_interval]) + rate(up[${__auto_interval_interval}]) + rate(up[[[__auto_interval_interval]]])`,
+			want: `rate(up[5m]) + rate(up[5m]) + rate(up[5m])`,
+			wantChanges: []string{
+				"macro $__auto_interval_interval to 5m",
+				"macro ${__auto_interval_interval} to 5m",
+				"macro [[__auto_interval_interval]] to 5m",
+			},
+		},
+		{
+			name: "expr regex after the token rules", expr: `irate(node_cpu[1m])`,
+			want:        `rate(node_cpu_seconds_total[$__rate_interval])`,
+			wantChanges: []string{"metric node_cpu to node_cpu_seconds_total", `rule 6 (expr /irate\((.+)\[1m\]\)/)`},
+		},
+		{
+			name: "expr from", expr: `up offset 1d`,
+			want:        `up offset 1w`,
+			wantChanges: []string{"rule 7 (expr  offset 1d)"},
+		},
+		{
+			name: "comments and strings are kept", expr: "node_cpu # node_cpu\n",
+			want:        "node_cpu_seconds_total # node_cpu\n",
+			wantChanges: []string{"metric node_cpu to node_cpu_seconds_total"},
+		},
+		{name: "no change", expr: `up`, want: `up`},
+	}
+	rules, err := loadTestPromQLRules(t, testPromQLRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, changes := rules.rewrite(test.expr)
+			if got != test.want {
+				t.Errorf("rewrite(%q) = %q, want %q", test.expr, got, test.want)
+			}
+			if !reflect.DeepEqual(changes, test.wantChanges) {
+				t.Errorf("changes = %q, want %q", changes, test.wantChanges)
+			}
+		})
+	}
+}
+
+func TestRewritePromQL(t *testing.T) {
+	rules, err := loadTestPromQLRules(t, testPromQLRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := promqlRules
+	defer func() { promqlRules = previous }()
+	promqlRules = rules
+
+	const spec = `{
+		"duration": "1h",
+		"panels": {
+			"b": {"kind": "Panel", "spec": {"display": {"name": "CPU"}, "plugin": {"kind": "TimeSeriesChart", "spec": {}},
+				"queries": [{"kind": "TimeSeriesQuery", "spec": {"plugin": {"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "node_cpu"}}}}]}},
+			"a": {"kind": "Panel", "spec": {"display": {"name": "Up"}, "plugin": {"kind": "TimeSeriesChart", "spec": {}},
+				"queries": [{"kind": "TimeSeriesQuery", "spec": {"plugin": {"kind": "PrometheusTimeSeriesQuery", "spec": {"query": "up"}}}}]}}
+		},
+		"variables": [
+			{"kind": "ListVariable", "spec": {"name": "instance", "plugin": {"kind": "PrometheusLabelValuesVariable",
+				"spec": {"labelName": "instance_name", "matchers": ["plutono_up{k8s_pod!=\"\"}"]}}}},
+			{"kind": "ListVariable", "spec": {"name": "top", "plugin": {"kind": "PrometheusPromQLVariable",
+				"spec": {"expr": "topk(5, node_cpu)", "labelName": "node_cpu"}}}}
+		]}`
+	var persesDashboard persesv1.Dashboard
+	data := `{"kind": "Dashboard", "metadata": {"name": "test", "project": "team"}, "spec": ` + spec + `}`
+	if err := json.Unmarshal([]byte(data), &persesDashboard); err != nil {
+		t.Fatalf("invalid fixture: %v", err)
+	}
+
+	rewrites := rewritePromQL(&persesDashboard)
+
+	want := []promqlRewrite{
+		{Location: `panel "CPU"`, Changes: []string{"metric node_cpu to node_cpu_seconds_total"}, Before: "node_cpu", After: "node_cpu_seconds_total"},
+		{Location: "variable instance", Changes: []string{"label instance_name to instance"}, Before: "instance_name", After: "instance"},
+		{
+			Location: "variable instance", Changes: []string{"metric plutono_up to perses_up", "label k8s_pod to pod"},
+			Before: `plutono_up{k8s_pod!=""}`, After: `perses_up{pod!=""}`,
+		},
+		// The labelName node_cpu of the variable is a label name, the metric rule leaves it alone
+		{Location: "variable top", Changes: []string{"metric node_cpu to node_cpu_seconds_total"}, Before: "topk(5, node_cpu)", After: "topk(5, node_cpu_seconds_total)"},
+	}
+	if !reflect.DeepEqual(rewrites, want) {
+		t.Errorf("rewrites = %+v\nwant %+v", rewrites, want)
+	}
+
+	rewritten, err := json.Marshal(persesDashboard.Spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`"query":"node_cpu_seconds_total"`, `"labelName":"instance"`, `"perses_up{pod!=\"\"}"`, `"labelName":"node_cpu"`} {
+		if !strings.Contains(string(rewritten), expected) {
+			t.Errorf("rewritten dashboard %s doesn't contain %s", rewritten, expected)
+		}
+	}
+
+	wantUnused := []string{"rule 5 (macro __auto_interval_interval)", `rule 6 (expr /irate\((.+)\[1m\]\)/)`, "rule 7 (expr  offset 1d)"}
+	if unused := rules.unusedRules(); !reflect.DeepEqual(unused, wantUnused) {
+		t.Errorf("unused rules = %q, want %q", unused, wantUnused)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+)
+
+// Migrated dashboards can be published to a Perses server. Every dashboard goes to the project of its input
+// subdirectory, see projectFor.
+
+const (
+	publishCreated   = "created"
+	publishUpdated   = "updated"
+	publishUnchanged = "unchanged"
+)
+
+type persesPublisher struct {
+	baseURL string
+	token   string
+	dryRun  bool
+	http    *http.Client
+
+	// projects caches the projects known to exist, so each one is checked or created once
+	projects     map[string]bool
+	projectMutex sync.Mutex
+}
+
+// newPersesPublisher validates the publish flags and logs in to the Perses server if credentials are given
+func newPersesPublisher() (*persesPublisher, error) {
+	publisher := &persesPublisher{
+		baseURL:  strings.TrimSuffix(*publishURL, "/"),
+		token:    *publishToken,
+		dryRun:   *publishDryRun,
+		http:     &http.Client{Timeout: 30 * time.Second},
+		projects: make(map[string]bool),
+	}
+	if publisher.token == "" {
+		publisher.token = os.Getenv("PERSES_TOKEN")
+	}
+
+	if publisher.token == "" && *publishUser != "" {
+		password := *publishPassword
+		if password == "" {
+			password = os.Getenv("PERSES_PASSWORD")
+		}
+		if err := publisher.login(*publishUser, password); err != nil {
+			return nil, err
+		}
+	}
+	return publisher, nil
+}
+
+// login exchanges native Perses credentials for an access token
+func (p *persesPublisher) login(user, password string) error {
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+	body := map[string]string{"login": user, "password": password}
+	if _, err := p.do(http.MethodPost, "/api/auth/providers/native/login", body, &response); err != nil {
+		return fmt.Errorf("failed to login to Perses: %v", err)
+	}
+	if response.AccessToken == "" {
+		return fmt.Errorf("failed to login to Perses: no access token in response")
+	}
+	p.token = response.AccessToken
+	return nil
+}
+
+// do sends a request to the Perses API. It returns the status code and an error for any status but 2xx; v is only
+// decoded on success.
+func (p *persesPublisher) do(method, apiPath string, body any, v any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, p.baseURL+apiPath, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%s %s failed: %v", method, apiPath, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("%s %s failed with status %d: %s", method, apiPath, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return resp.StatusCode, fmt.Errorf("failed to decode response of %s %s: %v", method, apiPath, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// get fetches a resource into v and tells whether it exists. Only the existence checks tolerate a 404, a create or
+// update that gets one, like with a wrong path prefix in --publish-url, fails.
+func (p *persesPublisher) get(apiPath string, v any) (bool, error) {
+	status, err := p.do(http.MethodGet, apiPath, nil, v)
+	if status == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ensureProject creates the project if it doesn't exist yet
+func (p *persesPublisher) ensureProject(project string, out *dashboardOutput) error {
+	p.projectMutex.Lock()
+	defer p.projectMutex.Unlock()
+	if p.projects[project] {
+		return nil
+	}
+
+	exists, err := p.get("/api/v1/projects/"+url.PathEscape(project), nil)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if p.dryRun {
+			out.Printf("    → [dry-run] Would create project %s\n", project)
+		} else {
+			newProject := persesv1.Project{
+				Kind:     persesv1.KindProject,
+				Metadata: persesv1.Metadata{Name: project},
+			}
+			if _, err := p.do(http.MethodPost, "/api/v1/projects", newProject, nil); err != nil {
+				return fmt.Errorf("failed to create project %s: %v", project, err)
+			}
+			out.Printf("    → Created project %s\n", project)
+		}
+	}
+
+	p.projects[project] = true
+	return nil
+}
+
+// publish applies a migrated dashboard file to its project and returns what was done
+func (p *persesPublisher) publish(dashboard *DashboardInfo, out *dashboardOutput) (string, error) {
+	data, err := readOutputFile(dashboard.PersesFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read migrated dashboard: %v", err)
+	}
+
+	var persesDashboard persesv1.Dashboard
+	if err := json.Unmarshal(data, &persesDashboard); err != nil {
+		return "", fmt.Errorf("failed to parse migrated dashboard: %v", err)
+	}
+
+	project := dashboard.Project
+	persesDashboard.Metadata.Project = project
+	name := persesDashboard.Metadata.Name
+
+	if err := p.ensureProject(project, out); err != nil {
+		return "", err
+	}
+
+	dashboardPath := fmt.Sprintf("/api/v1/projects/%s/dashboards/%s", url.PathEscape(project), url.PathEscape(name))
+	var existing persesv1.Dashboard
+	exists, err := p.get(dashboardPath, &existing)
+	if err != nil {
+		return "", err
+	}
+
+	action := publishCreated
+	if exists {
+		action = publishUpdated
+		if *publishSkipUnchanged && sameDashboardSpec(&existing, &persesDashboard) {
+			out.Printf("    → Dashboard %s/%s is unchanged on Perses, skipping\n", project, name)
+			return publishUnchanged, nil
+		}
+	}
+
+	if p.dryRun {
+		out.Printf("    → [dry-run] Would %s dashboard %s/%s\n", strings.TrimSuffix(action, "d"), project, name)
+		return action, nil
+	}
+
+	if exists {
+		_, err = p.do(http.MethodPut, dashboardPath, persesDashboard, nil)
+	} else {
+		_, err = p.do(http.MethodPost, fmt.Sprintf("/api/v1/projects/%s/dashboards", url.PathEscape(project)), persesDashboard, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	out.Printf("    → Published dashboard %s/%s (%s)\n", project, name, action)
+	return action, nil
+}
+
+// sameDashboardSpec compares the specs only, the metadata is maintained by the server
+func sameDashboardSpec(a, b *persesv1.Dashboard) bool {
+	specA, errA := json.Marshal(a.Spec)
+	specB, errB := json.Marshal(b.Spec)
+	return errA == nil && errB == nil && bytes.Equal(specA, specB)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakePerses is a stand-in for the projects and dashboards endpoints of the Perses API
+type fakePerses struct {
+	mutex      sync.Mutex
+	projects   map[string]bool
+	dashboards map[string]json.RawMessage // by project/name
+	requests   []string                   // method and path of every request
+	status     map[string]int             // forced status by "METHOD path"
+}
+
+func newFakePerses(t *testing.T) (*fakePerses, *persesPublisher) {
+	fake := &fakePerses{
+		projects:   make(map[string]bool),
+		dashboards: make(map[string]json.RawMessage),
+		status:     make(map[string]int),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	publisher := &persesPublisher{
+		baseURL:  server.URL,
+		http:     server.Client(),
+		projects: make(map[string]bool),
+	}
+	return fake, publisher
+}
+
+func (f *fakePerses) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	request := r.Method + " " + r.URL.Path
+	f.requests = append(f.requests, request)
+	if status, ok := f.status[request]; ok {
+		http.Error(w, `{"error":"forced"}`, status)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "projects" && r.Method == http.MethodPost:
+		var project struct {
+			Metadata struct{ Name string } `json:"metadata"`
+		}
+		_ = json.Unmarshal(body, &project)
+		f.projects[project.Metadata.Name] = true
+		w.WriteHeader(http.StatusOK)
+	case len(parts) == 2 && parts[0] == "projects" && r.Method == http.MethodGet:
+		if !f.projects[parts[1]] {
+			http.NotFound(w, r)
+		}
+	case len(parts) == 3 && parts[2] == "dashboards" && r.Method == http.MethodPost:
+		var dashboard struct {
+			Metadata struct{ Name string } `json:"metadata"`
+		}
+		_ = json.Unmarshal(body, &dashboard)
+		f.dashboards[parts[1]+"/"+dashboard.Metadata.Name] = body
+	case len(parts) == 4 && parts[2] == "dashboards":
+		key := parts[1] + "/" + parts[3]
+		existing, ok := f.dashboards[key]
+		switch {
+		case !ok:
+			http.NotFound(w, r)
+		case r.Method == http.MethodGet:
+			_, _ = w.Write(existing)
+		case r.Method == http.MethodPut:
+			f.dashboards[key] = body
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeDashboardFile writes a migrated dashboard file with a panel title, to publish it
+func writeDashboardFile(t *testing.T, name, title string) *DashboardInfo {
+	t.Helper()
+	dashboard := map[string]any{
+		"kind":     "Dashboard",
+		"metadata": map[string]any{"name": name},
+		"spec": map[string]any{
+			"display":  map[string]any{"name": title},
+			"duration": "1h",
+		},
+	}
+	data, err := json.Marshal(dashboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name+".json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &DashboardInfo{PersesFile: path, Project: "team", RelativePath: "team/" + name + ".json"}
+}
+
+func TestPublishCreatesProjectAndDashboard(t *testing.T) {
+	fake, publisher := newFakePerses(t)
+
+	action, err := publisher.publish(writeDashboardFile(t, "cpu", "CPU"), &dashboardOutput{})
+	if err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	if action != publishCreated {
+		t.Errorf("action = %s, want %s", action, publishCreated)
+	}
+	if !fake.projects["team"] {
+		t.Error("project team was not created")
+	}
+	if _, ok := fake.dashboards["team/cpu"]; !ok {
+		t.Error("dashboard team/cpu was not created")
+	}
+
+	// The project is known to exist from now on
+	if _, err := publisher.publish(writeDashboardFile(t, "memory", "Memory"), &dashboardOutput{}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	projectChecks := 0
+	for _, request := range fake.requests {
+		if request == "GET /api/v1/projects/team" {
+			projectChecks++
+		}
+	}
+	if projectChecks != 1 {
+		t.Errorf("project checked %d times, want 1", projectChecks)
+	}
+}
+
+func TestPublishUpdatesExistingDashboard(t *testing.T) {
+	fake, publisher := newFakePerses(t)
+	if _, err := publisher.publish(writeDashboardFile(t, "cpu", "CPU"), &dashboardOutput{}); err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+
+	tests := []struct {
+		title  string
+		action string
+		method string
+	}{
+		{title: "CPU", action: publishUnchanged},
+		{title: "CPU usage", action: publishUpdated, method: http.MethodPut},
+	}
+	for _, test := range tests {
+		t.Run(test.action, func(t *testing.T) {
+			fake.requests = nil
+			action, err := publisher.publish(writeDashboardFile(t, "cpu", test.title), &dashboardOutput{})
+			if err != nil {
+				t.Fatalf("publish failed: %v", err)
+			}
+			if action != test.action {
+				t.Errorf("action = %s, want %s", action, test.action)
+			}
+			last := fake.requests[len(fake.requests)-1]
+			if test.method != "" && last != test.method+" /api/v1/projects/team/dashboards/cpu" {
+				t.Errorf("last request = %s, want a %s of the dashboard", last, test.method)
+			}
+			if test.method == "" && !strings.HasPrefix(last, http.MethodGet) {
+				t.Errorf("last request = %s, want no change", last)
+			}
+		})
+	}
+	if !strings.Contains(string(fake.dashboards["team/cpu"]), "CPU usage") {
+		t.Errorf("dashboard was not updated: %s", fake.dashboards["team/cpu"])
+	}
+}
+
+func TestPublishErrorStatuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing bool
+		request  string
+		status   int
+	}{
+		{name: "project creation not found", request: "POST /api/v1/projects", status: http.StatusNotFound},
+		{name: "project check failed", request: "GET /api/v1/projects/team", status: http.StatusInternalServerError},
+		{name: "dashboard creation not found", request: "POST /api/v1/projects/team/dashboards", status: http.StatusNotFound},
+		{name: "dashboard creation forbidden", request: "POST /api/v1/projects/team/dashboards", status: http.StatusForbidden},
+		{name: "dashboard update not found", existing: true, request: "PUT /api/v1/projects/team/dashboards/cpu", status: http.StatusNotFound},
+		{name: "dashboard check unauthorized", request: "GET /api/v1/projects/team/dashboards/cpu", status: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake, publisher := newFakePerses(t)
+			if test.existing {
+				if _, err := publisher.publish(writeDashboardFile(t, "cpu", "CPU"), &dashboardOutput{}); err != nil {
+					t.Fatalf("publish failed: %v", err)
+				}
+			}
+			fake.status[test.request] = test.status
+
+			action, err := publisher.publish(writeDashboardFile(t, "cpu", "CPU usage"), &dashboardOutput{})
+			if err == nil {
+				t.Fatalf("publish succeeded with action %s, want an error", action)
+			}
+			if !strings.Contains(err.Error(), fmt.Sprintf("status %d", test.status)) {
+				t.Errorf("error %q doesn't mention the status", err)
+			}
+		})
+	}
+}
+
+func TestPublishDryRunChangesNothing(t *testing.T) {
+	fake, publisher := newFakePerses(t)
+	publisher.dryRun = true
+
+	action, err := publisher.publish(writeDashboardFile(t, "cpu", "CPU"), &dashboardOutput{})
+	if err != nil {
+		t.Fatalf("publish failed: %v", err)
+	}
+	if action != publishCreated {
+		t.Errorf("action = %s, want %s", action, publishCreated)
+	}
+	for _, request := range fake.requests {
+		if !strings.HasPrefix(request, http.MethodGet) {
+			t.Errorf("dry run sent %s", request)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The migration report is the machine-readable counterpart of the console summary. It lists every input dashboard
+// with the stage it reached, the error that stopped it and the warnings raised on the way.
+
+const (
+	reportFileName = "migration-report.json"
+
+	stageSchemaUpdated = "schema-updated"
+	stagePublished     = "published"
+
+	failedDownload     = "download"
+	failedSchemaUpdate = "schema-update"
+	failedExport       = "export"
+	failedMigration    = "migration"
+	failedValidation   = "validation"
+	failedPublish      = "publish"
+
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+	statusSkipped   = "skipped"
+)
+
+type migrationReport struct {
+	GeneratedAt time.Time         `json:"generatedAt"`
+	Duration    string            `json:"duration"`
+	Summary     reportSummary     `json:"summary"`
+	Dashboards  []dashboardReport `json:"dashboards"`
+
+	UnmappedDatasources []unmappedDatasource `json:"unmappedDatasources,omitempty"`
+	Datasources         *datasourceCheck     `json:"datasources,omitempty"`
+
+	elapsed time.Duration
+}
+
+type reportSummary struct {
+	Total     int `json:"total"`
+	Succeeded int `json:"succeeded"`
+	Skipped   int `json:"skipped"`
+	Failed    int `json:"failed"`
+	Invalid   int `json:"invalid,omitempty"` // dashboards with validation errors
+	// Unsupported counts the unsupported features of all dashboards by feature
+	Unsupported  map[string]int `json:"unsupported,omitempty"`
+	PromQLErrors int            `json:"promqlErrors,omitempty"` // queries that don't parse
+	// QueryProblems counts the problems of the verified queries by problem
+	QueryProblems map[string]int `json:"queryProblems,omitempty"`
+	SuccessRate   float64        `json:"successRate"` // percentage of dashboards that didn't fail
+}
+
+type dashboardReport struct {
+	InputPath        string               `json:"inputPath"` // relative path from input directory
+	Title            string               `json:"title,omitempty"`
+	OriginalUID      string               `json:"originalUid,omitempty"`
+	UID              string               `json:"uid,omitempty"`
+	Status           string               `json:"status"`
+	Project          string               `json:"project,omitempty"`
+	Stage            string               `json:"stage,omitempty"`       // last stage completed
+	FailedStage      string               `json:"failedStage,omitempty"` // stage that failed
+	Error            string               `json:"error,omitempty"`
+	GrafanaFile      string               `json:"grafanaFile,omitempty"` // relative path from output directory
+	PersesFile       string               `json:"persesFile,omitempty"`  // relative path from output directory
+	Publish          string               `json:"publish,omitempty"`     // created, updated or unchanged
+	Warnings         []string             `json:"warnings,omitempty"`
+	ValidationErrors []string             `json:"validationErrors,omitempty"`
+	Unsupported      []unsupportedFeature `json:"unsupported,omitempty"`
+	VariableFixes    []string             `json:"variableFixes,omitempty"`
+	PromQLRewrites   []promqlRewrite      `json:"promqlRewrites,omitempty"`
+	PromQLErrors     []promqlError        `json:"promqlErrors,omitempty"`
+	VerifiedQueries  int                  `json:"verifiedQueries,omitempty"`
+	QueryProblems    []queryProblem       `json:"queryProblems,omitempty"`
+	StartedAt        time.Time            `json:"startedAt"`
+	DurationMs       int64                `json:"durationMs"`
+}
+
+// newDashboardReport builds the report entry of a processed dashboard
+func newDashboardReport(dashboard *DashboardInfo, startedAt time.Time) dashboardReport {
+	status := statusSucceeded
+	switch {
+	case dashboard.Error != "":
+		status = statusFailed
+	case dashboard.Skipped:
+		status = statusSkipped
+	}
+
+	return dashboardReport{
+		InputPath:        filepath.ToSlash(dashboard.RelativePath),
+		Title:            dashboard.Title,
+		OriginalUID:      dashboard.OriginalUID,
+		UID:              dashboard.UID,
+		Status:           status,
+		Project:          dashboard.Project,
+		Stage:            dashboard.Stage,
+		FailedStage:      dashboard.FailedStage,
+		Error:            dashboard.Error,
+		GrafanaFile:      outputRelativePath(dashboard.GrafanaFile),
+		PersesFile:       outputRelativePath(dashboard.PersesFile),
+		Publish:          dashboard.PublishAction,
+		Warnings:         dashboard.Warnings,
+		ValidationErrors: dashboard.ValidationErrors,
+		Unsupported:      dashboard.Unsupported,
+		VariableFixes:    dashboard.VariableFixes,
+		PromQLRewrites:   dashboard.PromQLRewrites,
+		PromQLErrors:     dashboard.PromQLErrors,
+		VerifiedQueries:  dashboard.VerifiedQueries,
+		QueryProblems:    dashboard.QueryProblems,
+		StartedAt:        startedAt.UTC(),
+		DurationMs:       time.Since(startedAt).Milliseconds(),
+	}
+}
+
+func outputRelativePath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if rel, err := filepath.Rel(*outputDir, path); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return path
+}
+
+// newMigrationReport builds the report of all dashboards, sorted by input path
+func newMigrationReport(summary *MigrationSummary, startedAt time.Time) *migrationReport {
+	dashboards := append([]dashboardReport(nil), summary.Dashboards...)
+	sort.Slice(dashboards, func(i, j int) bool { return dashboards[i].InputPath < dashboards[j].InputPath })
+
+	elapsed := time.Since(startedAt)
+	report := &migrationReport{
+		GeneratedAt: time.Now().UTC(),
+		Duration:    elapsed.Round(time.Millisecond).String(),
+		elapsed:     elapsed,
+		Summary: reportSummary{
+			Total:       summary.TotalDashboards,
+			SuccessRate: summary.successRate(),
+		},
+		Dashboards:          dashboards,
+		UnmappedDatasources: datasourceMapping.unmappedDatasources(),
+		Datasources:         summary.Datasources,
+	}
+	for _, dashboard := range dashboards {
+		switch dashboard.Status {
+		case statusFailed:
+			report.Summary.Failed++
+		case statusSkipped:
+			report.Summary.Skipped++
+		default:
+			report.Summary.Succeeded++
+		}
+		if len(dashboard.ValidationErrors) > 0 {
+			report.Summary.Invalid++
+		}
+		report.Summary.PromQLErrors += len(dashboard.PromQLErrors)
+		for _, problem := range dashboard.QueryProblems {
+			if report.Summary.QueryProblems == nil {
+				report.Summary.QueryProblems = make(map[string]int)
+			}
+			for _, problemType := range problem.types() {
+				report.Summary.QueryProblems[problemType]++
+			}
+		}
+		for _, feature := range dashboard.Unsupported {
+			if report.Summary.Unsupported == nil {
+				report.Summary.Unsupported = make(map[string]int)
+			}
+			report.Summary.Unsupported[feature.Feature]++
+		}
+	}
+	return report
+}
+
+// writeMigrationReport writes the report to the output directory and returns its path
+func writeMigrationReport(report *migrationReport) (string, error) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal migration report: %v", err)
+	}
+
+	path := filepath.Join(*outputDir, reportFileName)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write migration report: %v", err)
+	}
+	return path, nil
+}
+
+// fail records the stage that failed and the error that stopped the dashboard
+func (d *DashboardInfo) fail(stage string, err error) {
+	d.FailedStage = stage
+	d.Error = err.Error()
+}
+
+// warnf logs a warning and records it in the report of the dashboard
+func (d *DashboardInfo) warnf(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	log.Printf("Warning: %s", message)
+	d.Warnings = append(d.Warnings, message)
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The offline schema upgrader replays the Grafana dashboard schema migrations in-process, so old Plutono/Grafana
+// dashboards can be brought to the latest schema without importing them into a Grafana container.
+// Only the migrations that change what the Perses conversion reads (layout, panel types, datasources, variables,
+// links and legends) are implemented; the other versions are no-ops and only bump schemaVersion.
+
+const (
+	// Oldest schema version Grafana itself still migrates from
+	minSupportedSchemaVersion = 13
+	latestSchemaVersion       = 41
+
+	gridColumnCount   = 24
+	gridCellHeight    = 30
+	gridCellVMargin   = 8
+	defaultRowHeight  = 250
+	minPanelGridSpan  = 3
+	defaultPanelSpan  = 4
+	rowPanelGridWidth = 24
+)
+
+var schemaMigrations = map[int]func(dashboard map[string]any){
+	14: migrateSchemaV14,
+	16: migrateSchemaV16,
+	17: migrateSchemaV17,
+	19: migrateSchemaV19,
+	20: migrateSchemaV20,
+	22: migrateSchemaV22,
+	24: migrateSchemaV24,
+	26: migrateSchemaV26,
+	27: migrateSchemaV27,
+	28: migrateSchemaV28,
+	29: migrateSchemaV29,
+	33: migrateSchemaV33,
+	37: migrateSchemaV37,
+}
+
+// upgradeGrafanaSchema migrates a dashboard in place from its schemaVersion to latestSchemaVersion,
+// then converts the deprecated Angular panels (graph, singlestat) like Grafana does when loading them.
+func upgradeGrafanaSchema(dashboard map[string]any) error {
+	version := 0
+	if v, ok := dashboard["schemaVersion"].(float64); ok {
+		version = int(v)
+	}
+
+	if version < minSupportedSchemaVersion {
+		return fmt.Errorf("schema version %d is not supported, minimum supported version is %d", version, minSupportedSchemaVersion)
+	}
+
+	for next := version + 1; next <= latestSchemaVersion; next++ {
+		if migrate, ok := schemaMigrations[next]; ok {
+			migrate(dashboard)
+		}
+	}
+	if version < latestSchemaVersion {
+		dashboard["schemaVersion"] = latestSchemaVersion
+	}
+
+	forEachPanel(dashboard, migrateAngularPanel)
+	return nil
+}
+
+// forEachPanel calls fn for every panel of the dashboard, including the panels nested in collapsed rows
+func forEachPanel(dashboard map[string]any, fn func(panel map[string]any)) {
+	panels, _ := dashboard["panels"].([]any)
+	for _, p := range panels {
+		panel, ok := p.(map[string]any)
+		if !ok {
+			continue
+		}
+		fn(panel)
+		nested, _ := panel["panels"].([]any)
+		for _, n := range nested {
+			if nestedPanel, ok := n.(map[string]any); ok {
+				fn(nestedPanel)
+			}
+		}
+	}
+}
+
+// forEachTemplateVar calls fn for every templating variable of the dashboard
+func forEachTemplateVar(dashboard map[string]any, fn func(templateVar map[string]any)) {
+	templating, _ := dashboard["templating"].(map[string]any)
+	list, _ := templating["list"].([]any)
+	for _, v := range list {
+		if templateVar, ok := v.(map[string]any); ok {
+			fn(templateVar)
+		}
+	}
+}
+
+// migrateSchemaV14 replaces the sharedCrosshair flag with graphTooltip
+func migrateSchemaV14(dashboard map[string]any) {
+	if shared, ok := dashboard["sharedCrosshair"].(bool); ok && shared {
+		dashboard["graphTooltip"] = 1
+	} else if _, ok := dashboard["graphTooltip"]; !ok {
+		dashboard["graphTooltip"] = 0
+	}
+	delete(dashboard, "sharedCrosshair")
+}
+
+// migrateSchemaV16 converts the legacy rows layout (rows[].panels[] with span) into the grid layout (panels[] with gridPos)
+func migrateSchemaV16(dashboard map[string]any) {
+	rows, ok := dashboard["rows"].([]any)
+	if !ok {
+		return
+	}
+	delete(dashboard, "rows")
+
+	var panels []any
+	nextID := maxPanelID(rows) + 1
+	y := 0
+
+	// A dashboard with a single row whose title is hidden doesn't need a row panel
+	showRows := len(rows) > 1
+	if len(rows) == 1 {
+		if row, ok := rows[0].(map[string]any); ok {
+			showRows, _ = row["showTitle"].(bool)
+			if collapse, _ := row["collapse"].(bool); collapse {
+				showRows = true
+			}
+		}
+	}
+
+	for _, r := range rows {
+		row, ok := r.(map[string]any)
+		if !ok {
+			continue
+		}
+		collapsed, _ := row["collapse"].(bool)
+		rowHeight := gridHeight(row["height"])
+
+		var rowPanel map[string]any
+		if showRows {
+			title, _ := row["title"].(string)
+			rowPanel = map[string]any{
+				"id":        nextID,
+				"type":      grafanaPanelRowType,
+				"title":     title,
+				"collapsed": collapsed,
+				"panels":    []any{},
+				"gridPos":   map[string]any{"x": 0, "y": y, "w": rowPanelGridWidth, "h": 1},
+			}
+			if repeat, ok := row["repeat"].(string); ok && repeat != "" {
+				rowPanel["repeat"] = repeat
+			}
+			nextID++
+			panels = append(panels, rowPanel)
+			y++
+		}
+
+		x := 0
+		rowPanels, _ := row["panels"].([]any)
+		for _, p := range rowPanels {
+			panel, ok := p.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			span := float64(defaultPanelSpan)
+			if s, ok := panel["span"].(float64); ok && s > 0 {
+				span = s
+			}
+			width := int(math.Max(float64(minPanelGridSpan), math.Round(span*gridColumnCount/12)))
+			height := rowHeight
+			if _, ok := panel["height"]; ok {
+				height = gridHeight(panel["height"])
+			}
+
+			if x+width > gridColumnCount {
+				x = 0
+				y += height
+			}
+			panel["gridPos"] = map[string]any{"x": x, "y": y, "w": width, "h": height}
+			delete(panel, "span")
+			delete(panel, "height")
+			x += width
+
+			if rowPanel != nil && collapsed {
+				rowPanel["panels"] = append(rowPanel["panels"].([]any), panel)
+			} else {
+				panels = append(panels, panel)
+			}
+		}
+
+		if len(rowPanels) > 0 && !collapsed {
+			y += rowHeight
+		}
+	}
+
+	dashboard["panels"] = panels
+}
+
+func maxPanelID(rows []any) int {
+	maxID := 0
+	for _, r := range rows {
+		row, _ := r.(map[string]any)
+		rowPanels, _ := row["panels"].([]any)
+		for _, p := range rowPanels {
+			panel, _ := p.(map[string]any)
+			if id, ok := panel["id"].(float64); ok && int(id) > maxID {
+				maxID = int(id)
+			}
+		}
+	}
+	return maxID
+}
+
+// gridHeight converts a pixel height ("250px" or 250) to grid units
+func gridHeight(height any) int {
+	pixels := defaultRowHeight
+	switch h := height.(type) {
+	case float64:
+		pixels = int(h)
+	case string:
+		if parsed, err := strconv.Atoi(strings.TrimSuffix(h, "px")); err == nil {
+			pixels = parsed
+		}
+	}
+	return int(math.Ceil(float64(pixels) / float64(gridCellHeight+gridCellVMargin)))
+}
+
+// migrateSchemaV17 replaces minSpan with maxPerRow for repeated panels
+func migrateSchemaV17(dashboard map[string]any) {
+	forEachPanel(dashboard, func(panel map[string]any) {
+		minSpan, ok := panel["minSpan"].(float64)
+		if !ok || minSpan <= 0 {
+			return
+		}
+		maxPerRow := gridColumnCount / int(minSpan)
+		factors := []int{1, 2, 3, 4, 6, 8, 12, 24}
+		best := 1
+		for _, factor := range factors {
+			if factor <= maxPerRow {
+				best = factor
+			}
+		}
+		panel["maxPerRow"] = best
+		delete(panel, "minSpan")
+	})
+}
+
+// migrateSchemaV19 converts the legacy panel links (dashUri, keepTime, includeVars, params) to plain URLs
+func migrateSchemaV19(dashboard map[string]any) {
+	forEachPanel(dashboard, func(panel map[string]any) {
+		links, ok := panel["links"].([]any)
+		if !ok {
+			return
+		}
+		for i, l := range links {
+			link, ok := l.(map[string]any)
+			if !ok {
+				continue
+			}
+			links[i] = upgradePanelLink(link)
+		}
+	})
+}
+
+func upgradePanelLink(link map[string]any) map[string]any {
+	url, _ := link["url"].(string)
+	if url == "" {
+		if dashURI, ok := link["dashUri"].(string); ok && dashURI != "" {
+			url = "dashboard/" + dashURI
+		} else if dashboardName, ok := link["dashboard"].(string); ok && dashboardName != "" {
+			url = "dashboards?query=" + dashboardName
+		}
+	}
+
+	var params []string
+	if keepTime, _ := link["keepTime"].(bool); keepTime {
+		params = append(params, "$__url_time_range")
+	}
+	if includeVars, _ := link["includeVars"].(bool); includeVars {
+		params = append(params, "$__all_variables")
+	}
+	if extra, ok := link["params"].(string); ok && extra != "" {
+		params = append(params, extra)
+	}
+	if len(params) > 0 {
+		separator := "?"
+		if strings.Contains(url, "?") {
+			separator = "&"
+		}
+		url += separator + strings.Join(params, "&")
+	}
+
+	result := map[string]any{"url": url}
+	if title, ok := link["title"].(string); ok {
+		result["title"] = title
+	} else if name, ok := link["name"].(string); ok {
+		result["title"] = name
+	}
+	if targetBlank, ok := link["targetBlank"].(bool); ok {
+		result["targetBlank"] = targetBlank
+	}
+	return result
+}
+
+// migrateSchemaV20 renames the data link variables to the new field/series syntax
+func migrateSchemaV20(dashboard map[string]any) {
+	replacer := strings.NewReplacer(
+		"__series_name", "__series.name",
+		"$__field_name", "${__field.name}",
+		"__value_time", "__value.time",
+	)
+	forEachPanel(dashboard, func(panel map[string]any) {
+		options, _ := panel["options"].(map[string]any)
+		for _, key := range []string{"dataLinks", "links"} {
+			links, _ := options[key].([]any)
+			for _, l := range links {
+				if link, ok := l.(map[string]any); ok {
+					if url, ok := link["url"].(string); ok {
+						link["url"] = replacer.Replace(url)
+					}
+				}
+			}
+		}
+	})
+}
+
+// migrateSchemaV22 sets an explicit alignment on the legacy table styles
+func migrateSchemaV22(dashboard map[string]any) {
+	forEachPanel(dashboard, func(panel map[string]any) {
+		if panel["type"] != "table" {
+			return
+		}
+		styles, _ := panel["styles"].([]any)
+		for _, s := range styles {
+			if style, ok := s.(map[string]any); ok {
+				if align, _ := style["align"].(string); align == "" {
+					style["align"] = "auto"
+				}
+			}
+		}
+	})
+}
+
+// migrateSchemaV24 moves the Angular table panels (the ones using styles) to table-old
+func migrateSchemaV24(dashboard map[string]any) {
+	forEachPanel(dashboard, func(panel map[string]any) {
+		if panel["type"] != "table" {
+			return
+		}
+		if _, ok := panel["styles"]; ok {
+			panel["type"] = "table-old"
+		}
+	})
+}
+
+// migrateSchemaV26 replaces the text2 panel with the text panel
+func migrateSchemaV26(dashboard map[string]any) {
+	forEachPanel(dashboard, func(panel map[string]any) {
+		if panel["type"] == "text2" {
+			panel["type"] = "text"
+			delete(panel, "angular")
+		}
+	})
+}
+
+// migrateSchemaV27 hides constant variables and fills their current value from the query
+func migrateSchemaV27(dashboard map[string]any) {
+	forEachTemplateVar(dashboard, func(templateVar map[string]any) {
+		if templateVar["type"] != "constant" {
+			return
+		}
+		if hide, _ := templateVar["hide"].(float64); hide == 0 {
+			templateVar["hide"] = 2
+		}
+		query, _ := templateVar["query"].(string)
+		current := map[string]any{"text": query, "value": query}
+		templateVar["current"] = current
+		templateVar["options"] = []any{current}
+	})
+}
+
+// migrateSchemaV28 converts singlestat panels to stat and removes the deprecated variable tags
+func migrateSchemaV28(dashboard map[string]any) {
+	forEachPanel(dashboard, func(panel map[string]any) {
+		if panel["type"] == "singlestat" || panel["type"] == "grafana-singlestat-panel" {
+			migrateSinglestatPanel(panel)
+		}
+	})
+	forEachTemplateVar(dashboard, func(templateVar map[string]any) {
+		delete(templateVar, "tags")
+		delete(templateVar, "tagsQuery")
+		delete(templateVar, "tagValuesQuery")
+		delete(templateVar, "useTags")
+	})
+}
+
+// migrateSchemaV29 refreshes query variables on dashboard load and drops their stale options
+func migrateSchemaV29(dashboard map[string]any) {
+	forEachTemplateVar(dashboard, func(templateVar map[string]any) {
+		if templateVar["type"] != "query" {
+			return
+		}
+		if refresh, _ := templateVar["refresh"].(float64); refresh == 0 {
+			templateVar["refresh"] = 1
+		}
+		templateVar["options"] = []any{}
+	})
+}
+
+// migrateSchemaV33 replaces datasource names with datasource references. The datasources of --grafana-url or
+// --datasource-provisioning resolve the names to their UID and type, like Grafana does; unknown names are kept as an
+// untyped uid, which is what Grafana does for unknown datasources.
+func migrateSchemaV33(dashboard map[string]any) {
+	forEachPanel(dashboard, func(panel map[string]any) {
+		if _, ok := panel["datasource"]; ok {
+			panel["datasource"] = datasourceRef(panel["datasource"])
+		}
+		targets, _ := panel["targets"].([]any)
+		for _, t := range targets {
+			if target, ok := t.(map[string]any); ok {
+				if _, ok := target["datasource"]; ok {
+					target["datasource"] = datasourceRef(target["datasource"])
+				}
+			}
+		}
+	})
+	forEachTemplateVar(dashboard, func(templateVar map[string]any) {
+		if _, ok := templateVar["datasource"]; ok {
+			templateVar["datasource"] = datasourceRef(templateVar["datasource"])
+		}
+	})
+}
+
+func datasourceRef(datasource any) any {
+	name, ok := datasource.(string)
+	if !ok || name == "" {
+		return datasource
+	}
+	if name == "default" {
+		return nil
+	}
+	if ds, ok := grafanaDatasources[name]; ok && ds.UID != "" {
+		return map[string]any{"type": ds.Type, "uid": ds.UID}
+	}
+	return map[string]any{"uid": name}
+}
+
+// migrateSchemaV37 normalizes the hidden legend to showLegend: false
+func migrateSchemaV37(dashboard map[string]any) {
+	forEachPanel(dashboard, func(panel map[string]any) {
+		options, _ := panel["options"].(map[string]any)
+		legend, ok := options["legend"].(map[string]any)
+		if !ok {
+			return
+		}
+		if legend["displayMode"] == "hidden" || legend["showLegend"] == false {
+			legend["displayMode"] = "list"
+			legend["showLegend"] = false
+		} else {
+			legend["showLegend"] = true
+		}
+	})
+}
+
+// migrateAngularPanel converts the deprecated Angular panels still present after the schema migrations
+func migrateAngularPanel(panel map[string]any) {
+	switch panel["type"] {
+	case "graph":
+		migrateGraphPanel(panel)
+	case "singlestat", "grafana-singlestat-panel":
+		migrateSinglestatPanel(panel)
+	}
+}
+
+// migrateGraphPanel converts a graph panel to timeseries, carrying over the legend, unit and decimals
+func migrateGraphPanel(panel map[string]any) {
+	panel["type"] = "timeseries"
+
+	legendOptions := map[string]any{"showLegend": true, "displayMode": "list", "placement": "bottom"}
+	if legend, ok := panel["legend"].(map[string]any); ok {
+		if show, ok := legend["show"].(bool); ok {
+			legendOptions["showLegend"] = show
+		}
+		if alignAsTable, _ := legend["alignAsTable"].(bool); alignAsTable {
+			legendOptions["displayMode"] = "table"
+		}
+		if rightSide, _ := legend["rightSide"].(bool); rightSide {
+			legendOptions["placement"] = "right"
+		}
+	}
+	options := ensureMap(panel, "options")
+	options["legend"] = legendOptions
+
+	defaults := ensureMap(ensureMap(panel, "fieldConfig"), "defaults")
+	if yaxes, ok := panel["yaxes"].([]any); ok && len(yaxes) > 0 {
+		if yaxis, ok := yaxes[0].(map[string]any); ok {
+			if format, ok := yaxis["format"].(string); ok && format != "" {
+				defaults["unit"] = format
+			}
+			if decimals, ok := yaxis["decimals"].(float64); ok {
+				defaults["decimals"] = decimals
+			}
+		}
+	}
+	if decimals, ok := panel["decimals"].(float64); ok {
+		defaults["decimals"] = decimals
+	}
+
+	for _, key := range []string{"legend", "yaxes", "xaxis", "lines", "bars", "points", "stack", "fill", "linewidth", "aliasColors", "seriesOverrides", "decimals", "renderer"} {
+		delete(panel, key)
+	}
+}
+
+var singlestatCalculations = map[string]string{
+	"avg":     "mean",
+	"current": "lastNotNull",
+	"total":   "sum",
+	"max":     "max",
+	"min":     "min",
+	"first":   "firstNotNull",
+	"delta":   "delta",
+	"diff":    "diff",
+	"range":   "range",
+}
+
+// migrateSinglestatPanel converts a singlestat panel to stat, carrying over the reducer, unit and decimals
+func migrateSinglestatPanel(panel map[string]any) {
+	panel["type"] = "stat"
+
+	calculation := "lastNotNull"
+	if valueName, ok := panel["valueName"].(string); ok {
+		if mapped, ok := singlestatCalculations[valueName]; ok {
+			calculation = mapped
+		}
+	}
+	options := ensureMap(panel, "options")
+	options["reduceOptions"] = map[string]any{"calcs": []any{calculation}, "fields": "", "values": false}
+
+	defaults := ensureMap(ensureMap(panel, "fieldConfig"), "defaults")
+	if format, ok := panel["format"].(string); ok && format != "" {
+		defaults["unit"] = format
+	}
+	if decimals, ok := panel["decimals"].(float64); ok {
+		defaults["decimals"] = decimals
+	}
+
+	for _, key := range []string{"valueName", "format", "decimals", "sparkline", "gauge", "colorBackground", "colorValue", "colors", "thresholds", "valueFontSize", "prefix", "postfix"} {
+		delete(panel, key)
+	}
+}
+
+func ensureMap(parent map[string]any, key string) map[string]any {
+	if m, ok := parent[key].(map[string]any); ok {
+		return m
+	}
+	m := map[string]any{}
+	parent[key] = m
+	return m
+}
+
+// supportedSchemaMigrations lists the schema versions with an offline migration, for the help output
+func supportedSchemaMigrations() []int {
+	versions := make([]int, 0, len(schemaMigrations))
+	for version := range schemaMigrations {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	return versions
+}
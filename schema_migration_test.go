@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeJSON decodes a JSON fixture, and normalizes a value built in Go to what it decodes to
+func decodeJSON(t *testing.T, value any) any {
+	t.Helper()
+	data, ok := value.(string)
+	if !ok {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = string(encoded)
+	}
+	var decoded any
+	if err := json.Unmarshal([]byte(data), &decoded); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return decoded
+}
+
+func TestSchemaMigrations(t *testing.T) {
+	previous := grafanaDatasources
+	defer func() { grafanaDatasources = previous }()
+	grafanaDatasources = indexDatasources([]provisionedDatasource{{UID: "prom-eu", Name: "Prom EU", Type: "prometheus"}})
+
+	tests := []struct {
+		name    string
+		migrate func(map[string]any)
+		input   string
+		want    string
+	}{
+		{
+			name: "v14 shared crosshair", migrate: migrateSchemaV14,
+			input: `{"sharedCrosshair": true}`,
+			want:  `{"graphTooltip": 1}`,
+		},
+		{
+			name: "v14 no shared crosshair", migrate: migrateSchemaV14,
+			input: `{}`,
+			want:  `{"graphTooltip": 0}`,
+		},
+		{
+			name: "v16 rows to grid", migrate: migrateSchemaV16,
+			input: `{"rows": [
+				{"title": "A", "showTitle": true, "height": "250px", "panels": [{"id": 1, "span": 6}, {"id": 2, "span": 6}]},
+				{"title": "B", "collapse": true, "repeat": "job", "panels": [{"id": 3, "span": 12, "height": 100}]}]}`,
+			want: `{"panels": [
+				{"id": 4, "type": "row", "title": "A", "collapsed": false, "panels": [], "gridPos": {"x": 0, "y": 0, "w": 24, "h": 1}},
+				{"id": 1, "gridPos": {"x": 0, "y": 1, "w": 12, "h": 7}},
+				{"id": 2, "gridPos": {"x": 12, "y": 1, "w": 12, "h": 7}},
+				{"id": 5, "type": "row", "title": "B", "collapsed": true, "repeat": "job", "gridPos": {"x": 0, "y": 8, "w": 24, "h": 1},
+				 "panels": [{"id": 3, "gridPos": {"x": 0, "y": 9, "w": 24, "h": 3}}]}]}`,
+		},
+		{
+			name: "v16 single row without title", migrate: migrateSchemaV16,
+			input: `{"rows": [{"panels": [{"id": 1}, {"id": 2, "span": 10}]}]}`,
+			want: `{"panels": [
+				{"id": 1, "gridPos": {"x": 0, "y": 0, "w": 8, "h": 7}},
+				{"id": 2, "gridPos": {"x": 0, "y": 7, "w": 20, "h": 7}}]}`,
+		},
+		{
+			name: "v17 min span", migrate: migrateSchemaV17,
+			input: `{"panels": [{"minSpan": 4}, {"minSpan": 5}, {"id": 3}]}`,
+			want:  `{"panels": [{"maxPerRow": 6}, {"maxPerRow": 4}, {"id": 3}]}`,
+		},
+		{
+			name: "v19 panel links", migrate: migrateSchemaV19,
+			input: `{"panels": [{"links": [
+				{"dashUri": "db/cpu", "keepTime": true, "includeVars": true, "title": "CPU", "targetBlank": true},
+				{"dashboard": "Memory", "params": "var-job=api", "name": "Memory"},
+				{"url": "https://example.com/?a=1", "keepTime": true}]}]}`,
+			want: `{"panels": [{"links": [
+				{"url": "dashboard/db/cpu?$__url_time_range&$__all_variables", "title": "CPU", "targetBlank": true},
+				{"url": "dashboards?query=Memory&var-job=api", "title": "Memory"},
+				{"url": "https://example.com/?a=1&$__url_time_range"}]}]}`,
+		},
+		{
+			name: "v20 data link variables", migrate: migrateSchemaV20,
+			input: `{"panels": [{"options": {"dataLinks": [{"url": "/d?s=${__series_name}&f=$__field_name&t=${__value_time}"}]}}]}`,
+			want:  `{"panels": [{"options": {"dataLinks": [{"url": "/d?s=${__series.name}&f=${__field.name}&t=${__value.time}"}]}}]}`,
+		},
+		{
+			name: "v22 table style alignment", migrate: migrateSchemaV22,
+			input: `{"panels": [{"type": "table", "styles": [{"pattern": "a"}, {"pattern": "b", "align": "left"}]}]}`,
+			want:  `{"panels": [{"type": "table", "styles": [{"pattern": "a", "align": "auto"}, {"pattern": "b", "align": "left"}]}]}`,
+		},
+		{
+			name: "v24 angular tables", migrate: migrateSchemaV24,
+			input: `{"panels": [{"type": "table", "styles": []}, {"type": "table"}]}`,
+			want:  `{"panels": [{"type": "table-old", "styles": []}, {"type": "table"}]}`,
+		},
+		{
+			name: "v26 text2 panel", migrate: migrateSchemaV26,
+			input: `{"panels": [{"type": "row", "panels": [{"type": "text2", "angular": "x", "content": "hi"}]}]}`,
+			want:  `{"panels": [{"type": "row", "panels": [{"type": "text", "content": "hi"}]}]}`,
+		},
+		{
+			name: "v27 constant variables", migrate: migrateSchemaV27,
+			input: `{"templating": {"list": [{"type": "constant", "name": "env", "query": "prod"}, {"type": "query", "name": "job"}]}}`,
+			want: `{"templating": {"list": [
+				{"type": "constant", "name": "env", "query": "prod", "hide": 2,
+				 "current": {"text": "prod", "value": "prod"}, "options": [{"text": "prod", "value": "prod"}]},
+				{"type": "query", "name": "job"}]}}`,
+		},
+		{
+			name: "v28 singlestat and variable tags", migrate: migrateSchemaV28,
+			input: `{"panels": [{"type": "singlestat", "valueName": "avg", "format": "percent"}],
+				"templating": {"list": [{"name": "job", "tags": [], "tagsQuery": "q", "tagValuesQuery": "q", "useTags": true}]}}`,
+			want: `{"panels": [{"type": "stat", "options": {"reduceOptions": {"calcs": ["mean"], "fields": "", "values": false}},
+				"fieldConfig": {"defaults": {"unit": "percent"}}}],
+				"templating": {"list": [{"name": "job"}]}}`,
+		},
+		{
+			name: "v29 query variable refresh", migrate: migrateSchemaV29,
+			input: `{"templating": {"list": [{"type": "query", "refresh": 0, "options": [{"value": "a"}]}, {"type": "query", "refresh": 2}, {"type": "custom", "options": [{"value": "a"}]}]}}`,
+			want:  `{"templating": {"list": [{"type": "query", "refresh": 1, "options": []}, {"type": "query", "refresh": 2, "options": []}, {"type": "custom", "options": [{"value": "a"}]}]}}`,
+		},
+		{
+			name: "v33 datasource references", migrate: migrateSchemaV33,
+			input: `{"panels": [{"datasource": "Prom EU", "targets": [{"datasource": "Other"}, {"datasource": {"uid": "x"}}]},
+				{"datasource": "default"}, {"datasource": null}],
+				"templating": {"list": [{"datasource": "prom-eu"}]}}`,
+			want: `{"panels": [{"datasource": {"type": "prometheus", "uid": "prom-eu"}, "targets": [{"datasource": {"uid": "Other"}}, {"datasource": {"uid": "x"}}]},
+				{"datasource": null}, {"datasource": null}],
+				"templating": {"list": [{"datasource": {"type": "prometheus", "uid": "prom-eu"}}]}}`,
+		},
+		{
+			name: "v37 legends", migrate: migrateSchemaV37,
+			input: `{"panels": [{"options": {"legend": {"displayMode": "hidden"}}}, {"options": {"legend": {"displayMode": "table"}}}, {"options": {}}]}`,
+			want:  `{"panels": [{"options": {"legend": {"displayMode": "list", "showLegend": false}}}, {"options": {"legend": {"displayMode": "table", "showLegend": true}}}, {"options": {}}]}`,
+		},
+		{
+			name: "graph panel", migrate: func(dashboard map[string]any) { forEachPanel(dashboard, migrateAngularPanel) },
+			input: `{"panels": [{"type": "graph", "legend": {"show": false, "alignAsTable": true, "rightSide": true},
+				"yaxes": [{"format": "bytes", "decimals": 1}], "lines": true, "seriesOverrides": []}]}`,
+			want: `{"panels": [{"type": "timeseries",
+				"options": {"legend": {"showLegend": false, "displayMode": "table", "placement": "right"}},
+				"fieldConfig": {"defaults": {"unit": "bytes", "decimals": 1}}}]}`,
+		},
+		{
+			name: "singlestat panel", migrate: func(dashboard map[string]any) { forEachPanel(dashboard, migrateAngularPanel) },
+			input: `{"panels": [{"type": "grafana-singlestat-panel", "valueName": "unknown", "decimals": 2, "sparkline": {}}]}`,
+			want: `{"panels": [{"type": "stat", "options": {"reduceOptions": {"calcs": ["lastNotNull"], "fields": "", "values": false}},
+				"fieldConfig": {"defaults": {"decimals": 2}}}]}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dashboard := decodeJSON(t, test.input).(map[string]any)
+			test.migrate(dashboard)
+			if got, want := decodeJSON(t, dashboard), decodeJSON(t, test.want); !reflect.DeepEqual(got, want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(want)
+				t.Errorf("got  %s\nwant %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestUpgradeGrafanaSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "too old",
+			input:   `{"schemaVersion": 12}`,
+			wantErr: "schema version 12 is not supported",
+		},
+		{
+			name:    "no version",
+			input:   `{}`,
+			wantErr: "schema version 0 is not supported",
+		},
+		{
+			name:  "every step",
+			input: `{"schemaVersion": 13, "rows": [{"panels": [{"id": 1, "span": 12, "type": "graph"}]}], "templating": {"list": [{"type": "query"}]}}`,
+			want: `{"schemaVersion": 41, "graphTooltip": 0, "templating": {"list": [{"type": "query", "refresh": 1, "options": []}]},
+				"panels": [{"id": 1, "type": "timeseries", "gridPos": {"x": 0, "y": 0, "w": 24, "h": 7},
+					"options": {"legend": {"showLegend": true, "displayMode": "list", "placement": "bottom"}},
+					"fieldConfig": {"defaults": {}}}]}`,
+		},
+		{
+			name:  "latest only converts the angular panels",
+			input: `{"schemaVersion": 41, "sharedCrosshair": true, "panels": [{"type": "singlestat"}]}`,
+			want: `{"schemaVersion": 41, "sharedCrosshair": true,
+				"panels": [{"type": "stat", "options": {"reduceOptions": {"calcs": ["lastNotNull"], "fields": "", "values": false}}, "fieldConfig": {"defaults": {}}}]}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dashboard := decodeJSON(t, test.input).(map[string]any)
+			err := upgradeGrafanaSchema(dashboard)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("upgrade failed: %v", err)
+			}
+			if got, want := decodeJSON(t, dashboard), decodeJSON(t, test.want); !reflect.DeepEqual(got, want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(want)
+				t.Errorf("got  %s\nwant %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The migration state records, for every input dashboard, the content hash and the last stage it reached.
+// It is an append-only JSON lines journal so that the progress survives a crash without rewriting the whole
+// file after every dashboard; the last entry of a dashboard wins. The journal is compacted at the end of a run.
+// Every entry also records a fingerprint of the options that change the output, so that --resume migrates the
+// dashboards again after one of them changed.
+
+const (
+	stateFileName = "migration-state.jsonl"
+
+	stageExported = "exported"
+	stageMigrated = "migrated"
+)
+
+type dashboardState struct {
+	InputPath   string    `json:"inputPath"` // relative path from input directory
+	ContentHash string    `json:"contentHash"`
+	Stage       string    `json:"stage"`
+	UID         string    `json:"uid,omitempty"`
+	GrafanaFile string    `json:"grafanaFile,omitempty"` // relative path from output directory
+	PersesFile  string    `json:"persesFile,omitempty"`  // relative path from output directory
+	Options     string    `json:"options,omitempty"`     // fingerprint of the options, see optionsFingerprint
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// fingerprintFlags are the flags that change the upgraded or migrated dashboards. The naming strategy and the output
+// format move the output files and are checked with their paths.
+var fingerprintFlags = []string{
+	"schema-upgrade", "migration-backend", "use-default-perses-datasource", "project-from-folder", "default-project",
+	"project-mapping", "fix-variables",
+}
+
+// fingerprintFiles are the flags naming a file whose content changes the migrated dashboards
+var fingerprintFiles = []string{"datasource-mapping", "promql-rules", "transforms"}
+
+type migrationState struct {
+	outputDir string
+	options   string // fingerprint of the options of this run
+	entries   map[string]dashboardState
+	journal   *os.File
+	mutex     sync.Mutex
+}
+
+// loadMigrationState reads the state journal of the output directory, if any, and opens it for appending
+func loadMigrationState(outputDir string) (*migrationState, error) {
+	state := &migrationState{
+		outputDir: outputDir,
+		entries:   make(map[string]dashboardState),
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	path := filepath.Join(outputDir, stateFileName)
+	if file, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry dashboardState
+			// A truncated last line is expected if the previous run was killed while writing
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			state.entries[entry.InputPath] = entry
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read migration state %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open migration state %s: %v", path, err)
+	}
+
+	journal, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open migration state %s: %v", path, err)
+	}
+	state.journal = journal
+	return state, nil
+}
+
+func (s *migrationState) get(inputPath string) (dashboardState, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[inputPath]
+	return entry, ok
+}
+
+// record stores the stage reached by a dashboard and appends it to the journal
+func (s *migrationState) record(dashboard *DashboardInfo, stage string) error {
+	entry := dashboardState{
+		InputPath:   dashboard.RelativePath,
+		ContentHash: dashboard.ContentHash,
+		Stage:       stage,
+		UID:         dashboard.UID,
+		GrafanaFile: s.relativePath(dashboard.GrafanaFile),
+		PersesFile:  s.relativePath(dashboard.PersesFile),
+		Options:     s.options,
+		UpdatedAt:   time.Now().UTC(),
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries[entry.InputPath] = entry
+	_, err = s.journal.Write(append(line, '\n'))
+	return err
+}
+
+// absolutePath resolves a path stored in the state against the output directory
+func (s *migrationState) absolutePath(path string) string {
+	if path == "" {
+		return ""
+	}
+	return filepath.Join(s.outputDir, path)
+}
+
+func (s *migrationState) relativePath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if rel, err := filepath.Rel(s.outputDir, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// close compacts the journal to a single entry per dashboard, sorted by input path
+func (s *migrationState) close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.journal.Close(); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(s.entries))
+	for path := range s.entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	path := filepath.Join(s.outputDir, stateFileName)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, p := range paths {
+		line, err := json.Marshal(s.entries[p])
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := writer.Write(append(line, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// optionsFingerprint hashes the options that change the output: the values of fingerprintFlags, the content of the
+// fingerprintFiles and the known Grafana datasources, which resolve the datasource references
+func optionsFingerprint() (string, error) {
+	hash := sha256.New()
+	for _, name := range fingerprintFlags {
+		fmt.Fprintf(hash, "%s=%s\n", name, flag.Lookup(name).Value)
+	}
+	for _, name := range fingerprintFiles {
+		path := flag.Lookup(name).Value.String()
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read --%s: %v", name, err)
+		}
+		fmt.Fprintf(hash, "%s=%x\n", name, sha256.Sum256(data))
+	}
+
+	references := make([]string, 0, len(grafanaDatasources))
+	for reference := range grafanaDatasources {
+		references = append(references, reference)
+	}
+	sort.Strings(references)
+	for _, reference := range references {
+		ds := grafanaDatasources[reference]
+		fmt.Fprintf(hash, "datasource %s=%s/%s/%s/%t\n", reference, ds.UID, ds.Name, ds.Type, ds.Default)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashFile returns the hex encoded SHA-256 of the file content
+func hashFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func fileExists(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const stateTestDashboard = `{"title": "%s", "uid": "%s", "schemaVersion": 39, "panels": [
+	{"type": "timeseries", "title": "Up", "gridPos": {"x": 0, "y": 0, "w": 12, "h": 8}, "targets": [{"refId": "A", "expr": "up"}]}]}`
+
+// setFlag sets a flag of a test and restores it after it
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	previous := flag.Lookup(name).Value.String()
+	t.Cleanup(func() { _ = flag.Set(name, previous) })
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeStateTestDashboard(t *testing.T, inputDir, name, title string) {
+	t.Helper()
+	content := fmt.Sprintf(stateTestDashboard, title, name)
+	if err := os.WriteFile(filepath.Join(inputDir, name+".json"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readJournal returns the entries of the state journal, line by line
+func readJournal(t *testing.T, outputDir string) []dashboardState {
+	t.Helper()
+	file, err := os.Open(filepath.Join(outputDir, stateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []dashboardState
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry dashboardState
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid journal line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestMigrationStateJournal(t *testing.T) {
+	outputDir := t.TempDir()
+	journal := strings.Join([]string{
+		`{"inputPath": "b.json", "contentHash": "1", "stage": "exported", "grafanaFile": "grafana-schema-latest/b.json"}`,
+		`{"inputPath": "a.json", "contentHash": "2", "stage": "migrated", "persesFile": "perses/a.json"}`,
+		`{"inputPath": "b.json", "contentHash": "1", "stage": "migrated", "persesFile": "perses/b.json"}`,
+		// Killed while writing the last line
+		`{"inputPath": "a.json", "contentHash": "3", "sta`,
+	}, "\n")
+	if err := os.WriteFile(filepath.Join(outputDir, stateFileName), []byte(journal), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := loadMigrationState(outputDir)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	// The last complete entry of a dashboard wins
+	if entry, ok := state.get("a.json"); !ok || entry.ContentHash != "2" || entry.Stage != stageMigrated {
+		t.Errorf("a.json = %+v, want the migrated entry before the truncated line", entry)
+	}
+	if entry, ok := state.get("b.json"); !ok || entry.Stage != stageMigrated || state.absolutePath(entry.PersesFile) != filepath.Join(outputDir, "perses", "b.json") {
+		t.Errorf("b.json = %+v, want the later migrated entry", entry)
+	}
+
+	state.options = "options"
+	dashboard := &DashboardInfo{RelativePath: "c.json", ContentHash: "4", UID: "c", GrafanaFile: filepath.Join(outputDir, "grafana-schema-latest", "c.json")}
+	if err := state.record(dashboard, stageExported); err != nil {
+		t.Fatalf("record failed: %v", err)
+	}
+	if err := state.close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// close compacts the journal to the last entry of every dashboard, sorted by input path
+	var paths, stages []string
+	for _, entry := range readJournal(t, outputDir) {
+		paths = append(paths, entry.InputPath)
+		stages = append(stages, entry.Stage)
+	}
+	if want := []string{"a.json", "b.json", "c.json"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("compacted journal has %q, want %q", paths, want)
+	}
+	if want := []string{stageMigrated, stageMigrated, stageExported}; !reflect.DeepEqual(stages, want) {
+		t.Errorf("compacted stages are %q, want %q", stages, want)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, stateFileName+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary journal left behind: %v", err)
+	}
+
+	state, err = loadMigrationState(outputDir)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	defer state.close()
+	if entry, _ := state.get("c.json"); entry.GrafanaFile != filepath.Join("grafana-schema-latest", "c.json") || entry.Options != "options" {
+		t.Errorf("c.json = %+v, want the recorded entry with a relative path", entry)
+	}
+}
+
+func TestOptionsFingerprint(t *testing.T) {
+	setDatasourceOptions(t, nil, true)
+	rulesFile := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(rulesFile, []byte("rules: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "promql-rules", rulesFile)
+
+	fingerprint := func() string {
+		t.Helper()
+		value, err := optionsFingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	base := fingerprint()
+
+	// Every flag changing the output changes the fingerprint, the others don't
+	for name, value := range map[string]string{"fix-variables": "false", "default-project": "other", "use-default-perses-datasource": "false"} {
+		t.Run(name, func(t *testing.T) {
+			setFlag(t, name, value)
+			if fingerprint() == base {
+				t.Errorf("changing --%s kept the fingerprint", name)
+			}
+		})
+	}
+	t.Run("concurrency", func(t *testing.T) {
+		setFlag(t, "concurrency", "8")
+		if fingerprint() != base {
+			t.Error("changing --concurrency changed the fingerprint")
+		}
+	})
+	t.Run("file content", func(t *testing.T) {
+		if err := os.WriteFile(rulesFile, []byte("rules:\n  - metric: {from: a, to: b}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if fingerprint() == base {
+			t.Error("changing the content of --promql-rules kept the fingerprint")
+		}
+		if err := os.WriteFile(rulesFile, []byte("rules: []\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("missing file", func(t *testing.T) {
+		setFlag(t, "transforms", filepath.Join(t.TempDir(), "missing.yaml"))
+		if _, err := optionsFingerprint(); err == nil || !strings.Contains(err.Error(), "failed to read --transforms") {
+			t.Errorf("error = %v, want a read error", err)
+		}
+	})
+	t.Run("datasources", func(t *testing.T) {
+		grafanaDatasources = indexDatasources([]provisionedDatasource{{UID: "prom", Name: "Prometheus", Type: "prometheus"}})
+		defer func() { grafanaDatasources = nil }()
+		if fingerprint() == base {
+			t.Error("known datasources kept the fingerprint")
+		}
+	})
+	if fingerprint() != base {
+		t.Error("the fingerprint is not stable")
+	}
+}
+
+func TestResume(t *testing.T) {
+	setDatasourceOptions(t, nil, true)
+	setNamingOptions(t, namingTitle, collisionSuffix)
+	previousOutputDir := *outputDir
+	defer func() { *outputDir = previousOutputDir }()
+	*outputDir = t.TempDir()
+	setFlag(t, "resume", "true")
+
+	inputDir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		writeStateTestDashboard(t, inputDir, name, "Dashboard "+name)
+	}
+
+	// run migrates the input directory and returns the status of every dashboard
+	run := func(t *testing.T) map[string]string {
+		t.Helper()
+		summary, err := runMigrationPipeline(inputDir, filepath.Join(*outputDir, "grafana-schema-latest"), filepath.Join(*outputDir, "perses"))
+		if err != nil {
+			t.Fatalf("migration failed: %v", err)
+		}
+		statuses := make(map[string]string)
+		for _, dashboard := range summary.Dashboards {
+			statuses[dashboard.InputPath] = dashboard.Status
+		}
+		return statuses
+	}
+	migrated := map[string]string{"a.json": statusSucceeded, "b.json": statusSucceeded, "c.json": statusSucceeded}
+	skipped := map[string]string{"a.json": statusSkipped, "b.json": statusSkipped, "c.json": statusSkipped}
+
+	steps := []struct {
+		name   string
+		change func(t *testing.T)
+		want   map[string]string
+	}{
+		{name: "first run", change: func(t *testing.T) {}, want: migrated},
+		{name: "unchanged", change: func(t *testing.T) {}, want: skipped},
+		{
+			name:   "changed input file",
+			change: func(t *testing.T) { writeStateTestDashboard(t, inputDir, "b", "Dashboard b v2") },
+			want:   map[string]string{"a.json": statusSkipped, "b.json": statusSucceeded, "c.json": statusSkipped},
+		},
+		{
+			name: "truncated last line",
+			change: func(t *testing.T) {
+				// The compacted journal is sorted, the entry of c.json is the last line
+				path := filepath.Join(*outputDir, stateFileName)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, data[:len(data)-20], 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"a.json": statusSkipped, "b.json": statusSkipped, "c.json": statusSucceeded},
+		},
+		{
+			name:   "changed option",
+			change: func(t *testing.T) { setFlag(t, "fix-variables", "false") },
+			want:   migrated,
+		},
+		{
+			name: "changed option file",
+			change: func(t *testing.T) {
+				rulesFile := filepath.Join(t.TempDir(), "rules.yaml")
+				if err := os.WriteFile(rulesFile, []byte("rules: []\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				setFlag(t, "promql-rules", rulesFile)
+			},
+			want: migrated,
+		},
+		{
+			name: "deleted output",
+			change: func(t *testing.T) {
+				if err := os.Remove(filepath.Join(*outputDir, "perses", "dashboard-a.json")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: map[string]string{"a.json": statusSucceeded, "b.json": statusSkipped, "c.json": statusSkipped},
+		},
+	}
+	// The steps build on each other: the options set by a step stay set for the later ones
+	for _, step := range steps {
+		step.change(t)
+		if got := run(t); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("%s: statuses = %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	entries := readJournal(t, *outputDir)
+	if len(entries) != 3 {
+		t.Fatalf("journal has %d entries after the last run, want 3", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Stage != stageMigrated || !fileExists(filepath.Join(*outputDir, entry.PersesFile)) {
+			t.Errorf("journal entry %+v doesn't point to a migrated dashboard", entry)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// After the conversion, every migrated dashboard goes through a pipeline of transformers before it is analyzed,
+// validated and written. The built-in transformers apply the PromQL rules, audit the variables, map the datasources
+// and set the project; a transforms file selects and orders them, and adds the transformers compiled in with
+// registerTransformer:
+//
+//	transforms:
+//	  - name: promql-rules
+//	  - name: variables
+//	  - name: datasources
+//	  - name: team-labels
+//	    options: {team: sre}
+//	  - name: project
+//
+// A transformer compiled in is a Go file in this package that registers its factory from init:
+//
+//	func init() {
+//		registerTransformer("team-labels", func(options map[string]any) (Transformer, error) {
+//			return &teamLabels{team: fmt.Sprint(options["team"])}, nil
+//		})
+//	}
+
+// Transformer rewrites a migrated Perses dashboard in place
+type Transformer interface {
+	Name() string
+	Transform(dashboard *persesv1.Dashboard, ctx *transformContext) error
+}
+
+// transformerFactory creates a transformer with the options given in the transforms file, nil without options
+type transformerFactory func(options map[string]any) (Transformer, error)
+
+// transformContext is what a transformer knows about the dashboard besides its Perses definition
+type transformContext struct {
+	Grafana   []byte // the Grafana dashboard with the latest schema, nil if it couldn't be read
+	InputPath string // relative path from the input directory
+	Project   string // Perses project of the dashboard, see projectFor
+
+	dashboard *DashboardInfo
+}
+
+// Warnf records a warning in the migration report of the dashboard
+func (c *transformContext) Warnf(format string, args ...any) {
+	c.dashboard.warnf(format, args...)
+}
+
+// defaultTransforms is the pipeline without a transforms file
+var defaultTransforms = []string{"promql-rules", "variables", "datasources", "project"}
+
+// transformerRegistry holds the factories of the built-in transformers and of those compiled in
+var transformerRegistry = map[string]transformerFactory{}
+
+// transformers is the pipeline of every dashboard, set from --transforms or defaultTransforms
+var transformers []Transformer
+
+// registerTransformer adds a transformer to the registry. It is meant to be called from init functions and panics
+// on duplicate names.
+func registerTransformer(name string, factory transformerFactory) {
+	if _, ok := transformerRegistry[name]; ok {
+		panic(fmt.Sprintf("transformer %s is registered twice", name))
+	}
+	transformerRegistry[name] = factory
+}
+
+func init() {
+	registerTransformer("promql-rules", func(map[string]any) (Transformer, error) { return promqlRulesTransformer{}, nil })
+	registerTransformer("variables", func(map[string]any) (Transformer, error) { return variablesTransformer{}, nil })
+	registerTransformer("datasources", func(map[string]any) (Transformer, error) { return datasourcesTransformer{}, nil })
+	registerTransformer("project", func(map[string]any) (Transformer, error) { return projectTransformer{}, nil })
+}
+
+// transformsConfig is the format of --transforms
+type transformsConfig struct {
+	Transforms []transformConfig `yaml:"transforms"`
+}
+
+type transformConfig struct {
+	Name    string         `yaml:"name"`
+	Options map[string]any `yaml:"options"`
+}
+
+// loadTransforms creates the pipeline of a transforms file, or the default pipeline without a file
+func loadTransforms(path string) ([]Transformer, error) {
+	var file transformsConfig
+	if path == "" {
+		for _, name := range defaultTransforms {
+			file.Transforms = append(file.Transforms, transformConfig{Name: name})
+		}
+	} else {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read transforms: %v", err)
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse transforms %s: %v", path, err)
+		}
+	}
+
+	var pipeline []Transformer
+	for i, transform := range file.Transforms {
+		factory, ok := transformerRegistry[transform.Name]
+		if !ok {
+			return nil, fmt.Errorf("transform %d: unknown transformer %q, available: %s", i+1, transform.Name, strings.Join(registeredTransformers(), ", "))
+		}
+		transformer, err := factory(transform.Options)
+		if err != nil {
+			return nil, fmt.Errorf("transform %d: failed to create transformer %s: %v", i+1, transform.Name, err)
+		}
+		pipeline = append(pipeline, transformer)
+	}
+	return pipeline, nil
+}
+
+// registeredTransformers returns the names of the registered transformers, sorted
+func registeredTransformers() []string {
+	names := make([]string, 0, len(transformerRegistry))
+	for name := range transformerRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// transformerNames returns the names of a pipeline, in order
+func transformerNames(pipeline []Transformer) []string {
+	names := make([]string, 0, len(pipeline))
+	for _, transformer := range pipeline {
+		names = append(names, transformer.Name())
+	}
+	return names
+}
+
+// hasTransformer tells whether a pipeline runs the transformer of the given name
+func hasTransformer(pipeline []Transformer, name string) bool {
+	for _, transformer := range pipeline {
+		if transformer.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTransforms runs a migrated dashboard through the transformers. A dashboard that doesn't decode as a Perses
+// dashboard is kept as migrated with a warning, the validation reports what is wrong with it.
+func applyTransforms(dashboard *DashboardInfo, grafanaData, jsonData []byte) ([]byte, error) {
+	if len(transformers) == 0 {
+		return jsonData, nil
+	}
+
+	var persesDashboard persesv1.Dashboard
+	if err := json.Unmarshal(jsonData, &persesDashboard); err != nil {
+		dashboard.warnf("Failed to parse the migrated %s, it is kept without transforms: %v", dashboard.RelativePath, err)
+		return jsonData, nil
+	}
+	ctx := &transformContext{
+		Grafana:   grafanaData,
+		InputPath: dashboard.RelativePath,
+		Project:   dashboard.Project,
+		dashboard: dashboard,
+	}
+	for _, transformer := range transformers {
+		if err := transformer.Transform(&persesDashboard, ctx); err != nil {
+			return nil, fmt.Errorf("transformer %s failed: %v", transformer.Name(), err)
+		}
+	}
+	return json.MarshalIndent(&persesDashboard, "", "  ")
+}
+
+// promqlRulesTransformer applies the rules of --promql-rules and records the rewrites in the report
+type promqlRulesTransformer struct{}
+
+func (promqlRulesTransformer) Name() string {
+	return "promql-rules"
+}
+
+func (promqlRulesTransformer) Transform(dashboard *persesv1.Dashboard, ctx *transformContext) error {
+	if promqlRules != nil {
+		ctx.dashboard.PromQLRewrites = append(ctx.dashboard.PromQLRewrites, rewritePromQL(dashboard)...)
+	}
+	return nil
+}
+
+// variablesTransformer audits the variables against the Grafana templating, fixes them with --fix-variables and
+// reports what can't be converted
+type variablesTransformer struct{}
+
+func (variablesTransformer) Name() string {
+	return "variables"
+}
+
+func (variablesTransformer) Transform(dashboard *persesv1.Dashboard, ctx *transformContext) error {
+	if ctx.Grafana == nil {
+		return nil
+	}
+	var grafana grafanaDashboard
+	if err := json.Unmarshal(ctx.Grafana, &grafana); err != nil {
+		ctx.Warnf("Failed to audit the variables of %s: failed to parse Grafana dashboard: %v", ctx.InputPath, err)
+		return nil
+	}
+	fixes, unsupported := auditVariables(grafana, dashboard, *fixVariables)
+	ctx.dashboard.VariableFixes = append(ctx.dashboard.VariableFixes, fixes...)
+	ctx.dashboard.Unsupported = append(ctx.dashboard.Unsupported, unsupported...)
+	return nil
+}
+
+// datasourcesTransformer maps the datasource selectors with --datasource-mapping, removes their names with
+// --use-default-perses-datasource, or names them like the generated datasources
+type datasourcesTransformer struct{}
+
+func (datasourcesTransformer) Name() string {
+	return "datasources"
+}
+
+func (datasourcesTransformer) Transform(dashboard *persesv1.Dashboard, ctx *transformContext) error {
+	cleanDatasources(dashboard, ctx.InputPath)
+	return nil
+}
+
+// projectTransformer sets metadata.project with --project-from-folder
+type projectTransformer struct{}
+
+func (projectTransformer) Name() string {
+	return "project"
+}
+
+func (projectTransformer) Transform(dashboard *persesv1.Dashboard, ctx *transformContext) error {
+	if *projectFromFolder {
+		dashboard.Metadata.Project = ctx.Project
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+)
+
+// suffixTransformer appends its suffix to the dashboard name, which shows the order of the pipeline
+type suffixTransformer struct {
+	suffix string
+}
+
+func (suffixTransformer) Name() string {
+	return "test-suffix"
+}
+
+func (t suffixTransformer) Transform(dashboard *persesv1.Dashboard, ctx *transformContext) error {
+	if t.suffix == "fail" {
+		return fmt.Errorf("suffix fail")
+	}
+	dashboard.Metadata.Name += "-" + t.suffix
+	ctx.Warnf("Added %s to %s in project %s", t.suffix, ctx.InputPath, ctx.Project)
+	return nil
+}
+
+// registerTestTransformer registers test-suffix for a test
+func registerTestTransformer(t *testing.T) {
+	t.Helper()
+	registerTransformer("test-suffix", func(options map[string]any) (Transformer, error) {
+		suffix, ok := options["suffix"].(string)
+		if !ok {
+			return nil, fmt.Errorf("option suffix is required")
+		}
+		return suffixTransformer{suffix: suffix}, nil
+	})
+	t.Cleanup(func() { delete(transformerRegistry, "test-suffix") })
+}
+
+func TestLoadTransforms(t *testing.T) {
+	registerTestTransformer(t)
+	tests := []struct {
+		name    string
+		file    string // content of the transforms file, none if empty
+		want    []string
+		wantErr string
+	}{
+		{name: "default", want: []string{"promql-rules", "variables", "datasources", "project"}},
+		{
+			name: "selected and ordered",
+			file: "transforms:\n  - name: project\n  - name: test-suffix\n    options: {suffix: a}\n  - name: datasources\n",
+			want: []string{"project", "test-suffix", "datasources"},
+		},
+		{name: "empty", file: "transforms: []\n", want: []string{}},
+		{
+			name:    "unknown transformer",
+			file:    "transforms:\n  - name: variables\n  - name: labels\n",
+			wantErr: `transform 2: unknown transformer "labels", available: datasources, project, promql-rules, test-suffix, variables`,
+		},
+		{
+			name:    "factory error",
+			file:    "transforms:\n  - name: test-suffix\n",
+			wantErr: "transform 1: failed to create transformer test-suffix: option suffix is required",
+		},
+		{name: "invalid YAML", file: "transforms: [", wantErr: "failed to parse transforms"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := ""
+			if test.file != "" {
+				path = filepath.Join(t.TempDir(), "transforms.yaml")
+				if err := os.WriteFile(path, []byte(test.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pipeline, err := loadTransforms(path)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load failed: %v", err)
+			}
+			if names := transformerNames(pipeline); !reflect.DeepEqual(names, test.want) {
+				t.Errorf("pipeline = %q, want %q", names, test.want)
+			}
+		})
+	}
+
+	if _, err := loadTransforms(filepath.Join(t.TempDir(), "missing.yaml")); err == nil || !strings.Contains(err.Error(), "failed to read transforms") {
+		t.Errorf("error of a missing file = %v, want a read error", err)
+	}
+}
+
+func TestRegisterTransformer(t *testing.T) {
+	registerTestTransformer(t)
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a transformer twice didn't panic")
+		}
+	}()
+	registerTransformer("test-suffix", nil)
+}
+
+func TestApplyTransforms(t *testing.T) {
+	previousTransformers := transformers
+	defer func() { transformers = previousTransformers }()
+	const migrated = `{"kind": "Dashboard", "metadata": {"name": "cpu", "project": "team"}, "spec": {"duration": "1h", "panels": {}, "layouts": []}}`
+
+	apply := func(t *testing.T, pipeline []Transformer, jsonData string) (*DashboardInfo, string, error) {
+		t.Helper()
+		transformers = pipeline
+		dashboard := &DashboardInfo{RelativePath: "team/cpu.json", Project: "team"}
+		data, err := applyTransforms(dashboard, nil, []byte(jsonData))
+		if err != nil {
+			return dashboard, "", err
+		}
+		var result map[string]any
+		if err := json.Unmarshal(data, &result); err != nil {
+			t.Fatal(err)
+		}
+		name, _ := lookup(result, "metadata", "name").(string)
+		return dashboard, name, nil
+	}
+
+	// The transformers run in the order of the pipeline and see the context of the dashboard
+	dashboard, name, err := apply(t, []Transformer{suffixTransformer{suffix: "a"}, suffixTransformer{suffix: "b"}}, migrated)
+	if err != nil {
+		t.Fatalf("transforms failed: %v", err)
+	}
+	if name != "cpu-a-b" {
+		t.Errorf("name = %q, want cpu-a-b", name)
+	}
+	if want := []string{"Added a to team/cpu.json in project team", "Added b to team/cpu.json in project team"}; !reflect.DeepEqual(dashboard.Warnings, want) {
+		t.Errorf("warnings = %q, want %q", dashboard.Warnings, want)
+	}
+
+	if _, _, err := apply(t, []Transformer{suffixTransformer{suffix: "a"}, suffixTransformer{suffix: "fail"}}, migrated); err == nil || err.Error() != "transformer test-suffix failed: suffix fail" {
+		t.Errorf("error = %v, want the error of the failed transformer", err)
+	}
+
+	// A dashboard that doesn't decode is kept as migrated
+	const invalid = `{"kind": "Dashboard", "metadata": {"name": "cpu"}, "spec": {"duration": "forever"}}`
+	dashboard, name, err = apply(t, []Transformer{suffixTransformer{suffix: "a"}}, invalid)
+	if err != nil || name != "cpu" || len(dashboard.Warnings) != 1 {
+		t.Errorf("invalid dashboard: name %q, warnings %q, error %v, want it kept with a warning", name, dashboard.Warnings, err)
+	}
+
+	// Without transformers, the migrated dashboard is returned as is
+	transformers = nil
+	if data, err := applyTransforms(&DashboardInfo{}, nil, []byte(invalid)); err != nil || string(data) != invalid {
+		t.Errorf("without transformers = %s, %v, want the dashboard unchanged", data, err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+	"github.com/perses/perses/pkg/model/api/v1/datasource"
+	"github.com/perses/perses/pkg/model/api/v1/utils"
+)
+
+// Every migrated dashboard is validated before it is written, offline, with the checks the Perses API runs when a
+// dashboard is applied. With --plugin-dir, the plugin specs are also checked against the CUE schemas of the plugins
+// with percli lint. Invalid dashboards are written with a warning, or not at all with --reject-invalid.
+
+// variableNameRegexp is the variable name rule of the Perses API: names can't be only a number
+var variableNameRegexp = regexp.MustCompile(`^\w*?[^0-9]\w*$`)
+
+// errInvalidDashboard is returned for invalid dashboards with --reject-invalid
+var errInvalidDashboard = errors.New("the migrated dashboard is not valid")
+
+// pluginSchemaDir is the directory of unpacked plugins given to percli lint; empty without --plugin-dir
+var pluginSchemaDir string
+
+// validateDashboard returns the validation errors of a migrated dashboard, none when it is valid
+func validateDashboard(jsonData []byte) []string {
+	// Decoding runs the validation of the Perses model: kind, names, panel references and layouts
+	var dashboard persesv1.Dashboard
+	if err := json.Unmarshal(jsonData, &dashboard); err != nil {
+		return []string{err.Error()}
+	}
+
+	var errs []string
+	if _, err := utils.BuildVariableOrder(dashboard.Spec.Variables, nil, nil); err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, variable := range dashboard.Spec.Variables {
+		name := variable.Spec.GetName()
+		if !variableNameRegexp.MatchString(name) {
+			errs = append(errs, fmt.Sprintf("variable name '%s' is not valid", name))
+		} else if persesv1.IsBuiltinVariable(name) {
+			errs = append(errs, fmt.Sprintf("variable name '%s' can not have builtin variable prefix: __", name))
+		}
+	}
+
+	names := make([]string, 0, len(dashboard.Spec.Datasources))
+	for name := range dashboard.Spec.Datasources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	defaults := make(map[string]string)
+	for _, name := range names {
+		spec := dashboard.Spec.Datasources[name]
+		if _, _, err := datasource.ValidateAndExtract(spec.Plugin.Spec); err != nil {
+			errs = append(errs, fmt.Sprintf("datasource %s: %v", name, err))
+		}
+		if !spec.Default {
+			continue
+		}
+		if previous, ok := defaults[spec.Plugin.Kind]; ok {
+			errs = append(errs, fmt.Sprintf("datasources %s and %s are both the default %s", previous, name, spec.Plugin.Kind))
+			continue
+		}
+		defaults[spec.Plugin.Kind] = name
+	}
+
+	if pluginSchemaDir != "" {
+		if err := lintDashboard(jsonData); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	return errs
+}
+
+// lintDashboard checks the plugin specs of a dashboard against the plugin schemas with percli lint
+func lintDashboard(jsonData []byte) error {
+	cmd := exec.Command(percliBinPath, "lint", "-f", "-", "--plugin.path", pluginSchemaDir)
+	cmd.Stdin = bytes.NewReader(jsonData)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		message := strings.TrimSpace(string(output))
+		if message == "" {
+			message = err.Error()
+		}
+		return fmt.Errorf("plugin schema: %s", strings.TrimPrefix(message, "Error: "))
+	}
+	return nil
+}
+
+// preparePluginDir returns the plugin directory to validate with. Plugin archives (.tar.gz), as published with the
+// Perses plugin releases, are extracted to a temporary directory that the returned function removes.
+func preparePluginDir(dir string) (string, func(), error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read plugin directory: %v", err)
+	}
+
+	var archives []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isPluginArchive(entry.Name()) {
+			archives = append(archives, entry.Name())
+		}
+	}
+	if len(archives) == 0 {
+		return dir, func() {}, nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "perses-plugins-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+	for _, archive := range archives {
+		name := strings.TrimSuffix(strings.TrimSuffix(archive, ".tgz"), ".tar.gz")
+		if err := extractTarGz(filepath.Join(dir, archive), filepath.Join(tmpDir, name)); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("failed to extract plugin archive %s: %v", archive, err)
+		}
+	}
+	return tmpDir, cleanup, nil
+}
+
+func isPluginArchive(name string) bool {
+	return strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// extractTarGz extracts the regular files of a tar.gz archive below targetDir
+func extractTarGz(archive, targetDir string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		target := filepath.Join(targetDir, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(target, filepath.Clean(targetDir)+string(os.PathSeparator)) {
+			return fmt.Errorf("invalid file path %q in archive", header.Name)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		outFile, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(outFile, tarReader); err != nil {
+			outFile.Close()
+			return err
+		}
+		if err := outFile.Close(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateDashboard(t *testing.T) {
+	const prometheus = `"plugin": {"kind": "PrometheusDatasource", "spec": {"directUrl": "http://prometheus:9090"}}`
+	labelValues := func(name, matcher string) string {
+		return `{"kind": "ListVariable", "spec": {"name": "` + name + `", "plugin": {"kind": "PrometheusLabelValuesVariable",
+			"spec": {"labelName": "job", "matchers": ["` + matcher + `"]}}}}`
+	}
+	tests := []struct {
+		name        string
+		datasources string
+		variables   string
+		want        []string // prefixes of the validation errors
+	}{
+		{
+			name:        "valid",
+			datasources: `"prom": {"default": true, ` + prometheus + `}, "thanos": {"default": false, ` + prometheus + `}`,
+			variables:   labelValues("job", "up") + `, ` + labelValues("instance", `up{job=\"$job\"}`),
+		},
+		{
+			name:        "two defaults of a kind",
+			datasources: `"prom": {"default": true, ` + prometheus + `}, "thanos": {"default": true, ` + prometheus + `}`,
+			want:        []string{"datasources prom and thanos are both the default PrometheusDatasource"},
+		},
+		{
+			name:        "invalid datasource spec",
+			datasources: `"prom": {"default": true, "plugin": {"kind": "PrometheusDatasource", "spec": {"proxy": {"kind": "HTTPProxy", "spec": {}}}}}`,
+			want:        []string{"datasource prom: "},
+		},
+		{name: "numeric variable name", variables: labelValues("42", "up"), want: []string{"variable name '42' is not valid"}},
+		{name: "builtin variable prefix", variables: labelValues("__job", "up"), want: []string{"variable name '__job' can not have builtin variable prefix: __"}},
+		{
+			name:      "variable cycle",
+			variables: labelValues("a", `up{job=\"$b\"}`) + `, ` + labelValues("b", `up{job=\"$a\"}`),
+			want:      []string{"circular dependency detected"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dashboard := `{"kind": "Dashboard", "metadata": {"name": "test", "project": "team"}, "spec": {"duration": "1h",
+				"panels": {}, "layouts": [], "datasources": {` + test.datasources + `}, "variables": [` + test.variables + `]}}`
+
+			errs := validateDashboard([]byte(dashboard))
+			if len(errs) != len(test.want) {
+				t.Fatalf("errors = %q, want %q", errs, test.want)
+			}
+			for i, err := range errs {
+				if !strings.HasPrefix(err, test.want[i]) {
+					t.Errorf("error %q, want %q", err, test.want[i])
+				}
+			}
+		})
+	}
+
+	if errs := validateDashboard([]byte(`{"kind": "Dashboard", "metadata": {"name": "test"}, "spec": {"duration": "1h",
+		"panels": {}, "layouts": [{"kind": "Grid", "spec": {"items": [{"content": {"$ref": "#/spec/panels/missing"}}]}}]}}`)); len(errs) != 1 {
+		t.Errorf("errors of a dashboard that doesn't decode = %q, want one", errs)
+	}
+}
+
+func TestRejectInvalid(t *testing.T) {
+	setDatasourceOptions(t, nil, true)
+	setNamingOptions(t, namingTitle, collisionSuffix)
+	previousOutputDir := *outputDir
+	defer func() { *outputDir = previousOutputDir }()
+	*outputDir = t.TempDir()
+
+	inputDir := t.TempDir()
+	dashboards := map[string]string{
+		"valid.json": `{"title": "Valid", "uid": "valid", "schemaVersion": 39, "templating": {"list": [
+			{"type": "custom", "name": "env", "query": "prod,dev"}]}}`,
+		// Perses doesn't allow variable names made of digits only
+		"invalid.json": `{"title": "Invalid", "uid": "invalid", "schemaVersion": 39, "templating": {"list": [
+			{"type": "custom", "name": "1", "query": "prod,dev"}]}}`,
+	}
+	for name, content := range dashboards {
+		if err := os.WriteFile(filepath.Join(inputDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func() *MigrationSummary {
+		t.Helper()
+		summary, err := runMigrationPipeline(inputDir, filepath.Join(*outputDir, "grafana-schema-latest"), filepath.Join(*outputDir, "perses"))
+		if err != nil {
+			t.Fatalf("migration failed: %v", err)
+		}
+		return summary
+	}
+	invalidOutput := filepath.Join(*outputDir, "perses", "invalid.json")
+
+	// Without --reject-invalid, the invalid dashboard is written with its validation errors
+	setFlag(t, "reject-invalid", "false")
+	summary := run()
+	if !reflect.DeepEqual(summary.ValidationFailed, []string{"invalid.json"}) || summary.totalFailures() != 0 {
+		t.Errorf("validation failed = %q, failures = %d, want invalid.json and no failure", summary.ValidationFailed, summary.totalFailures())
+	}
+	if !fileExists(invalidOutput) {
+		t.Fatal("the invalid dashboard was not written")
+	}
+
+	// With --reject-invalid, it is rejected: migrated but not written, and failed in the validation stage
+	setFlag(t, "reject-invalid", "true")
+	summary = run()
+	if len(summary.MigrationFailed) != 0 || summary.MigrationSuccess != 2 {
+		t.Errorf("migration failed = %q, succeeded = %d, want the rejected dashboard counted as migrated", summary.MigrationFailed, summary.MigrationSuccess)
+	}
+	if !reflect.DeepEqual(summary.ValidationFailed, []string{"invalid.json"}) || summary.ValidationSuccess != 1 {
+		t.Errorf("validation failed = %q, succeeded = %d, want invalid.json rejected", summary.ValidationFailed, summary.ValidationSuccess)
+	}
+	if summary.totalFailures() != 1 {
+		t.Errorf("failures = %d, want the rejected dashboard", summary.totalFailures())
+	}
+	for _, dashboard := range summary.Dashboards {
+		want := dashboardReport{Status: statusSucceeded, Stage: stageMigrated}
+		if dashboard.InputPath == "invalid.json" {
+			want = dashboardReport{Status: statusFailed, Stage: stageMigrated, FailedStage: failedValidation}
+		}
+		if dashboard.Status != want.Status || dashboard.Stage != want.Stage || dashboard.FailedStage != want.FailedStage {
+			t.Errorf("%s: status %s, stage %s, failed stage %q, want %+v", dashboard.InputPath, dashboard.Status, dashboard.Stage, dashboard.FailedStage, want)
+		}
+	}
+	if fileExists(invalidOutput) {
+		t.Error("the output of the rejected dashboard from the previous run was kept")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+	"github.com/perses/perses/pkg/model/api/v1/dashboard"
+)
+
+// The variables of every migrated dashboard are audited against the Grafana templating. Variables the migration
+// dropped or replaced with a placeholder are converted again when the native converter supports them, like custom
+// and interval variables to static lists and constants to text variables. The Grafana variable syntax that Perses
+// doesn't interpolate is rewritten in the PromQL of the queries and variables: [[var]], [[var:format]] and the old
+// $interval. What can't be converted is reported as unsupported features. With --fix-variables=false, the dashboards
+// are only audited.
+
+// grafanaVariableUsageRegex matches [[var]], [[var:format]], ${var}, ${var:format} and $var
+var grafanaVariableUsageRegex = regexp.MustCompile(`\[\[(\w+)(?::(\w+))?\]\]|\$\{(\w+)(?::([^}]*))?\}|\$(\w+)`)
+
+// persesBuiltinVariables are the builtin variables of Perses and of its Prometheus plugin
+var persesBuiltinVariables = map[string]bool{
+	"__dashboard":     true,
+	"__project":       true,
+	"__from":          true,
+	"__to":            true,
+	"__range":         true,
+	"__range_s":       true,
+	"__range_ms":      true,
+	"__interval":      true,
+	"__interval_ms":   true,
+	"__rate_interval": true,
+}
+
+// grafanaLegacyVariables are the builtin variables of old Grafana versions that Perses knows under another name
+var grafanaLegacyVariables = map[string]string{
+	"interval": "__interval",
+}
+
+// persesVariableFormats are the ${var:format} formats Perses interpolates like Grafana; the others, like date, are
+// not supported
+var persesVariableFormats = map[string]bool{
+	"csv":                 true,
+	"distributed":         true,
+	"doublequote":         true,
+	"glob":                true,
+	"json":                true,
+	"lucene":              true,
+	"percentencode":       true,
+	"pipe":                true,
+	"queryparam":          true,
+	"raw":                 true,
+	"regex":               true,
+	"singlequote":         true,
+	"singlevariablevalue": true,
+	"sqlstring":           true,
+	"text":                true,
+}
+
+// variableAudit collects the changes and the unsupported features found while auditing the variables
+type variableAudit struct {
+	fix         bool
+	variables   map[string]bool // names of the dashboard variables
+	fixes       []string
+	unsupported []unsupportedFeature
+}
+
+// auditVariables audits the variables of a migrated dashboard against the Grafana dashboard it was migrated from, and
+// fixes them in place with fix. It returns the fixes and the features that can't be converted.
+func auditVariables(grafana grafanaDashboard, persesDashboard *persesv1.Dashboard, fix bool) ([]string, []unsupportedFeature) {
+	audit := &variableAudit{fix: fix, variables: make(map[string]bool)}
+	persesDashboard.Spec.Variables = audit.auditDefinitions(grafana.Templating.List, persesDashboard.Spec.Variables)
+	for _, v := range persesDashboard.Spec.Variables {
+		audit.variables[v.Spec.GetName()] = true
+	}
+
+	keys := make([]string, 0, len(persesDashboard.Spec.Panels))
+	for key := range persesDashboard.Spec.Panels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		panel := persesDashboard.Spec.Panels[key]
+		for i := range panel.Spec.Queries {
+			plugin := &panel.Spec.Queries[i].Spec.Plugin
+			if spec, ok := plugin.Spec.(map[string]any); ok && plugin.Kind == "PrometheusTimeSeriesQuery" {
+				audit.rewriteField(spec, "query", fmt.Sprintf("panel %q", panel.Spec.Display.Name), panel.Spec.Display.Name)
+			}
+		}
+	}
+	for _, v := range persesDashboard.Spec.Variables {
+		listSpec, ok := v.Spec.(*dashboard.ListVariableSpec)
+		if !ok {
+			continue
+		}
+		spec, ok := listSpec.Plugin.Spec.(map[string]any)
+		if !ok {
+			continue
+		}
+		location := "variable " + listSpec.Name
+		audit.rewriteField(spec, "expr", location, "")
+		if matchers, ok := spec["matchers"].([]any); ok {
+			for i := range matchers {
+				if matcher, ok := matchers[i].(string); ok {
+					matchers[i] = audit.rewrite(matcher, location, "")
+				}
+			}
+		}
+	}
+
+	return audit.fixes, audit.unsupported
+}
+
+// auditDefinitions returns the variables in the order of the Grafana templating, with the missing and placeholder
+// variables converted again when possible. Variables unknown to the Grafana templating are kept at the end.
+func (a *variableAudit) auditDefinitions(templateVars []grafanaTemplateVar, variables []dashboard.Variable) []dashboard.Variable {
+	existing := make(map[string]int)
+	for i, v := range variables {
+		existing[v.Spec.GetName()] = i
+	}
+
+	var result []dashboard.Variable
+	for _, templateVar := range templateVars {
+		if templateVar.Type == "interval" && templateVar.Auto {
+			a.unsupported = append(a.unsupported, unsupportedFeature{Feature: featureVariable, Detail: fmt.Sprintf("%s (interval auto option)", templateVar.Name)})
+		}
+
+		i, found := existing[templateVar.Name]
+		delete(existing, templateVar.Name)
+		if found && !isPlaceholderVariable(variables[i]) {
+			result = append(result, variables[i])
+			continue
+		}
+
+		converted, ok := convertGrafanaVariable(templateVar, templateVars)
+		switch {
+		case ok && a.fix:
+			action := "added missing"
+			if found {
+				action = "converted placeholder"
+			}
+			a.fixes = append(a.fixes, fmt.Sprintf("%s %s variable %s to %s", action, templateVar.Type, templateVar.Name, variableKind(converted)))
+			result = append(result, converted)
+		case found:
+			// The analysis reports the placeholder
+			result = append(result, variables[i])
+		default:
+			a.unsupported = append(a.unsupported, unsupportedFeature{Feature: featureVariable, Detail: fmt.Sprintf("%s (%s, missing)", templateVar.Name, templateVar.Type)})
+		}
+	}
+
+	for i, v := range variables {
+		if _, ok := existing[v.Spec.GetName()]; ok {
+			result = append(result, variables[i])
+		}
+	}
+	return result
+}
+
+// convertGrafanaVariable converts a Grafana variable with the native converter, if it supports its type
+func convertGrafanaVariable(v grafanaTemplateVar, variables []grafanaTemplateVar) (dashboard.Variable, bool) {
+	if v.Type == "constant" || v.Type == "textbox" {
+		return convertTextVariable(v), true
+	}
+	if _, ok := convertVariablePlugin(v, variables); !ok {
+		return dashboard.Variable{}, false
+	}
+	return convertListVariable(v, variables), true
+}
+
+// isPlaceholderVariable tells whether the migration replaced a variable with the placeholder of unsupported variables
+func isPlaceholderVariable(v dashboard.Variable) bool {
+	listSpec, ok := v.Spec.(*dashboard.ListVariableSpec)
+	if !ok {
+		return false
+	}
+	data, err := json.Marshal(listSpec.Plugin)
+	if err != nil {
+		return false
+	}
+	var plugin map[string]any
+	if err := json.Unmarshal(data, &plugin); err != nil {
+		return false
+	}
+	return isPlaceholder(plugin, unsupportedVariablePlugin, "values")
+}
+
+// variableKind returns the plugin kind of a list variable, or the kind of the variable
+func variableKind(v dashboard.Variable) string {
+	if listSpec, ok := v.Spec.(*dashboard.ListVariableSpec); ok {
+		return listSpec.Plugin.Kind
+	}
+	return string(v.Kind)
+}
+
+// rewriteField rewrites the variable usages of a string field of a plugin spec
+func (a *variableAudit) rewriteField(spec map[string]any, field, location, panel string) {
+	if text, ok := spec[field].(string); ok {
+		spec[field] = a.rewrite(text, location, panel)
+	}
+}
+
+// rewrite rewrites the Grafana variable usages of a PromQL expression to the Perses syntax. Usages without a Perses
+// equivalent are reported; with --fix-variables=false, every usage that needs a rewrite is.
+func (a *variableAudit) rewrite(text, location, panel string) string {
+	var result strings.Builder
+	last := 0
+	for _, match := range grafanaVariableUsageRegex.FindAllStringSubmatchIndex(text, -1) {
+		usage := text[match[0]:match[1]]
+		replacement, ok := a.convertUsage(usage, submatch(text, match, 1)+submatch(text, match, 3)+submatch(text, match, 5),
+			submatch(text, match, 2)+submatch(text, match, 4))
+		switch {
+		case !ok:
+			a.unsupported = append(a.unsupported, unsupportedFeature{Feature: featureVariableUsage, Panel: panel, Detail: usageDetail(usage, location, panel)})
+			continue
+		case replacement == usage:
+			continue
+		case !a.fix:
+			a.unsupported = append(a.unsupported, unsupportedFeature{Feature: featureVariableUsage, Panel: panel, Detail: usageDetail(usage, location, panel)})
+			continue
+		}
+		a.fixes = append(a.fixes, fmt.Sprintf("rewrote %s to %s in %s", usage, replacement, location))
+		result.WriteString(text[last:match[0]])
+		result.WriteString(replacement)
+		last = match[1]
+	}
+	if last == 0 {
+		return text
+	}
+	result.WriteString(text[last:])
+	return result.String()
+}
+
+// convertUsage returns the Perses syntax of a variable usage, and false when it has no Perses equivalent
+func (a *variableAudit) convertUsage(usage, name, format string) (string, bool) {
+	if renamed, ok := grafanaLegacyVariables[name]; ok && !a.variables[name] {
+		name = renamed
+	} else if !a.variables[name] && !persesBuiltinVariables[name] {
+		// Grafana builtins like $__timeFilter have no equivalent; other names, like $1 in label_replace, are not variables
+		return usage, !strings.HasPrefix(name, "__") && name != "timeFilter"
+	}
+
+	switch {
+	case format != "" && !persesVariableFormats[format]:
+		return usage, false
+	case format != "":
+		return "${" + name + ":" + format + "}", true
+	case strings.HasPrefix(usage, "$") && !strings.HasPrefix(usage, "${"):
+		return "$" + name, true
+	}
+	return "${" + name + "}", true
+}
+
+func submatch(text string, match []int, group int) string {
+	if match[2*group] < 0 {
+		return ""
+	}
+	return text[match[2*group]:match[2*group+1]]
+}
+
+// usageDetail describes where a variable usage is, panels are named by the feature itself
+func usageDetail(usage, location, panel string) string {
+	if panel != "" {
+		return usage
+	}
+	return usage + " in " + location
+}
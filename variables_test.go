@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestConvertUsage(t *testing.T) {
+	type usage struct {
+		usage, name, format string
+		want                string
+		wantOK              bool
+	}
+	tests := []usage{
+		{usage: "$job", name: "job", want: "$job", wantOK: true},
+		{usage: "${job}", name: "job", want: "${job}", wantOK: true},
+		{usage: "[[job]]", name: "job", want: "${job}", wantOK: true},
+		{usage: "$interval", name: "interval", want: "$__interval", wantOK: true},
+		{usage: "[[interval]]", name: "interval", want: "${__interval}", wantOK: true},
+		{usage: "$__rate_interval", name: "__rate_interval", want: "$__rate_interval", wantOK: true},
+		{usage: "$__timeFilter", name: "__timeFilter", want: "$__timeFilter"},
+		{usage: "$timeFilter", name: "timeFilter", want: "$timeFilter"},
+		{usage: "$1", name: "1", want: "$1", wantOK: true},
+		{usage: "${job:date}", name: "job", format: "date", want: "${job:date}"},
+		{usage: "${__from:date:iso}", name: "__from", format: "date:iso", want: "${__from:date:iso}"},
+		{usage: "${job:unknown}", name: "job", format: "unknown", want: "${job:unknown}"},
+		{usage: "[[job:date]]", name: "job", format: "date", want: "[[job:date]]"},
+		{usage: "${interval:csv}", name: "interval", format: "csv", want: "${__interval:csv}", wantOK: true},
+	}
+	// Every format Perses supports is kept, [[var:format]] becomes ${var:format}
+	formats := make([]string, 0, len(persesVariableFormats))
+	for format := range persesVariableFormats {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	for _, format := range formats {
+		tests = append(tests,
+			usage{usage: "${job:" + format + "}", name: "job", format: format, want: "${job:" + format + "}", wantOK: true},
+			usage{usage: "[[job:" + format + "]]", name: "job", format: format, want: "${job:" + format + "}", wantOK: true},
+		)
+	}
+
+	audit := &variableAudit{fix: true, variables: map[string]bool{"job": true}}
+	for _, test := range tests {
+		t.Run(test.usage, func(t *testing.T) {
+			got, ok := audit.convertUsage(test.usage, test.name, test.format)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("convertUsage(%q) = %q, %t, want %q, %t", test.usage, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestRewriteVariableUsages(t *testing.T) {
+	const query = `sum by (job) (rate(up{job=~"[[job:regex]]", env="${env:csv}", day="${env:date}"}[$interval]))`
+	tests := []struct {
+		name            string
+		fix             bool
+		want            string
+		wantFixes       []string
+		wantUnsupported []string
+	}{
+		{
+			name: "fix",
+			fix:  true,
+			want: `sum by (job) (rate(up{job=~"${job:regex}", env="${env:csv}", day="${env:date}"}[$__interval]))`,
+			wantFixes: []string{
+				`rewrote [[job:regex]] to ${job:regex} in panel "CPU"`,
+				`rewrote $interval to $__interval in panel "CPU"`,
+			},
+			wantUnsupported: []string{`${env:date}`},
+		},
+		{
+			name:            "audit only",
+			want:            query,
+			wantUnsupported: []string{`[[job:regex]]`, `${env:date}`, `$interval`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			audit := &variableAudit{fix: test.fix, variables: map[string]bool{"job": true, "env": true}}
+			if got := audit.rewrite(query, `panel "CPU"`, "CPU"); got != test.want {
+				t.Errorf("rewrite = %q, want %q", got, test.want)
+			}
+			if !reflect.DeepEqual(audit.fixes, test.wantFixes) {
+				t.Errorf("fixes = %q, want %q", audit.fixes, test.wantFixes)
+			}
+			var unsupported []string
+			for _, feature := range audit.unsupported {
+				unsupported = append(unsupported, feature.Detail)
+			}
+			if !reflect.DeepEqual(unsupported, test.wantUnsupported) {
+				t.Errorf("unsupported = %q, want %q", unsupported, test.wantUnsupported)
+			}
+		})
+	}
+}
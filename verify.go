@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	persesv1 "github.com/perses/perses/pkg/model/api/v1"
+	"github.com/perses/perses/pkg/model/api/v1/dashboard"
+)
+
+// With --verify-prometheus-url, the PromQL queries of every migrated dashboard are run against a Prometheus
+// compatible API, like Prometheus, Thanos or Mimir, over the last --verify-range. The variables are resolved to their
+// default values, or to all values, so the queries return what the dashboard shows when it is opened. Queries that
+// return no data, fail or take longer than --verify-slow are reported; they don't fail the migration.
+
+const (
+	queryEmpty  = "empty"
+	queryFailed = "error"
+	querySlow   = "slow"
+)
+
+// grafanaAllValue is the value of list variables defaulting to All in Grafana dashboards
+const grafanaAllValue = "$__all"
+
+// queryProblem is a migrated query that returned no data, failed or was slow. A query has a single problem; an empty
+// or failed query that was also slow is marked Slow.
+type queryProblem struct {
+	Location   string `json:"location"`
+	Problem    string `json:"problem"` // empty, error or slow
+	Slow       bool   `json:"slow,omitempty"`
+	Query      string `json:"query"` // with the variables resolved
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// types returns the problem types a query counts for in the totals: its problem, and slow when it was also slow
+func (p queryProblem) types() []string {
+	if p.Slow && p.Problem != querySlow {
+		return []string{p.Problem, querySlow}
+	}
+	return []string{p.Problem}
+}
+
+type queryVerifier struct {
+	baseURL    string
+	token      string
+	queryRange time.Duration
+	slow       time.Duration
+	http       *http.Client
+}
+
+// prometheusResponse is the response of the Prometheus HTTP API, for errors too
+type prometheusResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string            `json:"resultType"`
+		Result     []json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// newQueryVerifier validates the verification flags
+func newQueryVerifier() (*queryVerifier, error) {
+	if *verifyRange <= 0 {
+		return nil, fmt.Errorf("invalid --verify-range %s, use a positive duration like 1h", *verifyRange)
+	}
+	verifier := &queryVerifier{
+		baseURL:    strings.TrimSuffix(*verifyPrometheusURL, "/"),
+		token:      *verifyToken,
+		queryRange: *verifyRange,
+		slow:       *verifySlow,
+		http:       &http.Client{Timeout: 2 * time.Minute},
+	}
+	if verifier.token == "" {
+		verifier.token = os.Getenv("PROMETHEUS_TOKEN")
+	}
+	return verifier, nil
+}
+
+// verify runs the queries of a migrated dashboard file and returns the number of queries run and the problems
+func (v *queryVerifier) verify(dashboardInfo *DashboardInfo, out *dashboardOutput) (int, []queryProblem, error) {
+	data, err := readOutputFile(dashboardInfo.PersesFile)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read migrated dashboard: %v", err)
+	}
+	var persesDashboard persesv1.Dashboard
+	if err := json.Unmarshal(data, &persesDashboard); err != nil {
+		return 0, nil, fmt.Errorf("failed to parse migrated dashboard: %v", err)
+	}
+
+	end := time.Now()
+	start := end.Add(-v.queryRange)
+	step := max(v.queryRange/250, 15*time.Second).Truncate(time.Second)
+	values := v.variableValues(&persesDashboard, start, end, step)
+
+	count := 0
+	var problems []queryProblem
+	walkPromQL(&persesDashboard, func(location, field, text string) string {
+		// Variable expressions list values, the matchers of label variables are not queries
+		if field != "query" || strings.TrimSpace(text) == "" {
+			return text
+		}
+		query := resolveVariables(text, values)
+		count++
+		// Queries that don't parse would fail, they are not run
+		if err := parsePromQL(text); err != nil {
+			problems = append(problems, queryProblem{Location: location, Problem: queryFailed, Query: query, Error: err.Error()})
+			return text
+		}
+
+		startedAt := time.Now()
+		empty, err := v.queryRangeEmpty(query, start, end, step)
+		duration := time.Since(startedAt)
+		problem := queryProblem{Location: location, Query: query, DurationMs: duration.Milliseconds()}
+		problem.Slow = v.slow > 0 && duration > v.slow
+		switch {
+		case err != nil:
+			problem.Problem, problem.Error = queryFailed, err.Error()
+		case empty:
+			problem.Problem = queryEmpty
+		case problem.Slow:
+			problem.Problem = querySlow
+		default:
+			return text
+		}
+		problems = append(problems, problem)
+		return text
+	})
+
+	for _, problem := range problems {
+		out.Printf("    → Query %s\n", describeQueryProblem(problem))
+	}
+	return count, problems, nil
+}
+
+// describeQueryProblem describes a query problem on one line, like "empty in panel "CPU": sum(rate(...))"
+func describeQueryProblem(problem queryProblem) string {
+	detail := problem.Query
+	switch {
+	case problem.Error != "":
+		detail = problem.Error
+	case problem.Problem == querySlow:
+		detail = fmt.Sprintf("%dms: %s", problem.DurationMs, problem.Query)
+	}
+	kind := problem.Problem
+	if problem.Slow && problem.Problem != querySlow {
+		kind = fmt.Sprintf("%s and slow (%dms)", problem.Problem, problem.DurationMs)
+	}
+	return fmt.Sprintf("%s in %s: %s", kind, problem.Location, detail)
+}
+
+// queryRangeEmpty runs a range query and tells whether it returned no series
+func (v *queryVerifier) queryRangeEmpty(query string, start, end time.Time, step time.Duration) (bool, error) {
+	form := url.Values{
+		"query": {query},
+		"start": {strconv.FormatInt(start.Unix(), 10)},
+		"end":   {strconv.FormatInt(end.Unix(), 10)},
+		"step":  {strconv.FormatFloat(step.Seconds(), 'f', -1, 64)},
+	}
+	req, err := http.NewRequest(http.MethodPost, v.baseURL+"/api/v1/query_range", strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if v.token != "" {
+		req.Header.Set("Authorization", "Bearer "+v.token)
+	}
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("query failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var response prometheusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return false, fmt.Errorf("query failed with status %d: invalid response: %v", resp.StatusCode, err)
+	}
+	if response.Status != "success" {
+		return false, fmt.Errorf("%s: %s", response.ErrorType, response.Error)
+	}
+	return len(response.Data.Result) == 0, nil
+}
+
+// variableValues returns the value of every variable for the verification: the default value, all values when the
+// default is the All value or when there is no default, and the builtin variables of the time range
+func (v *queryVerifier) variableValues(persesDashboard *persesv1.Dashboard, start, end time.Time, step time.Duration) map[string]string {
+	rateInterval := max(step+15*time.Second, time.Minute)
+	values := map[string]string{
+		"__dashboard":     persesDashboard.Metadata.Name,
+		"__project":       persesDashboard.Metadata.Project,
+		"__from":          strconv.FormatInt(start.UnixMilli(), 10),
+		"__to":            strconv.FormatInt(end.UnixMilli(), 10),
+		"__range":         promqlSeconds(v.queryRange),
+		"__range_s":       strconv.FormatInt(int64(v.queryRange.Seconds()), 10),
+		"__range_ms":      strconv.FormatInt(v.queryRange.Milliseconds(), 10),
+		"__interval":      promqlSeconds(step),
+		"__interval_ms":   strconv.FormatInt(step.Milliseconds(), 10),
+		"__rate_interval": promqlSeconds(rateInterval),
+	}
+
+	for _, persesVariable := range persesDashboard.Spec.Variables {
+		switch spec := persesVariable.Spec.(type) {
+		case *dashboard.TextVariableSpec:
+			values[spec.Name] = spec.Value
+		case *dashboard.ListVariableSpec:
+			values[spec.Name] = listDefaultValue(spec)
+		}
+	}
+	return values
+}
+
+// listDefaultValue returns the value a list variable has when the dashboard is opened. Multiple values are joined
+// as a regex alternation, like Perses does, and values that need a query to be known match everything.
+func listDefaultValue(spec *dashboard.ListVariableSpec) string {
+	allValue := ".*"
+	if spec.CustomAllValue != "" {
+		allValue = spec.CustomAllValue
+	}
+
+	var defaults []string
+	if spec.DefaultValue != nil {
+		defaults = spec.DefaultValue.SliceValues
+		if spec.DefaultValue.SingleValue != "" {
+			defaults = []string{spec.DefaultValue.SingleValue}
+		}
+	}
+	if len(defaults) == 0 && !spec.AllowAllValue {
+		defaults = staticListValues(spec)
+		if len(defaults) > 1 {
+			defaults = defaults[:1]
+		}
+	}
+
+	for _, value := range defaults {
+		if value == grafanaAllValue {
+			return allValue
+		}
+	}
+	switch len(defaults) {
+	case 0:
+		return allValue
+	case 1:
+		return defaults[0]
+	}
+	return "(" + strings.Join(defaults, "|") + ")"
+}
+
+// staticListValues returns the values of a static list variable, which are strings or {value, label} objects
+func staticListValues(spec *dashboard.ListVariableSpec) []string {
+	pluginSpec, ok := spec.Plugin.Spec.(map[string]any)
+	if !ok || spec.Plugin.Kind != "StaticListVariable" {
+		return nil
+	}
+	list, _ := pluginSpec["values"].([]any)
+	var values []string
+	for _, item := range list {
+		switch value := item.(type) {
+		case string:
+			values = append(values, value)
+		case map[string]any:
+			if text, ok := value["value"].(string); ok {
+				values = append(values, text)
+			}
+		}
+	}
+	return values
+}
+
+// resolveVariables replaces the variables of a query with their values. Unknown variables are left as they are,
+// like Perses does, so the query fails as it would in the dashboard.
+func resolveVariables(query string, values map[string]string) string {
+	return grafanaVariableUsageRegex.ReplaceAllStringFunc(query, func(usage string) string {
+		match := grafanaVariableUsageRegex.FindStringSubmatch(usage)
+		if value, ok := values[match[1]+match[3]+match[5]]; ok {
+			return value
+		}
+		return usage
+	})
+}
+
+// promqlSeconds formats a duration for PromQL in whole seconds
+func promqlSeconds(d time.Duration) string {
+	return fmt.Sprintf("%ds", max(int64(d.Seconds()), 1))
+}
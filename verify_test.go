@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeQuery is how the fake Prometheus answers a query
+type fakeQuery struct {
+	series int
+	status int    // HTTP status, 200 if zero
+	body   string // raw response body instead of a Prometheus response
+	delay  time.Duration
+}
+
+// fakePrometheus is a stand-in for the range query endpoint of the Prometheus API. Unknown queries return a series.
+type fakePrometheus struct {
+	mutex   sync.Mutex
+	queries map[string]fakeQuery
+	token   string   // Authorization header of the last request
+	run     []string // queries run, in order
+}
+
+func (f *fakePrometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/api/v1/query_range" {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.FormValue("query")
+	f.mutex.Lock()
+	f.run = append(f.run, query)
+	f.token = r.Header.Get("Authorization")
+	answer, ok := f.queries[query]
+	f.mutex.Unlock()
+	if !ok {
+		answer = fakeQuery{series: 1}
+	}
+
+	time.Sleep(answer.delay)
+	if answer.status != 0 {
+		w.WriteHeader(answer.status)
+	}
+	if answer.body != "" {
+		_, _ = w.Write([]byte(answer.body))
+		return
+	}
+	result := make([]map[string]any, answer.series)
+	for i := range result {
+		result[i] = map[string]any{"metric": map[string]string{"series": fmt.Sprint(i)}, "values": [][]any{}}
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"data":   map[string]any{"resultType": "matrix", "result": result},
+	})
+}
+
+// verifyVariables are the variables of the verified dashboards: a list variable with a default value, a list
+// variable defaulting to All and a text variable
+const verifyVariables = `[
+	{"kind": "ListVariable", "spec": {"name": "job", "defaultValue": "api",
+		"plugin": {"kind": "PrometheusLabelValuesVariable", "spec": {"labelName": "job"}}}},
+	{"kind": "ListVariable", "spec": {"name": "instance", "defaultValue": "$__all", "allowAllValue": true, "allowMultiple": true,
+		"plugin": {"kind": "PrometheusLabelValuesVariable", "spec": {"labelName": "instance"}}}},
+	{"kind": "TextVariable", "spec": {"name": "env", "value": "prod"}}
+]`
+
+// writeVerifiedDashboard writes a migrated dashboard with a panel running the query
+func writeVerifiedDashboard(t *testing.T, query string) *DashboardInfo {
+	t.Helper()
+	var variables []any
+	if err := json.Unmarshal([]byte(verifyVariables), &variables); err != nil {
+		t.Fatal(err)
+	}
+	dashboard := map[string]any{
+		"kind":     "Dashboard",
+		"metadata": map[string]any{"name": "cpu", "project": "team"},
+		"spec": map[string]any{
+			"display":   map[string]any{"name": "CPU"},
+			"duration":  "1h",
+			"variables": variables,
+			"panels": map[string]any{"0": map[string]any{"kind": "Panel", "spec": map[string]any{
+				"display": map[string]any{"name": "Usage"},
+				"plugin":  map[string]any{"kind": "TimeSeriesChart", "spec": map[string]any{}},
+				"queries": []any{map[string]any{"kind": "TimeSeriesQuery", "spec": map[string]any{
+					"plugin": map[string]any{"kind": "PrometheusTimeSeriesQuery", "spec": map[string]any{"query": query}},
+				}}},
+			}}},
+		},
+	}
+	data, err := json.Marshal(dashboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cpu.json")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &DashboardInfo{PersesFile: path, RelativePath: "team/cpu.json"}
+}
+
+func TestVerifyQueries(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		answer      *fakeQuery // answer to the resolved query, a series by default
+		wantRun     string     // resolved query sent to Prometheus, none if empty
+		wantProblem string
+		wantSlow    bool
+		wantError   string
+	}{
+		{name: "series", query: "up", wantRun: "up"},
+		{name: "empty", query: "absent_metric", answer: &fakeQuery{}, wantRun: "absent_metric", wantProblem: queryEmpty},
+		{
+			name: "error", query: "up / on(job) group_left up", wantRun: "up / on(job) group_left up",
+			answer:      &fakeQuery{status: http.StatusUnprocessableEntity, body: `{"status":"error","errorType":"execution","error":"many-to-many matching not allowed"}`},
+			wantProblem: queryFailed, wantError: "execution: many-to-many matching not allowed",
+		},
+		{
+			name: "error status without response", query: "up", wantRun: "up",
+			answer:      &fakeQuery{status: http.StatusBadGateway, body: "bad gateway"},
+			wantProblem: queryFailed, wantError: "query failed with status 502",
+		},
+		{name: "slow", query: "slow_metric", answer: &fakeQuery{series: 1, delay: 300 * time.Millisecond}, wantRun: "slow_metric", wantProblem: querySlow, wantSlow: true},
+		{name: "empty and slow", query: "slow_absent", answer: &fakeQuery{delay: 300 * time.Millisecond}, wantRun: "slow_absent", wantProblem: queryEmpty, wantSlow: true},
+		{
+			name: "error and slow", query: "slow_error", wantRun: "slow_error",
+			answer:      &fakeQuery{status: http.StatusServiceUnavailable, body: `{"status":"error","errorType":"timeout","error":"query timed out"}`, delay: 300 * time.Millisecond},
+			wantProblem: queryFailed, wantSlow: true, wantError: "timeout: query timed out",
+		},
+		{name: "list and text variables", query: `up{job="$job",env="${env}"}`, wantRun: `up{job="api",env="prod"}`},
+		{name: "all value", query: `up{instance=~"[[instance]]"}`, wantRun: `up{instance=~".*"}`},
+		{name: "builtin variables", query: "rate(up[$__rate_interval])", wantRun: "rate(up[60s])"},
+		{name: "unknown variable is kept", query: `up{job="$missing"}`, wantRun: `up{job="$missing"}`},
+		{name: "invalid query is not run", query: `rate(up{job="$job"}[5m]`, wantProblem: queryFailed, wantError: "parse error: unclosed left parenthesis"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakePrometheus{queries: make(map[string]fakeQuery)}
+			if test.answer != nil {
+				fake.queries[test.wantRun] = *test.answer
+			}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			verifier := &queryVerifier{
+				baseURL:    server.URL,
+				token:      "secret",
+				queryRange: time.Hour,
+				slow:       100 * time.Millisecond,
+				http:       server.Client(),
+			}
+
+			count, problems, err := verifier.verify(writeVerifiedDashboard(t, test.query), &dashboardOutput{})
+			if err != nil {
+				t.Fatalf("verify failed: %v", err)
+			}
+
+			if count != 1 {
+				t.Errorf("verified %d queries, want 1", count)
+			}
+			wantQuery := test.wantRun
+			if test.wantRun == "" {
+				if len(fake.run) != 0 {
+					t.Errorf("ran %v, want no query", fake.run)
+				}
+				wantQuery = `rate(up{job="api"}[5m]`
+			} else {
+				if len(fake.run) != 1 || fake.run[0] != test.wantRun {
+					t.Fatalf("ran %v, want %q", fake.run, test.wantRun)
+				}
+				if fake.token != "Bearer secret" {
+					t.Errorf("Authorization = %q, want the bearer token", fake.token)
+				}
+			}
+
+			if test.wantProblem == "" {
+				if len(problems) > 0 {
+					t.Errorf("problems = %+v, want none", problems)
+				}
+				return
+			}
+			if len(problems) != 1 {
+				t.Fatalf("problems = %+v, want one %s problem", problems, test.wantProblem)
+			}
+			problem := problems[0]
+			if problem.Problem != test.wantProblem || problem.Slow != test.wantSlow || problem.Location != `panel "Usage"` || problem.Query != wantQuery {
+				t.Errorf("problem = %+v, want %s (slow %t) of %q in panel \"Usage\"", problem, test.wantProblem, test.wantSlow, wantQuery)
+			}
+			if !strings.Contains(problem.Error, test.wantError) {
+				t.Errorf("problem error = %q, want %q", problem.Error, test.wantError)
+			}
+		})
+	}
+}
+
+func TestRecordVerificationCountsProblemTypes(t *testing.T) {
+	summary := &MigrationSummary{}
+	summary.recordVerification(&DashboardInfo{VerifiedQueries: 4, QueryProblems: []queryProblem{
+		{Problem: queryEmpty, Slow: true},
+		{Problem: queryFailed},
+		{Problem: querySlow, Slow: true},
+	}}, nil)
+
+	want := map[string]int{queryEmpty: 1, queryFailed: 1, querySlow: 2}
+	if !reflect.DeepEqual(summary.QueryProblems, want) {
+		t.Errorf("query problems = %v, want %v", summary.QueryProblems, want)
+	}
+	if summary.VerifiedQueries != 4 || summary.VerifiedDashboards != 1 {
+		t.Errorf("verified %d queries in %d dashboards, want 4 in 1", summary.VerifiedQueries, summary.VerifiedDashboards)
+	}
+}